@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// withAccessLog logs each request to stdout (alongside your service's own
+// output) once it has completed, in the format given by -access-log.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		fmt.Fprintln(stdout, formatAccessLog(*accessLogFlag, r, rw.status, rw.bytes, start, time.Since(start), atomic.LoadInt32(&buildNumber)))
+	})
+}
+
+// formatAccessLog formats a completed request as a log line.
+func formatAccessLog(format string, r *http.Request, status int, bytes int64, start time.Time, duration time.Duration, build int32) string {
+	switch format {
+	case "common", "combined":
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || host == "" {
+			host = "-"
+		}
+		user := "-"
+		if username, _, ok := r.BasicAuth(); ok && username != "" {
+			user = username
+		}
+		line := fmt.Sprintf("%s - %s [%s] %q %d %d", host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto, status, bytes)
+		if format == "combined" {
+			line += fmt.Sprintf(" %q %q", orDash(r.Referer()), orDash(r.UserAgent()))
+		}
+		return line
+
+	case "json":
+		line, _ := json.Marshal(map[string]interface{}{
+			"time":        start.Format(time.RFC3339Nano),
+			"method":      r.Method,
+			"path":        r.RequestURI,
+			"status":      status,
+			"bytes":       bytes,
+			"duration_ms": float64(duration) / float64(time.Millisecond),
+			"build":       build,
+		})
+		return string(line)
+
+	default:
+		return fmt.Sprintf("lrt: %s %s %d %s %dB (build %d)", r.Method, r.RequestURI, status, duration.Round(100*time.Microsecond), bytes, build)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
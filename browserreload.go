@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// browserReloadScript is added to HTML pages with -browser-reload, and
+// reloads the page when lrt says to. EventSource reconnects by itself if
+// lrt restarts.
+const browserReloadScript = `<script>new EventSource("/__lrt/browser-reload").addEventListener("reload", function () { location.reload() })</script>`
+
+// watchBrowserReloadPatterns tells the browser to reload whenever a file
+// matching one of the -browser-reload patterns changes, without rebuilding
+// or restarting the service (e.g. for templates it reads on each request).
+func watchBrowserReloadPatterns() {
+	watchPatterns(*browserReloadFlag, func(name string) {
+		infof("lrt: %s changed, reloading the browser\n", name)
+		emit("browser-reload", event{"file": name})
+	})
+}
+
+// streamBrowserReloads sends a reload event to the page for each
+// browser-reload event
+func streamBrowserReloads(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			if e["type"] == "browser-reload" {
+				fmt.Fprintf(w, "event: reload\ndata: %s\n\n", e["file"])
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// allowBrowserReloadScript asks the service not to compress HTML pages, so
+// that the script can be added to them
+func allowBrowserReloadScript(req *http.Request) {
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		req.Header.Del("Accept-Encoding")
+	}
+}
+
+// addBrowserReloadScript adds browserReloadScript to successful HTML
+// responses, before </body> if there is one. Responses that can't have a body
+// (like 204 and 304) are left alone.
+func addBrowserReloadScript(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusResetContent {
+		return nil
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || resp.Header.Get("Content-Encoding") != "" || resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>")); i >= 0 {
+		body = append(body[:i:i], append([]byte(browserReloadScript), body[i:]...)...)
+	} else {
+		body = append(body, browserReloadScript...)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
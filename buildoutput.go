@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// stableBuildOutput is set when the service is built to buildOutputDir, rather
+// than a temporary file, and lockedBuildOutput is held open (and locked) for as
+// long as lrt is using it
+var (
+	stableBuildOutput bool
+	lockedBuildOutput *os.File
+)
+
+// buildOutputMaxAge is how long a build in buildOutputDir is kept after lrt
+// last used it
+const buildOutputMaxAge = 14 * 24 * time.Hour
+
+// buildOutputDir is where the service is built: a directory per package (and
+// -service-name) in the user cache directory, or with -ram-build in ramDir. As
+// the path doesn't change, the next lrt can reuse the build if nothing has
+// changed (go build skips writing a binary that is up to date), kept builds
+// aren't cleaned up along with the temp directory during a long session, and
+// other tools can find the binary.
+func buildOutputDir() string {
+	root := ramDir
+	if root == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return ""
+		}
+		root = filepath.Join(cache, "lrt")
+	}
+	cwd, _ := os.Getwd()
+	sum := sha256.Sum256([]byte(strings.Join(append([]string{cwd, *serviceNameFlag}, packageArgs()...), "\x00")))
+	name := hex.EncodeToString(sum[:8])
+	if *serviceNameFlag != "" {
+		// so the process is easy to find
+		name = *serviceNameFlag + "-" + name
+	}
+	return filepath.Join(root, name)
+}
+
+// mustOpenBuildOutput sets tmpFile to where the service will be built: bin in
+// buildOutputDir, or a temporary file if that isn't possible, e.g. because
+// another lrt is running the same package.
+func mustOpenBuildOutput() {
+	if dir := buildOutputDir(); dir != "" {
+		f, err := openBuildOutput(dir)
+		if err == nil {
+			tmpFile, stableBuildOutput = f, true
+			debugf("lrt: building to %s\n", f.Name())
+			go pruneBuildOutputs(filepath.Dir(dir))
+			return
+		}
+		debugf("lrt: could not build to %s: %s\n", dir, err)
+	}
+
+	pattern := "lrt-service"
+	if *serviceNameFlag != "" {
+		pattern += "-" + *serviceNameFlag + "-"
+	}
+	f, err := ioutil.TempFile(ramDir, pattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+	tmpFile = f
+}
+
+// openBuildOutput locks dir, so that two lrts running the same package don't
+// replace each other's builds, removes anything a previous lrt left behind
+// apart from the build itself, and returns the file to build to. (The file is
+// only needed for its name, so it is closed.) The directory lrt was run from
+// is recorded in cwd, whose modification time says when dir was last used.
+func openBuildOutput(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("another lrt is using it")
+		}
+		return nil, err
+	}
+
+	cwd, _ := os.Getwd()
+	ioutil.WriteFile(filepath.Join(dir, "cwd"), []byte(cwd), 0644)
+	leftovers, _ := filepath.Glob(filepath.Join(dir, "bin-*"))
+	for _, file := range leftovers {
+		os.Remove(file)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "bin"), os.O_RDONLY|os.O_CREATE, 0755)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	f.Close()
+	lockedBuildOutput = lock
+	return f, nil
+}
+
+// pruneBuildOutputs removes the builds in root that no lrt is using and that
+// won't be used again: those for directories that no longer exist, and those
+// that haven't been used for buildOutputMaxAge.
+func pruneBuildOutputs(root string) {
+	infos, _ := ioutil.ReadDir(root)
+	for _, info := range infos {
+		dir := filepath.Join(root, info.Name())
+		if !info.IsDir() || dir == filepath.Dir(tmpFile.Name()) {
+			continue
+		}
+		lock, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR, 0)
+		if err != nil {
+			// not a build directory
+			continue
+		}
+		if syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil && isStaleBuildOutput(dir) {
+			debugf("lrt: removing the old build in %s\n", dir)
+			os.RemoveAll(dir)
+		}
+		lock.Close()
+	}
+}
+
+// isStaleBuildOutput is true if the build in dir won't be used again
+func isStaleBuildOutput(dir string) bool {
+	file := filepath.Join(dir, "cwd")
+	cwd, err := ioutil.ReadFile(file)
+	if err != nil {
+		return true
+	}
+	if _, err := os.Stat(string(cwd)); os.IsNotExist(err) {
+		return true
+	}
+	info, err := os.Stat(file)
+	return err != nil || time.Since(info.ModTime()) > buildOutputMaxAge
+}
+
+// removeBuildOutput removes the builds lrt made, when it exits. A build in
+// buildOutputDir is left for next time.
+func removeBuildOutput() {
+	if !stableBuildOutput {
+		os.Remove(tmpFile.Name())
+	}
+	os.Remove(tmpFile.Name() + "-next")
+	for _, build := range keptBuilds {
+		os.Remove(keptBinary(build))
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// capturedRequest is a request (and its response) recorded by -capture
+type capturedRequest struct {
+	Start    time.Time
+	Duration time.Duration
+	Build    int32
+
+	Method       string
+	URL          string
+	Proto        string
+	Header       http.Header
+	Body         []byte
+	BodySize     int64
+	Status       int
+	RespHeader   http.Header
+	RespBody     []byte
+	RespBodySize int64
+}
+
+var (
+	capturedLock sync.Mutex
+	captured     []*capturedRequest
+)
+
+// withCapture records requests and their responses, keeping the last
+// -capture of them.
+func withCapture(next http.Handler) http.Handler {
+	lrtMux.HandleFunc("/__lrt/requests", serveCapturedRequests)
+	lrtMux.HandleFunc("/__lrt/requests.har", serveHAR)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := &capturedRequest{
+			Start:  time.Now(),
+			Method: r.Method,
+			Proto:  r.Proto,
+			Header: r.Header.Clone(),
+		}
+		c.URL = "http://" + r.Host + r.RequestURI
+		if r.TLS != nil {
+			c.URL = "https://" + r.Host + r.RequestURI
+		}
+
+		reqBody := &cappedBuffer{limit: *captureBodyFlag}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+		respBody := &cappedBuffer{limit: *captureBodyFlag}
+		rw := &responseWriter{ResponseWriter: w, onWrite: func(p []byte) { respBody.Write(p) }}
+
+		next.ServeHTTP(rw, r)
+
+		c.Duration = time.Since(c.Start)
+		c.Build = atomic.LoadInt32(&buildNumber)
+		c.Body, c.BodySize = reqBody.Bytes(), reqBody.size
+		c.Status = rw.status
+		if c.Status == 0 {
+			c.Status = http.StatusOK
+		}
+		c.RespHeader = w.Header().Clone()
+		c.RespBody, c.RespBodySize = respBody.Bytes(), respBody.size
+
+		capturedLock.Lock()
+		defer capturedLock.Unlock()
+		captured = append(captured, c)
+		if len(captured) > *captureFlag {
+			captured = captured[len(captured)-*captureFlag:]
+		}
+	})
+}
+
+// cappedBuffer keeps the first limit bytes written to it, and counts the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+	size  int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func capturedRequests() []*capturedRequest {
+	capturedLock.Lock()
+	defer capturedLock.Unlock()
+	return append([]*capturedRequest{}, captured...)
+}
+
+var capturedTemplate = template.Must(template.New("requests").Funcs(template.FuncMap{
+	"body": func(b []byte, size int64) string {
+		if !utf8.Valid(b) {
+			return fmt.Sprintf("(%d bytes of binary data)", size)
+		}
+		if int64(len(b)) < size {
+			return string(b) + fmt.Sprintf("\n(truncated, %d bytes in total)", size)
+		}
+		return string(b)
+	},
+}).Parse(`<!DOCTYPE html>
+<title>lrt: requests</title>
+<style>body { font-family: sans-serif } pre { background: #f4f4f4; padding: 8px; white-space: pre-wrap }</style>
+<h1>Recent requests</h1>
+<p><a href="/__lrt/requests.har" download="lrt.har">Download as HAR</a></p>
+{{ range . }}
+<details>
+<summary><code>{{ .Method }} {{ .URL }}</code> {{ .Status }} ({{ .Duration }}, build {{ .Build }})</summary>
+<pre>{{ .Method }} {{ .URL }} {{ .Proto }}
+{{ range $k, $v := .Header }}{{ range $v }}{{ $k }}: {{ . }}
+{{ end }}{{ end }}
+{{ body .Body .BodySize }}</pre>
+<pre>{{ .Status }}
+{{ range $k, $v := .RespHeader }}{{ range $v }}{{ $k }}: {{ . }}
+{{ end }}{{ end }}
+{{ body .RespBody .RespBodySize }}</pre>
+</details>
+{{ else }}
+<p>No requests yet.</p>
+{{ end }}
+`))
+
+// serveCapturedRequests lists the captured requests, newest first.
+func serveCapturedRequests(w http.ResponseWriter, r *http.Request) {
+	requests := capturedRequests()
+	for i, j := 0, len(requests)-1; i < j; i, j = i+1, j-1 {
+		requests[i], requests[j] = requests[j], requests[i]
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	capturedTemplate.Execute(w, requests)
+}
+
+// serveHAR exports the captured requests as a HAR file, which can be
+// imported into browser devtools and most HTTP debugging tools.
+func serveHAR(w http.ResponseWriter, r *http.Request) {
+	type nameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	headers := func(h http.Header) []nameValue {
+		result := []nameValue{}
+		for name, values := range h {
+			for _, value := range values {
+				result = append(result, nameValue{name, value})
+			}
+		}
+		return result
+	}
+	content := func(b []byte, size int64, h http.Header) map[string]interface{} {
+		c := map[string]interface{}{"mimeType": h.Get("Content-Type"), "size": size}
+		if utf8.Valid(b) {
+			c["text"] = string(b)
+		} else {
+			c["text"] = base64.StdEncoding.EncodeToString(b)
+			c["encoding"] = "base64"
+		}
+		return c
+	}
+
+	entries := []interface{}{}
+	for _, c := range capturedRequests() {
+		ms := float64(c.Duration) / float64(time.Millisecond)
+		request := map[string]interface{}{
+			"method":      c.Method,
+			"url":         c.URL,
+			"httpVersion": c.Proto,
+			"headers":     headers(c.Header),
+			"cookies":     []nameValue{},
+			"headersSize": -1,
+			"bodySize":    c.BodySize,
+		}
+		if c.BodySize > 0 {
+			postData := content(c.Body, c.BodySize, c.Header)
+			delete(postData, "size")
+			request["postData"] = postData
+		}
+		if u, err := url.Parse(c.URL); err == nil {
+			request["queryString"] = headers(http.Header(u.Query()))
+		}
+
+		entries = append(entries, map[string]interface{}{
+			"startedDateTime": c.Start.Format(time.RFC3339Nano),
+			"time":            ms,
+			"request":         request,
+			"response": map[string]interface{}{
+				"status":      c.Status,
+				"statusText":  http.StatusText(c.Status),
+				"httpVersion": c.Proto,
+				"headers":     headers(c.RespHeader),
+				"cookies":     []nameValue{},
+				"content":     content(c.RespBody, c.RespBodySize, c.RespHeader),
+				"redirectURL": c.RespHeader.Get("Location"),
+				"headersSize": -1,
+				"bodySize":    c.RespBodySize,
+			},
+			"cache":   map[string]interface{}{},
+			"timings": map[string]interface{}{"send": 0, "wait": ms, "receive": 0},
+			"comment": fmt.Sprintf("build %d", c.Build),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]string{"name": "lrt", "version": "1"},
+			"entries": entries,
+		},
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// subcommands are completed along with packages as lrt's first argument
+var subcommands = []string{"test", "stats", "init", "doctor", "start", "stop", "status", "logs", "completion"}
+
+// flagChoices are the values completed for options that take one of a few
+var flagChoices = map[string][]string{
+	"access-log":     {"short", "common", "combined", "json"},
+	"color":          {"auto", "always", "never"},
+	"editor":         {"vscode", "cursor", "idea", "goland", "sublime", "textmate"},
+	"health-check":   {"/", "tcp", "grpc"},
+	"host-header":    {"preserve", "service"},
+	"log-level":      {"error", "info", "debug"},
+	"restart":        {"never", "on-failure", "always"},
+	"service-scheme": {"http", "https"},
+}
+
+// runCompletion implements lrt completion, which prints a script for the
+// given shell that completes lrt's options, commands and main packages.
+func runCompletion(args []string) {
+	if len(args) == 1 && args[0] == "packages" {
+		// used by the scripts, to complete the main packages in the current module
+		for _, pkg := range mainPackages() {
+			fmt.Println(pkg)
+		}
+		return
+	}
+	if len(args) != 1 || (args[0] != "bash" && args[0] != "zsh" && args[0] != "fish") {
+		fmt.Print(`Usage: lrt completion bash|zsh|fish
+
+lrt completion prints a script that lets your shell complete lrt's options,
+commands, and the main packages in the current module. To use it:
+
+  bash:  source <(lrt completion bash)    (e.g. in ~/.bashrc)
+  zsh:   source <(lrt completion zsh)     (e.g. in ~/.zshrc)
+  fish:  lrt completion fish > ~/.config/fish/completions/lrt.fish
+`)
+		os.Exit(2)
+	}
+
+	var flags []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion(flags))
+	case "zsh":
+		fmt.Print(zshCompletion(flags))
+	case "fish":
+		fmt.Print(fishCompletion(flags))
+	}
+}
+
+// isBoolFlag is true for flags that don't take a value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagDescription is the first line of a flag's usage
+func flagDescription(f *flag.Flag) string {
+	return strings.SplitN(f.Usage, "\n", 2)[0]
+}
+
+func bashCompletion(flags []*flag.Flag) string {
+	var b strings.Builder
+	b.WriteString("# bash completion for lrt, generated by lrt completion bash\n")
+	b.WriteString("_lrt() {\n")
+	b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	b.WriteString("\tcase \"$prev\" in\n")
+	var names, valued []string
+	for _, f := range flags {
+		names = append(names, "-"+f.Name)
+		if isBoolFlag(f) {
+			continue
+		}
+		if choices, ok := flagChoices[f.Name]; ok {
+			fmt.Fprintf(&b, "\t-%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", f.Name, strings.Join(choices, " "))
+		} else {
+			valued = append(valued, "-"+f.Name)
+		}
+	}
+	fmt.Fprintf(&b, "\t%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", strings.Join(valued, "|"))
+	b.WriteString("\tesac\n")
+	fmt.Fprintf(&b, "\tif [[ $cur == -* ]]; then\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintf(&b, "\telif [[ $COMP_CWORD -eq 1 ]]; then\n\t\tCOMPREPLY=($(compgen -W \"%s $(lrt completion packages 2>/dev/null)\" -- \"$cur\"))\n", strings.Join(subcommands, " "))
+	b.WriteString("\telse\n\t\tCOMPREPLY=($(compgen -W \"$(lrt completion packages 2>/dev/null)\" -- \"$cur\"))\n\tfi\n")
+	b.WriteString("}\ncomplete -F _lrt lrt\n")
+	return b.String()
+}
+
+func zshCompletion(flags []*flag.Flag) string {
+	var b strings.Builder
+	b.WriteString("#compdef lrt\n# zsh completion for lrt, generated by lrt completion zsh\n\n")
+	b.WriteString("_lrt_packages() {\n\tlocal -a packages\n\tpackages=(${(f)\"$(lrt completion packages 2>/dev/null)\"})\n\t_describe -t packages package packages\n}\n\n")
+	fmt.Fprintf(&b, "_lrt_first() {\n\tlocal -a commands\n\tcommands=(%s)\n\t_describe -t commands command commands\n\t_lrt_packages\n}\n\n", strings.Join(subcommands, " "))
+	b.WriteString("_lrt() {\n\t_arguments -S \\\n")
+	escape := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`)
+	for _, f := range flags {
+		spec := "-" + f.Name + "[" + escape.Replace(flagDescription(f)) + "]"
+		if choices, ok := flagChoices[f.Name]; ok {
+			spec += ":" + f.Name + ":(" + strings.Join(choices, " ") + ")"
+		} else if !isBoolFlag(f) {
+			spec += ":" + f.Name + ":_files"
+		}
+		fmt.Fprintf(&b, "\t\t'%s' \\\n", spec)
+	}
+	b.WriteString("\t\t'1: :_lrt_first' \\\n\t\t'*: :_lrt_packages'\n}\n\n")
+	b.WriteString("if [ \"$funcstack[1]\" = \"_lrt\" ]; then\n\t_lrt \"$@\"\nelse\n\tcompdef _lrt lrt\nfi\n")
+	return b.String()
+}
+
+func fishCompletion(flags []*flag.Flag) string {
+	var b strings.Builder
+	b.WriteString("# fish completion for lrt, generated by lrt completion fish\n")
+	b.WriteString("complete -c lrt -f\n")
+	fmt.Fprintf(&b, "complete -c lrt -n __fish_use_subcommand -a '%s'\n", strings.Join(subcommands, " "))
+	b.WriteString("complete -c lrt -a '(lrt completion packages 2>/dev/null)'\n")
+	escape := strings.NewReplacer(`\`, `\\`, "'", `\'`)
+	for _, f := range flags {
+		line := "complete -c lrt -o " + f.Name
+		if choices, ok := flagChoices[f.Name]; ok {
+			line += " -x -a '" + strings.Join(choices, " ") + "'"
+		} else if !isBoolFlag(f) {
+			line += " -r -F"
+		}
+		fmt.Fprintf(&b, "%s -d '%s'\n", line, escape.Replace(flagDescription(f)))
+	}
+	return b.String()
+}
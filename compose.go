@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// composeContainer is the part of docker compose ps --format json that lrt
+// uses to tell when a service is ready
+type composeContainer struct {
+	Service    string
+	State      string
+	Health     string
+	Publishers []struct {
+		URL           string
+		PublishedPort int
+	}
+}
+
+// composeCommand runs docker compose with -compose-file, if it was given
+func composeCommand(args ...string) *exec.Cmd {
+	if *composeFileFlag != "" {
+		args = append([]string{"-f", *composeFileFlag}, args...)
+	}
+	return exec.Command("docker", append([]string{"compose"}, args...)...)
+}
+
+// composeContainers lists the containers for the given services
+func composeContainers(services []string) ([]composeContainer, error) {
+	output, err := composeCommand(append([]string{"ps", "--all", "--format", "json"}, services...)...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("docker compose ps failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	// older versions print a JSON array, newer ones a line per container
+	var containers []composeContainer
+	if bytes.HasPrefix(bytes.TrimSpace(output), []byte("[")) {
+		err = json.Unmarshal(output, &containers)
+		return containers, err
+	}
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var c composeContainer
+		if err := json.Unmarshal(line, &c); err != nil {
+			return nil, err
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// startComposeServices starts each -compose service that isn't already
+// running (stopping them again when lrt exits), and waits for them all to be
+// ready: healthy, if they have a health check, and accepting connections on
+// the ports they publish.
+func startComposeServices() {
+	services := *composeFlag
+	containers, err := composeContainers(services)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		fmt.Fprintln(os.Stderr, "     hint: -compose needs docker compose, and a compose file in the current directory (or -compose-file)")
+		exit(1)
+	}
+	running := map[string]bool{}
+	for _, c := range containers {
+		if c.State == "running" {
+			running[c.Service] = true
+		}
+	}
+	var started []string
+	for _, service := range services {
+		if !running[service] {
+			started = append(started, service)
+		}
+	}
+
+	if len(started) > 0 {
+		infof("lrt: starting %s with docker compose\n", strings.Join(started, ", "))
+		if output, err := composeCommand(append([]string{"up", "-d"}, started...)...).CombinedOutput(); err != nil {
+			fmt.Fprint(os.Stderr, "lrt: docker compose up failed:\n"+string(output))
+			exit(1)
+		}
+		// only stop what lrt started, so services you started yourself keep running
+		atExit(func() {
+			infof("lrt: stopping %s\n", strings.Join(started, ", "))
+			composeCommand(append([]string{"stop"}, started...)...).Run()
+		})
+	}
+
+	deadline := time.Now().Add(*composeTimeoutFlag)
+	waiting := ""
+	for {
+		waiting = composeNotReady(services)
+		if waiting == "" {
+			infof("lrt: %s ready\n", strings.Join(services, ", "))
+			return
+		}
+		if time.Now().After(deadline) {
+			fmt.Fprintf(os.Stderr, "lrt: %s did not become ready within %s\n", waiting, *composeTimeoutFlag)
+			fmt.Fprintf(os.Stderr, "     hint: see why with docker compose logs %s, or increase -compose-timeout\n", strings.SplitN(waiting, " ", 2)[0])
+			exit(1)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// composeNotReady describes the first of the services that isn't ready yet,
+// or returns "" if they all are
+func composeNotReady(services []string) string {
+	containers, err := composeContainers(services)
+	if err != nil {
+		return err.Error()
+	}
+	found := map[string]bool{}
+	for _, c := range containers {
+		found[c.Service] = true
+		if c.State != "running" {
+			return c.Service + " (" + c.State + ")"
+		}
+		if c.Health != "" && c.Health != "healthy" {
+			return c.Service + " (" + c.Health + ")"
+		}
+		for _, p := range c.Publishers {
+			if p.PublishedPort == 0 {
+				continue
+			}
+			host := p.URL
+			if host == "" || host == "0.0.0.0" || host == "::" {
+				host = "localhost"
+			}
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(p.PublishedPort)), time.Second)
+			if err != nil {
+				return c.Service + " (not accepting connections on port " + strconv.Itoa(p.PublishedPort) + ")"
+			}
+			conn.Close()
+		}
+	}
+	for _, service := range services {
+		if !found[service] {
+			return service + " (not created)"
+		}
+	}
+	return ""
+}
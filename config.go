@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configFile holds a project's lrt options, so that everyone working on it
+// can just run lrt. lrt init writes one to start from.
+const configFile = ".lrt.yaml"
+
+// configPackage is the package to build from configFile, used if one isn't
+// given on the command line
+var configPackage string
+
+// envPrefix starts the names of environment variables that set options, e.g.
+// LRT_LISTEN for -listen or LRT_BUILD_ARGS for -build-args
+const envPrefix = "LRT_"
+
+// setFromEnv records which options were set by environment variables
+var setFromEnv = map[string]bool{}
+
+// configSetting is an option set in configFile
+type configSetting struct {
+	line  int
+	name  string
+	value string
+}
+
+// mustLoadEnv sets options from environment variables. It is called before
+// anything else, so that the options lrt's commands share with the main
+// command are set too.
+func mustLoadEnv() {
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := flag.Set(f.Name, value); err != nil {
+			fmt.Printf("lrt: $%s is invalid: %s. See lrt --help for details\n", name, err)
+			os.Exit(2)
+		}
+		setFromEnv[f.Name] = true
+	})
+}
+
+// mustLoadConfig sets options from configFile, if there is one. It is called
+// before the command line is parsed, so options given there win (options
+// that may be repeated, like -env, are added to those in the file, apart
+// from -listen, which replaces them). Options
+// set by environment variables also take precedence over the file, so that
+// developers can override a project's settings in their shell.
+func mustLoadConfig() {
+	contents, err := ioutil.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	var settings []configSetting
+	if err == nil {
+		settings, err = parseConfig(contents)
+	}
+	if err != nil {
+		fmt.Printf("lrt: %s is invalid: %s\n", configFile, err)
+		os.Exit(2)
+	}
+
+	for _, s := range settings {
+		if s.name == "package" {
+			configPackage = s.value
+			continue
+		}
+		if flag.Lookup(s.name) == nil {
+			fmt.Printf("lrt: %s:%d: there is no -%s option. See lrt --help for details\n", configFile, s.line, s.name)
+			os.Exit(2)
+		}
+		if setFromEnv[s.name] {
+			continue
+		}
+		if err := flag.Set(s.name, s.value); err != nil {
+			fmt.Printf("lrt: %s:%d: -%s is invalid: %s. See lrt --help for details\n", configFile, s.line, s.name, err)
+			os.Exit(2)
+		}
+	}
+}
+
+// parseConfig parses the simple subset of YAML that configFile uses: a map of
+// option names to values, where the value of an option that may be repeated
+// can be a list.
+//
+//	listen: localhost:4000
+//	env:
+//	  - DEBUG=1
+//	  - "GREETING=hello # world"
+func parseConfig(contents []byte) ([]configSetting, error) {
+	var settings []configSetting
+	list := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if list == "" || trimmed == line {
+				return nil, fmt.Errorf("line %d: list items must be indented under an option", n)
+			}
+			value, err := configValue(strings.TrimPrefix(trimmed, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			settings = append(settings, configSetting{line: n, name: list, value: value})
+			continue
+		}
+		if trimmed != line {
+			return nil, fmt.Errorf("line %d: expected an option, not an indented line", n)
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected name: value", n)
+		}
+		name := strings.TrimSpace(line[:i])
+		value, err := configValue(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		list = ""
+		if value == "" && !strings.Contains(line[i+1:], `"`) && !strings.Contains(line[i+1:], `'`) {
+			// a list may follow
+			list = name
+			continue
+		}
+		settings = append(settings, configSetting{line: n, name: name, value: value})
+	}
+	return settings, scanner.Err()
+}
+
+// configValue parses a (possibly quoted) value, without any comment after it
+func configValue(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := strings.LastIndex(s, `"`)
+		if end == 0 || !isComment(s[end+1:]) {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return strconv.Unquote(s[:end+1])
+	case strings.HasPrefix(s, "'"):
+		end := strings.LastIndex(s, "'")
+		if end == 0 || !isComment(s[end+1:]) {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.Replace(s[1:end], "''", "'", -1), nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	if strings.HasPrefix(s, "#") {
+		s = ""
+	}
+	return strings.TrimSpace(s), nil
+}
+
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fsnotify needs a watch (and, on macOS, a file descriptor for every file)
+// per directory, so on large projects lrt can run into the open file or
+// inotify limits. When it does, rather than giving up, lrt releases the
+// watches on the directory's siblings and polls them all from one goroutine
+// instead, which doesn't use any.
+
+// pollInterval is how often polled directories are checked for changes
+const pollInterval = 500 * time.Millisecond
+
+// polledRoots are the parents whose watched directories are polled, and
+// pollEvents receives the changes they find. Guarded by watchLock.
+var (
+	polledRoots = map[string]bool{}
+	pollEvents  = make(chan fsnotify.Event, 100)
+)
+
+// warnedOutOfWatches is set once lrt has warned that it is polling. Guarded
+// by watchLock.
+var warnedOutOfWatches bool
+
+// isPolled is true if dir is under a polled parent. The caller must hold
+// watchLock.
+func isPolled(dir string) bool {
+	for root := range polledRoots {
+		if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOutOfWatches is true if err means that fsnotify has run out of file
+// descriptors or inotify watches
+func isOutOfWatches(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENOSPC)
+}
+
+// pollSiblings polls dir's parent instead of watching its children one by
+// one, after watching dir failed with err. The caller must hold watchLock.
+func pollSiblings(dir string, err error) {
+	parent := filepath.Dir(dir)
+	if !warnedOutOfWatches {
+		fmt.Fprintf(stderr, "lrt: warning: can't watch %s: %s, so polling for changes instead\n", dir, err)
+		fmt.Fprint(stderr, lrtHintsFor(err))
+		warnedOutOfWatches = true
+	}
+
+	// parents that are already polled are now covered by this one
+	for root := range polledRoots {
+		if strings.HasPrefix(root, parent+string(filepath.Separator)) {
+			delete(polledRoots, root)
+		}
+	}
+	polledRoots[parent] = true
+	watchedDir[dir] = true
+	n := 0
+	for watched := range watchedDir {
+		if isPolled(watched) {
+			watcher.Remove(watched)
+			n++
+		}
+	}
+	debugf("lrt: polling the %d directories being watched under %s, instead of watching each one\n", n, parent)
+	go pollTree(parent)
+}
+
+// pollTree checks the .go files in the watched directories under root for
+// changes every pollInterval, and sends them to pollEvents as fsnotify would,
+// until root is no longer polled.
+// With -watch-root, new directories are sent too, so that they are watched.
+func pollTree(root string) {
+	seen, scanned := scanTree(root)
+	for {
+		time.Sleep(pollInterval)
+		watchLock.Lock()
+		polled := polledRoots[root]
+		watchLock.Unlock()
+		if !polled {
+			return
+		}
+		now, dirs := scanTree(root)
+		for name, modified := range now {
+			if before, ok := seen[name]; ok && !modified.Equal(before) {
+				pollEvents <- fsnotify.Event{Name: name, Op: fsnotify.Write}
+			} else if !ok && scanned[filepath.Dir(name)] {
+				// (directories that have only just been watched have no changes yet)
+				pollEvents <- fsnotify.Event{Name: name, Op: fsnotify.Create}
+			}
+		}
+		for name := range seen {
+			if _, ok := now[name]; !ok {
+				pollEvents <- fsnotify.Event{Name: name, Op: fsnotify.Remove}
+			}
+		}
+		seen, scanned = now, dirs
+	}
+}
+
+// scanTree returns when each .go file in the watched directories under root
+// was last modified, and which directories it looked in
+func scanTree(root string) (map[string]time.Time, map[string]bool) {
+	watchLock.Lock()
+	dirs := map[string]bool{}
+	for dir := range watchedDir {
+		if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			dirs[dir] = true
+		}
+	}
+	watchLock.Unlock()
+
+	files := map[string]time.Time{}
+	for dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, info := range infos {
+			name := filepath.Join(dir, info.Name())
+			if info.IsDir() && *watchRootFlag && !dirs[name] && !isIgnoredDir(name) {
+				pollEvents <- fsnotify.Event{Name: name, Op: fsnotify.Create}
+			} else if strings.HasSuffix(info.Name(), ".go") && info.Mode()&os.ModeType == 0 {
+				files[name] = info.ModTime()
+			}
+		}
+	}
+	return files, dirs
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// serveControl serves the control API on the unix socket at path. It lets
+// editors and scripts drive lrt:
+//
+//	POST /rebuild   rebuild and restart the service
+//	POST /restart   restart the service without rebuilding it
+//	POST /rollback  go back to the previous build (or ?build=N), or forward again
+//	GET  /builds    list the builds that can be rolled back to
+//	POST /pause     stop rebuilding when files change
+//	POST /resume    start again (rebuilding if anything changed)
+//	GET  /status    describe what lrt is doing
+//	GET  /watches   list the directories being watched (?file= says whether saving it rebuilds)
+func serveControl(path string) error {
+	listener, err := listenUnix(path)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rebuild", controlAction(func() error {
+		go rebuild()
+		return nil
+	}))
+	mux.HandleFunc("/restart", controlAction(restartService))
+	mux.HandleFunc("/rollback", func(w http.ResponseWriter, r *http.Request) {
+		build, _ := strconv.Atoi(r.URL.Query().Get("build"))
+		controlAction(func() error { return rollback(int32(build)) })(w, r)
+	})
+	mux.HandleFunc("/builds", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listKeptBuilds())
+	})
+	mux.HandleFunc("/pause", controlAction(func() error {
+		pauseWatching()
+		return nil
+	}))
+	mux.HandleFunc("/resume", controlAction(func() error {
+		resumeWatching()
+		return nil
+	}))
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentStatus())
+	})
+	mux.HandleFunc("/watches", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(requestedWatchSet(r))
+	})
+
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// controlAction wraps an action so that it can only be triggered by a POST
+func controlAction(action func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "lrt: use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := action(); err != nil {
+			http.Error(w, "lrt: "+err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentStatus())
+	}
+}
+
+// restartService restarts the service without rebuilding it, returning once
+// it has started
+func restartService() error {
+	buildLock.Lock()
+	defer buildLock.Unlock()
+	atomic.StoreInt32(&restarting, 1)
+	defer atomic.StoreInt32(&restarting, 0)
+	lockProxy()
+	defer proxyLock.Unlock()
+
+	if !builtOnce || (buildFailed && lastGoodWarning == "") {
+		return fmt.Errorf("there is no successful build to restart")
+	}
+
+	infof("lrt: restarting service...\n")
+	stopRunningService()
+	errorResponse = nil
+	crashes = 0
+	startService()
+	return nil
+}
+
+// keptBuilds are the recent builds that can be rolled back to, oldest first.
+// There are at most -keep-builds of them.
+var keptBuilds []int32
+
+// keptBinary is where a kept build is stored
+func keptBinary(build int32) string {
+	return fmt.Sprintf("%s-build-%d", tmpFile.Name(), build)
+}
+
+// keepPreviousBuild moves the current build aside before it is replaced, so
+// that it can be rolled back to. The caller must hold the write lock on the
+// proxy.
+func keepPreviousBuild() {
+	if *keepBuildsFlag <= 0 || servingBuild == 0 || *remoteFlag != "" {
+		return
+	}
+	if err := os.Rename(tmpFile.Name(), keptBinary(servingBuild)); err != nil {
+		return
+	}
+	keptBuilds = append(keptBuilds, servingBuild)
+	for len(keptBuilds) > *keepBuildsFlag {
+		os.Remove(keptBinary(keptBuilds[0]))
+		keptBuilds = keptBuilds[1:]
+	}
+}
+
+// rollback swaps the current build for a kept one (the most recent if build
+// is 0) and restarts the service, returning once it has started. The current
+// build is kept in its place, so rolling back twice goes back to where you
+// started.
+func rollback(build int32) error {
+	buildLock.Lock()
+	defer buildLock.Unlock()
+	atomic.StoreInt32(&restarting, 1)
+	defer atomic.StoreInt32(&restarting, 0)
+	lockProxy()
+	defer proxyLock.Unlock()
+
+	if len(keptBuilds) == 0 {
+		return fmt.Errorf("there is no previous build to roll back to")
+	}
+	if build == 0 {
+		build = keptBuilds[len(keptBuilds)-1]
+	}
+	i := 0
+	for i < len(keptBuilds) && keptBuilds[i] != build {
+		i++
+	}
+	if i == len(keptBuilds) {
+		return fmt.Errorf("build %d is not one of the kept builds", build)
+	}
+
+	// move the build out of the way first, so that keeping the current build
+	// can't remove it (and so that if it can't be moved, the service is left
+	// running)
+	target := tmpFile.Name() + "-rollback"
+	if err := os.Rename(keptBinary(build), target); err != nil {
+		return err
+	}
+	keptBuilds = append(keptBuilds[:i], keptBuilds[i+1:]...)
+
+	stopRunningService()
+	keepPreviousBuild()
+	if err := os.Rename(target, tmpFile.Name()); err != nil {
+		// the current build may already have been kept, so there is nothing
+		// to restart
+		msg := fmt.Sprintf("lrt: error: couldn't roll back to build %d: %s\n", build, err)
+		fmt.Fprint(stderr, msg)
+		errorResponse = []byte(msg)
+		return err
+	}
+
+	fmt.Fprintf(stdout, "lrt: rolled back to build %d\n", build)
+	servingBuild = build
+	buildFailed = false
+	lastGoodWarning = ""
+	errorResponse = nil
+	crashes = 0
+	startService()
+	return nil
+}
+
+// keptBuild describes a kept build, for GET /builds
+type keptBuild struct {
+	Build int32     `json:"build"`
+	Path  string    `json:"path"`
+	Size  int64     `json:"size"`
+	Time  time.Time `json:"time"`
+}
+
+// listKeptBuilds lists the kept builds, newest first
+func listKeptBuilds() []keptBuild {
+	proxyLock.RLock()
+	defer proxyLock.RUnlock()
+
+	builds := []keptBuild{}
+	for i := len(keptBuilds) - 1; i >= 0; i-- {
+		b := keptBuild{Build: keptBuilds[i], Path: keptBinary(keptBuilds[i])}
+		if info, err := os.Stat(b.Path); err == nil {
+			b.Size, b.Time = info.Size(), info.ModTime()
+		}
+		builds = append(builds, b)
+	}
+	return builds
+}
+
+// pauseWatching stops lrt rebuilding the service when files change
+func pauseWatching() {
+	if atomic.CompareAndSwapInt32(&paused, 0, 1) {
+		fmt.Fprintf(stdout, "lrt: paused, changes will not be rebuilt until you resume\n")
+	}
+}
+
+// resumeWatching starts rebuilding on change again, and rebuilds straight
+// away if anything changed while paused.
+func resumeWatching() {
+	if atomic.CompareAndSwapInt32(&paused, 1, 0) {
+		fmt.Fprintf(stdout, "lrt: resumed\n")
+		if atomic.SwapInt32(&changedWhilePaused, 0) == 1 {
+			go rebuild()
+		}
+	}
+}
+
+// status describes what lrt is doing, for the control API and status page
+type status struct {
+	Build       int32     `json:"build"`
+	State       string    `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	Paused      bool      `json:"paused"`
+	Address     string    `json:"address"`
+	PID         int       `json:"pid,omitempty"`
+	Binary      string    `json:"binary,omitempty"`
+	WatchedDirs int       `json:"watched_dirs"`
+	BuildTime   int64     `json:"build_duration_ms,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+func currentStatus() status {
+	s := status{
+		Build:     atomic.LoadInt32(&buildNumber),
+		Paused:    atomic.LoadInt32(&paused) == 1,
+		Address:   serviceAddress(),
+		BuildTime: atomic.LoadInt64(&lastBuildTime),
+		Time:      time.Now(),
+	}
+	// both hold the proxy lock until the service is healthy
+	if atomic.LoadInt32(&rebuilding) == 1 {
+		s.State = "rebuilding"
+		return s
+	}
+	if atomic.LoadInt32(&restarting) == 1 {
+		s.State = "restarting"
+		return s
+	}
+
+	proxyLock.RLock()
+	defer proxyLock.RUnlock()
+	watchLock.Lock()
+	s.WatchedDirs = len(watchedDir)
+	watchLock.Unlock()
+	if service != nil {
+		s.PID = service.Process.Pid
+	}
+	if builtOnce && *remoteFlag == "" {
+		s.Binary = tmpFile.Name()
+	}
+	switch {
+	case !builtOnce:
+		s.State = "starting"
+	case errorResponse != nil:
+		s.State = "error"
+		s.Error = string(errorResponse)
+	default:
+		s.State = "ready"
+	}
+	return s
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// daemonDir holds the pid file, control socket and log of an lrt started
+// with lrt start, in the directory it was started from.
+const daemonDir = ".lrt"
+
+var (
+	daemonPidFile = filepath.Join(daemonDir, "lrt.pid")
+	daemonSocket  = filepath.Join(daemonDir, "lrt.sock")
+	daemonLog     = filepath.Join(daemonDir, "lrt.log")
+)
+
+// runDaemonCommand handles lrt start, stop, status and logs
+func runDaemonCommand(command string, args []string) {
+	switch command {
+	case "start":
+		startDaemon(args)
+	case "stop":
+		parseDaemonFlags(command, "stops the lrt started by lrt start in this directory.", args)
+		stopDaemon()
+	case "status":
+		parseDaemonFlags(command, "describes what the lrt started by lrt start in this directory is doing.\nIt exits with status 3 if lrt is not running.", args)
+		printDaemonStatus()
+	case "logs":
+		followFlag := parseDaemonFlags(command, "prints the output of the lrt started by lrt start in this directory.", args)
+		printDaemonLogs(*followFlag)
+	}
+}
+
+// parseDaemonFlags parses the (few) options of the daemon commands
+func parseDaemonFlags(command string, description string, args []string) *bool {
+	flags := flag.NewFlagSet("lrt "+command, flag.ExitOnError)
+	var followFlag *bool
+	if command == "logs" {
+		followFlag = flags.Bool("f", false, "keep printing output as it is written")
+	}
+	flags.Usage = func() {
+		fmt.Printf("Usage: lrt %s [options]\n\nlrt %s %s\n\noptions:\n", command, command, description)
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	flags.Parse(args)
+	return followFlag
+}
+
+// startDaemon runs lrt in the background with the given arguments, with its
+// output going to .lrt/lrt.log and a control socket at .lrt/lrt.sock, and
+// waits until it is up.
+func startDaemon(args []string) {
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		fmt.Print(`Usage: lrt start [options] <package>
+
+lrt start runs lrt in the background, taking the same options as lrt itself.
+Its output is written to .lrt/lrt.log, and it can be managed with lrt stop,
+lrt status and lrt logs from the same directory.
+`)
+		os.Exit(2)
+	}
+
+	if pid, ok := runningDaemon(); ok {
+		fmt.Fprintf(os.Stderr, "lrt: already running in the background (pid %d)\n", pid)
+		fmt.Fprintf(os.Stderr, "     hint: use lrt stop to stop it first\n")
+		os.Exit(1)
+	}
+
+	executable, err := os.Executable()
+	if err == nil {
+		err = os.MkdirAll(daemonDir, 0755)
+	}
+	var log *os.File
+	if err == nil {
+		log, err = os.OpenFile(daemonLog, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+	defer log.Close()
+
+	// any -control-socket given explicitly comes later, so it wins
+	cmd := exec.Command(executable, append([]string{"-keys=false", "-control-socket", daemonSocket}, args...)...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	// detach from the terminal, so lrt isn't killed when it closes
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(daemonPidFile, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+
+	exited := make(chan bool)
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	deadline := time.After(10 * time.Second)
+	for {
+		if _, err := daemonStatus(); err == nil {
+			fmt.Printf("lrt: started in the background (pid %d), see lrt logs -f for its output\n", cmd.Process.Pid)
+			return
+		}
+		select {
+		case <-exited:
+			os.Remove(daemonPidFile)
+			fmt.Fprintf(os.Stderr, "lrt: failed to start (%s), the end of %s is:\n", cmd.ProcessState, daemonLog)
+			printLogTail(daemonLog, 10)
+			os.Exit(1)
+		case <-deadline:
+			fmt.Fprintf(os.Stderr, "lrt: started in the background (pid %d), but it is not responding on %s\n", cmd.Process.Pid, daemonSocket)
+			os.Exit(1)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// stopDaemon stops the lrt started by lrt start, and waits for it to exit
+func stopDaemon() {
+	pid, ok := runningDaemon()
+	if !ok {
+		fmt.Fprintln(os.Stderr, "lrt: not running in the background")
+		os.Exit(1)
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			fmt.Fprintf(os.Stderr, "lrt: pid %d has not exited after 10s\n", pid)
+			os.Exit(1)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	os.Remove(daemonPidFile)
+	fmt.Printf("lrt: stopped (pid %d)\n", pid)
+}
+
+// printDaemonStatus describes the lrt started by lrt start, exiting with
+// status 3 (as init scripts do) if it isn't running.
+func printDaemonStatus() {
+	pid, ok := runningDaemon()
+	if !ok {
+		fmt.Println("lrt: not running in the background")
+		os.Exit(3)
+	}
+	s, err := daemonStatus()
+	if err != nil {
+		fmt.Printf("lrt: running in the background (pid %d), but not responding on %s: %s\n", pid, daemonSocket, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("lrt: running in the background (pid %d)\n", pid)
+	fmt.Printf("  state:   %s\n", s.State)
+	fmt.Printf("  build:   %d\n", s.Build)
+	fmt.Printf("  address: %s\n", s.Address)
+	if s.PID != 0 {
+		fmt.Printf("  pid:     %d\n", s.PID)
+	}
+	if s.Paused {
+		fmt.Printf("  paused:  true\n")
+	}
+	if s.Error != "" {
+		fmt.Printf("\n%s", s.Error)
+	}
+}
+
+// printDaemonLogs prints .lrt/lrt.log, and with follow keeps printing what is
+// added to it until interrupted.
+func printDaemonLogs(follow bool) {
+	f, err := os.Open(daemonLog)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	for {
+		if _, err := io.Copy(os.Stdout, f); err != nil {
+			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+			os.Exit(1)
+		}
+		if !follow {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// runningDaemon returns the pid of the lrt started by lrt start, if it is
+// still running
+func runningDaemon() (int, bool) {
+	contents, err := ioutil.ReadFile(daemonPidFile)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, syscall.Kill(pid, 0) == nil
+}
+
+// daemonStatus asks the lrt started by lrt start for its status
+func daemonStatus() (status, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", daemonSocket)
+			},
+		},
+	}
+	var s status
+	resp, err := client.Get("http://lrt/status")
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+	return s, json.NewDecoder(resp.Body).Decode(&s)
+}
+
+// printLogTail prints the last n lines of the file at path to stderr
+func printLogTail(path string, n int) {
+	contents, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimRight(string(contents), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for _, line := range lines {
+		fmt.Fprintln(os.Stderr, "  "+line)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// dependencyFiles are the directories of the packages the service is built
+// from, and for each the .go files go list knows about: true for those that
+// are built, false for those that aren't (excluded by build tags, or
+// //go:build ignore). A nil map means lrt doesn't know which files are built.
+var (
+	dependencyLock  sync.Mutex
+	dependencyFiles = map[string]map[string]bool{}
+	dependencyKnown bool // set once findDependencies has run
+)
+
+// fileHeaders are the headers (see fileHeader) of the .go files in the watched
+// directories as of when findDependencies last ran go list, or nil if it
+// didn't succeed. If a rebuild doesn't change any of them, the service is
+// built from the same packages and files as before, so go list needn't run
+// again.
+var fileHeaders map[string]string
+
+func addDependencyDir(dir string) {
+	dependencyLock.Lock()
+	defer dependencyLock.Unlock()
+	if _, ok := dependencyFiles[dir]; !ok {
+		dependencyFiles[dir] = nil
+	}
+}
+
+// isBuiltFile is false for .go files that changing won't change the service:
+// those excluded by their build constraints, and with -watch-root those
+// outside the dependencies' directories. Any change before go list has run is
+// assumed to matter.
+func isBuiltFile(name string) bool {
+	dependencyLock.Lock()
+	files, ok := dependencyFiles[filepath.Dir(name)]
+	known := dependencyKnown
+	dependencyLock.Unlock()
+	if !known {
+		return true
+	}
+	if !ok {
+		return !*watchRootFlag
+	}
+	if files[filepath.Base(name)] {
+		return true
+	}
+	// the file is new, or was excluded last time go list ran; its build
+	// constraints may have changed since
+	ctxt := buildContext()
+	match, err := ctxt.MatchFile(filepath.Dir(name), filepath.Base(name))
+	return match || err != nil
+}
+
+// buildContext is the go/build context for the platform and tags the service
+// is built with
+func buildContext() build.Context {
+	ctxt := build.Default
+	for _, kv := range targetGoEnv {
+		if strings.HasPrefix(kv, "GOOS=") {
+			ctxt.GOOS = strings.TrimPrefix(kv, "GOOS=")
+		} else if strings.HasPrefix(kv, "GOARCH=") {
+			ctxt.GOARCH = strings.TrimPrefix(kv, "GOARCH=")
+		}
+	}
+	for i, arg := range buildArgs {
+		tags := ""
+		if (arg == "-tags" || arg == "--tags") && i+1 < len(buildArgs) {
+			tags = buildArgs[i+1]
+		} else if strings.HasPrefix(arg, "-tags=") || strings.HasPrefix(arg, "--tags=") {
+			tags = arg[strings.Index(arg, "=")+1:]
+		}
+		ctxt.BuildTags = append(ctxt.BuildTags, strings.FieldsFunc(tags, func(r rune) bool { return r == ',' || r == ' ' })...)
+	}
+	return ctxt
+}
+
+// findDependencies runs go list in the background after a build that may
+// have changed them, to find out which files each dependency is built from
+// (and watch any packages the build didn't list because they were already
+// compiled). If it fails the build will too, and say why.
+func findDependencies() {
+	rebuilds := atomic.LoadInt64(&rebuildsTotal.value)
+	// read before go list runs, so that a change while it does isn't missed
+	headers := readFileHeaders()
+	format := "{{if not .Standard}}{{.ImportPath}}\t{{.Dir}}\t{{join .GoFiles \" \"}} {{join .CgoFiles \" \"}}\t{{join .IgnoredGoFiles \" \"}}{{end}}"
+	list := exec.Command(*goFlag, append([]string{"list", "-deps", "-f", format}, packageArgs()...)...)
+	list.Env = append(os.Environ(), targetGoEnv...)
+	output, err := list.Output()
+	if err != nil {
+		debugf("lrt: could not list dependencies: %s\n", err)
+		dependencyLock.Lock()
+		fileHeaders = nil
+		dependencyLock.Unlock()
+		return
+	}
+
+	packages := []string{}
+	found := map[string]map[string]bool{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 || fields[1] == "" {
+			continue
+		}
+		packages = append(packages, fields[0])
+		files := map[string]bool{}
+		for _, file := range strings.Fields(fields[3]) {
+			files[file] = false
+		}
+		for _, file := range strings.Fields(fields[2]) {
+			files[file] = true
+		}
+		found[fields[1]] = files
+	}
+	watchDependencies([]byte(strings.Join(packages, "\n")))
+	pruned := pruneWatches(found, rebuilds)
+
+	dependencyLock.Lock()
+	defer dependencyLock.Unlock()
+	for dir, files := range found {
+		dependencyFiles[dir] = files
+	}
+	for _, dir := range pruned {
+		delete(dependencyFiles, dir)
+	}
+	dependencyKnown = true
+	fileHeaders = headers
+	debugf("lrt: found the files in %d directories that %s is built from\n", len(found), packageName)
+}
+
+// fileHeader is the start of a .go file up to the end of its imports, which
+// is everything that affects what the service is built from: its build
+// constraints, package clause and imports. It is "" if the file can't be read
+// or parsed.
+func fileHeader(name string) string {
+	src, err := ioutil.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, src, parser.ImportsOnly)
+	if err != nil {
+		return ""
+	}
+	return string(src[:fset.Position(f.End()).Offset])
+}
+
+// readFileHeaders reads the headers of the .go files in the watched
+// directories (with -watch-root, only those that are dependencies)
+func readFileHeaders() map[string]string {
+	watched := []string{}
+	watchLock.Lock()
+	for dir := range watchedDir {
+		watched = append(watched, dir)
+	}
+	watchLock.Unlock()
+	dirs := []string{}
+	dependencyLock.Lock()
+	for _, dir := range watched {
+		if _, ok := dependencyFiles[dir]; ok || !*watchRootFlag {
+			dirs = append(dirs, dir)
+		}
+	}
+	dependencyLock.Unlock()
+
+	headers := map[string]string{}
+	for _, dir := range dirs {
+		names, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+		for _, name := range names {
+			abs, err := filepath.Abs(name)
+			if err == nil && !strings.HasSuffix(name, "_test.go") {
+				headers[abs] = fileHeader(abs)
+			}
+		}
+	}
+	return headers
+}
+
+// dependenciesMayHaveChanged is false if changing files can't have changed
+// which packages and files the service is built from, because none of them
+// changed the header of a .go file since findDependencies last ran.
+func dependenciesMayHaveChanged(files []string) bool {
+	dependencyLock.Lock()
+	headers := fileHeaders
+	dependencyLock.Unlock()
+	if headers == nil || len(files) == 0 {
+		return true
+	}
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		abs, err := filepath.Abs(name)
+		if err != nil || !strings.HasSuffix(name, ".go") {
+			return true
+		}
+		if header, ok := headers[abs]; !ok || fileHeader(abs) != header {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneWatches stops watching the directories that aren't in found, because
+// the service no longer imports a package in them, returning them. Otherwise
+// long sessions on big projects accumulate watches, and rebuild when files
+// that no longer matter change. If lrt has started rebuilding since
+// findDependencies ran go list, found may already be out of date, so nothing
+// is pruned; and with -watch-root everything is watched on purpose.
+func pruneWatches(found map[string]map[string]bool, rebuilds int64) []string {
+	if *watchRootFlag {
+		return nil
+	}
+	watchLock.Lock()
+	if atomic.LoadInt32(&rebuilding) == 1 || atomic.LoadInt64(&rebuildsTotal.value) != rebuilds {
+		watchLock.Unlock()
+		return nil
+	}
+	pruned := []string{}
+	for dir := range watchedDir {
+		abs, _ := filepath.Abs(dir)
+		if _, ok := found[dir]; ok {
+			continue
+		}
+		if _, ok := found[abs]; ok {
+			continue
+		}
+		delete(watchedDir, dir)
+		if !*dryRunFlag {
+			watcher.Remove(dir)
+		}
+		pruned = append(pruned, dir)
+		debugf("lrt: no longer watching %s, as nothing in it is imported any more\n", dir)
+	}
+	watchLock.Unlock()
+
+	if len(pruned) > 0 {
+		saveWatchCache()
+	}
+	return pruned
+}
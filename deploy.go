@@ -0,0 +1,31 @@
+package main
+
+import "os/exec"
+
+// targetGoEnv sets GOOS and GOARCH for the build (and for listing the files
+// to watch) from -goos and -goarch, or to the remote host's with -remote
+var targetGoEnv []string
+
+// deployCommand runs -deploy in place of the service. It is given the path of
+// the new build in $BINARY, the -service port in $PORT and -cmd-args in
+// $ARGS. It can either copy the binary, restart the service on the target,
+// and exit successfully, after which lrt waits for the -service address to
+// pass the health check; or keep running (e.g. ssh device ./app) and print a
+// line matching -ready-log-pattern once the service is ready.
+func deployCommand() *exec.Cmd {
+	return exec.Command("sh", "-c", *deployFlag)
+}
+
+// deployHint explains why the service didn't become ready if the -deploy
+// hook is still running, given the channel that is closed once it exits
+func deployHint(deployed <-chan bool) string {
+	if *deployFlag == "" || readyLogPattern != nil {
+		return ""
+	}
+	select {
+	case <-deployed:
+		return ""
+	default:
+		return "     hint: -deploy is still running, and lrt only checks your service once it exits. If it keeps running your service, use -ready-log-pattern to say when it is ready.\n"
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	shellwords "github.com/mattn/go-shellwords"
+	"github.com/sirkon/goproxy/gomod"
+)
+
+// doctor collects the results of lrt doctor's checks
+type doctor struct {
+	problems int
+}
+
+func (d *doctor) ok(format string, args ...interface{}) {
+	fmt.Printf("lrt: ok: "+format+"\n", args...)
+}
+
+// problem reports something that will stop lrt working, with hints on how
+// to fix it
+func (d *doctor) problem(msg string, hints ...string) {
+	d.problems++
+	fmt.Println("lrt: problem: " + msg)
+	d.hint(hints)
+}
+
+// warning reports something that may get in the way
+func (d *doctor) warning(msg string, hints ...string) {
+	fmt.Println("lrt: warning: " + msg)
+	d.hint(hints)
+}
+
+func (d *doctor) hint(hints []string) {
+	for i, hint := range hints {
+		if i == 0 {
+			fmt.Println("     hint: " + hint)
+		} else {
+			fmt.Println("           " + hint)
+		}
+	}
+}
+
+// runDoctor implements lrt doctor, which checks that lrt will be able to
+// build, run and watch the given package, and suggests how to fix anything
+// that will get in the way.
+func runDoctor(args []string) {
+	doctorFlags := flag.NewFlagSet("lrt doctor", flag.ExitOnError)
+	// these are shared with the main command
+	for _, name := range []string{"build-args", "cmd-args", "go", "health-check-timeout", "no-proxy"} {
+		f := flag.Lookup(name)
+		doctorFlags.Var(f.Value, f.Name, f.Usage)
+	}
+	doctorFlags.Usage = func() {
+		fmt.Print(`Usage: lrt doctor [options] [package]
+
+lrt doctor checks that lrt can build, run and watch your package: that go and
+the other tools lrt uses are installed, that your module's dependencies
+resolve, that the system will let lrt watch all of your package's files, and
+that your service listens on $PORT. It exits with status 1 if it finds a
+problem.
+
+parameters:
+  package
+	the go package to check (default ".")
+
+options:
+`)
+		doctorFlags.PrintDefaults()
+		os.Exit(2)
+	}
+	doctorFlags.Parse(args)
+
+	pkg := doctorFlags.Arg(0)
+	if pkg == "" {
+		pkg = "."
+	}
+
+	d := &doctor{}
+	if d.checkTools() {
+		dirs, files := d.checkModule(pkg)
+		d.checkWatchLimits(dirs, files)
+		if dirs > 0 && !*noProxyFlag {
+			d.checkPort(pkg)
+		}
+	}
+
+	switch d.problems {
+	case 0:
+	case 1:
+		fmt.Println("lrt: found 1 problem")
+		os.Exit(1)
+	default:
+		fmt.Printf("lrt: found %d problems\n", d.problems)
+		os.Exit(1)
+	}
+}
+
+// checkTools checks that go is installed, and mentions the optional tools
+// that some of lrt's options need. It returns false if go isn't usable.
+func (d *doctor) checkTools() bool {
+	output, err := exec.Command(*goFlag, "version").CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			d.problem(*goFlag+" version failed: "+strings.TrimSpace(string(output)), "check your go installation")
+		} else {
+			d.problem(err.Error(), "install go from https://go.dev/dl/, or use -go to point at a go binary")
+		}
+		return false
+	}
+	d.ok("%s", strings.TrimSpace(string(output)))
+	if !usingOtherToolchain() && !strings.Contains(string(output), " "+runtime.Version()+" ") {
+		d.warning("lrt was built with "+runtime.Version()+", so it will reinstall itself next time it runs",
+			"use -no-self-update if you don't want it to")
+	}
+
+	for _, tool := range []struct{ name, usedFor, install string }{
+		{"dlv", "-debug", "go install github.com/go-delve/delve/cmd/dlv@latest"},
+		{"mkcert", "-tls", "see https://github.com/FiloSottile/mkcert, and run `mkcert -install`"},
+		{"lsof", "-detect-port", "install lsof with your package manager"},
+		{"rsync", "-remote", "install rsync with your package manager"},
+	} {
+		if tool.name == "lsof" && runtime.GOOS == "linux" {
+			// ports are read from /proc instead
+			continue
+		}
+		if path, err := exec.LookPath(tool.name); err == nil {
+			d.ok("%s is installed at %s", tool.name, path)
+		} else {
+			d.warning(tool.name+" is not installed, you'll need it to use "+tool.usedFor, tool.install)
+		}
+	}
+	return true
+}
+
+// checkModule checks that the package's replace directives point somewhere and
+// that its dependencies can be listed, and returns how many directories (and
+// files in them) lrt would watch.
+func (d *doctor) checkModule(pkg string) (dirs int, files int) {
+	output, err := exec.Command(*goFlag, "env", "GOMOD").Output()
+	goModuleFile := strings.TrimSpace(string(output))
+	if err == nil && goModuleFile != "" && goModuleFile != os.DevNull {
+		contents, err := ioutil.ReadFile(goModuleFile)
+		if err == nil {
+			var module *gomod.Module
+			module, err = gomod.Parse(goModuleFile, contents)
+			if err == nil {
+				d.ok("module %s (%s)", module.Name, goModuleFile)
+				for path, replace := range module.Replace {
+					r, ok := replace.(gomod.RelativePath)
+					if !ok {
+						continue
+					}
+					dir := string(r)
+					if !filepath.IsAbs(dir) {
+						dir = filepath.Join(filepath.Dir(goModuleFile), dir)
+					}
+					if _, err := os.Stat(filepath.Join(dir, "go.mod")); err != nil {
+						d.problem(fmt.Sprintf("%s is replaced by %s, but there is no go.mod there", path, r),
+							"check out "+path+" at "+dir+", or remove the replace directive from "+goModuleFile)
+					}
+				}
+			}
+		}
+		if err != nil {
+			d.problem(err.Error())
+		}
+	} else if err == nil {
+		d.warning("not in a go module, so lrt will build in GOPATH mode", "run go mod init if you meant to use modules")
+	}
+
+	output, err = exec.Command(*goFlag, "list", "-deps", "-f", `{{if not .Standard}}{{.Dir}}{{end}}`, pkg).CombinedOutput()
+	if err != nil {
+		d.problem("go list could not resolve "+pkg+" and its dependencies:\n"+strings.TrimSpace(string(output)),
+			"if a dependency is missing, run go mod tidy",
+			"go packages are specified by package name, to use a relative directory start with ./, e.g. \"./lrt\"")
+		return 0, 0
+	}
+	for _, dir := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if dir == "" {
+			continue
+		}
+		dirs++
+		entries, _ := ioutil.ReadDir(dir)
+		files += len(entries)
+	}
+	d.ok("%s and its dependencies resolve (%d directories to watch)", pkg, dirs)
+	return dirs, files
+}
+
+// checkWatchLimits checks that lrt will be allowed to watch everything. On
+// linux each directory uses an inotify watch, elsewhere kqueue needs an open
+// file for each file.
+func (d *doctor) checkWatchLimits(dirs int, files int) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err == nil {
+		needed := uint64(1024)
+		if runtime.GOOS != "linux" {
+			needed += uint64(files)
+		}
+		if limit.Cur < needed {
+			hint := "run ulimit -n " + strconv.FormatUint(needed*2, 10) + " before starting lrt"
+			if runtime.GOOS == "darwin" {
+				hint = "sudo launchctl limit maxfiles 1000000 1000000"
+			}
+			d.problem(fmt.Sprintf("you may only open %d files at once, lrt needs about %d", limit.Cur, needed), hint)
+		} else {
+			d.ok("you may open %d files at once", limit.Cur)
+		}
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if contents, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_user_watches"); err == nil {
+		watches, _ := strconv.Atoi(strings.TrimSpace(string(contents)))
+		// editors and other tools use inotify watches too
+		if watches < dirs*2 {
+			d.problem(fmt.Sprintf("inotify only allows %d watches, and lrt needs %d", watches, dirs),
+				"sudo sysctl fs.inotify.max_user_watches=524288",
+				"(add it to /etc/sysctl.conf to keep it after a reboot)")
+		} else {
+			d.ok("inotify allows %d watches", watches)
+		}
+	}
+	if contents, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_user_instances"); err == nil {
+		instances, _ := strconv.Atoi(strings.TrimSpace(string(contents)))
+		if instances < 16 {
+			d.warning(fmt.Sprintf("inotify only allows %d instances, so you may not be able to run many lrts (or editors) at once", instances),
+				"sudo sysctl fs.inotify.max_user_instances=512")
+		} else {
+			d.ok("inotify allows %d instances", instances)
+		}
+	}
+}
+
+// checkPort builds the package and boots it with $PORT set, to check that it
+// listens there
+func (d *doctor) checkPort(pkg string) {
+	dir, err := ioutil.TempDir("", "lrt-doctor")
+	if err != nil {
+		d.problem(err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	build, err := shellwords.Parse(*buildArgsFlag)
+	var args []string
+	if err == nil {
+		args, err = shellwords.Parse(*cmdArgsFlag)
+	}
+	if err != nil {
+		d.problem(err.Error())
+		return
+	}
+
+	binary := filepath.Join(dir, "service")
+	output, err := exec.Command(*goFlag, append(append([]string{"build"}, build...), "-o", binary, pkg)...).CombinedOutput()
+	if err != nil {
+		d.problem(pkg+" does not build:\n"+strings.TrimSpace(string(output)), "lrt will show you build errors as you fix them")
+		return
+	}
+
+	address := generateServiceURL(&url.URL{Scheme: "http", Host: "localhost:3000"})
+	service := exec.Command(binary, args...)
+	service.Env = append(os.Environ(), "PORT="+address.Port())
+	recentOutput.reset()
+	service.Stdout = &lineWriter{out: ioutil.Discard, onLine: recentOutput.add}
+	service.Stderr = service.Stdout
+	service.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := service.Start(); err != nil {
+		d.problem(err.Error())
+		return
+	}
+	exited := make(chan bool)
+	go func() {
+		service.Wait()
+		close(exited)
+	}()
+	defer func() {
+		syscall.Kill(-service.Process.Pid, syscall.SIGKILL)
+		<-exited
+	}()
+
+	deadline := time.After(*timeoutFlag)
+	for {
+		if conn, err := net.Dial("tcp", address.Host); err == nil {
+			conn.Close()
+			d.ok("%s listens on $PORT", pkg)
+			return
+		}
+
+		select {
+		case <-exited:
+			d.problem(strings.TrimSpace(string(withRecentOutput(fmt.Sprintf("%s exited (%s) before listening on $PORT", pkg, service.ProcessState)))),
+				"your service should keep running and listen on $PORT. For example: http.ListenAndServe(\"localhost:\" + os.Getenv(\"PORT\"), nil)")
+			return
+		case <-deadline:
+			if ports := listeningPorts(service.Process.Pid); len(ports) > 0 {
+				d.problem(fmt.Sprintf("%s listens on port %d, not on $PORT", pkg, ports[0]),
+					"change it to listen on $PORT. For example: http.ListenAndServe(\"localhost:\" + os.Getenv(\"PORT\"), nil)",
+					fmt.Sprintf("or run lrt with -service localhost:%d, or -detect-port", ports[0]))
+			} else {
+				d.problem(fmt.Sprintf("%s did not listen on $PORT within %s", pkg, *timeoutFlag),
+					"ensure your service listens on $PORT. For example: http.ListenAndServe(\"localhost:\" + os.Getenv(\"PORT\"), nil)",
+					"if it takes a while to start, increase -health-check-timeout")
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
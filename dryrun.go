@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// printDryRun implements -dry-run: it prints the options lrt would use, the
+// directories it would watch (and the files in them that the service is
+// built from), and the commands it would build and run the service with.
+// Nothing is started or built, though go list is run to find the
+// dependencies.
+func printDryRun() {
+	figureOutModules()
+	if *remoteFlag != "" {
+		remoteHost, remoteDir = parseRemote(*remoteFlag, syncRoot())
+	}
+
+	fmt.Printf("lrt: dry run, nothing will be started\n\n")
+
+	fmt.Printf("options:\n")
+	flag.Visit(func(f *flag.Flag) {
+		fmt.Printf("  -%s=%s\n", f.Name, shellQuote(f.Value.String()))
+	})
+	fmt.Println()
+
+	fmt.Printf("package %s in %s", packageName, packageDir)
+	if goModule != nil {
+		fmt.Printf(" (module %s)", goModule.Name)
+	}
+	fmt.Println()
+	if !*noProxyFlag {
+		for _, u := range listenURLs {
+			fmt.Printf("listening on %s (forwarding to %s)\n", u, serviceAddress())
+		}
+		for i, u := range replicaURLs {
+			fmt.Printf("replica %d on %s\n", i+2, u)
+		}
+		if healthCheckURL != nil && *readyPatternFlag == "" && len(healthCheckCmd) == 0 {
+			fmt.Printf("health check: %s %s\n", *healthMethodFlag, healthCheckURL)
+		}
+	}
+	fmt.Println()
+
+	printDryRunWatches()
+
+	args := buildArgs
+	if *versionVarFlag != "" {
+		args = withLdflags(args, "-X "+*versionVarFlag+"=<git sha>-<timestamp>")
+	}
+	fmt.Printf("build:\n")
+	if *remoteFlag != "" {
+		rsync, build := remoteBuildCommands(args)
+		fmt.Printf("  %s\n  %s\n", shellJoin(rsync.Args), shellJoin(build.Args))
+	} else {
+		build := buildCommand(args, tmpFile.Name())
+		fmt.Printf("  %s\n", shellJoin(append(addedEnv(build.Env), build.Args...)))
+	}
+	fmt.Println()
+
+	fmt.Printf("run:\n")
+	cmd := primaryCommand()
+	fmt.Printf("  %s\n", shellJoin(append(addedEnv(cmd.Env), cmd.Args...)))
+}
+
+// printDryRunWatches finds and prints what lrt would watch, as it would on the
+// first build
+func printDryRunWatches() {
+	if *watchRootFlag {
+		watchTree(watchRootDir())
+	} else {
+		output, err := listDependencies()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "lrt: warning: could not list dependencies, so lrt would wait for the first build to find them: %s\n%s", err, output)
+		} else {
+			watchDependencies(output)
+		}
+	}
+	findDependencies()
+
+	dirs := make([]string, 0, len(watchedDir))
+	for dir := range watchedDir {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	fmt.Printf("watching %d directories:\n", len(dirs))
+	for _, dir := range dirs {
+		files := []string{}
+		ignored := 0
+		for file, built := range dependencyFiles[dir] {
+			if built {
+				files = append(files, file)
+			} else {
+				ignored++
+			}
+		}
+		sort.Strings(files)
+		line := "  " + dir
+		if len(files) > 0 {
+			line += ": " + strings.Join(files, " ")
+		}
+		if ignored > 0 {
+			line += fmt.Sprintf(" (ignoring %d excluded by build constraints)", ignored)
+		}
+		fmt.Println(line)
+	}
+
+	also := []string{}
+	for _, file := range *envFileFlag {
+		also = append(also, filepath.Clean(file))
+	}
+	if *dotenvFlag {
+		for _, file := range dotenvFiles {
+			if _, err := os.Stat(file); err == nil {
+				also = append(also, file+" (to restart your service)")
+			}
+		}
+	}
+	for _, pattern := range *reloadFlag {
+		also = append(also, filepath.Clean(pattern)+" (to send -reload-signal)")
+	}
+	for _, pattern := range *browserReloadFlag {
+		also = append(also, filepath.Clean(pattern)+" (to reload the browser)")
+	}
+	if len(also) > 0 {
+		fmt.Printf("and:\n")
+		for _, file := range also {
+			fmt.Printf("  %s\n", file)
+		}
+	}
+	fmt.Println()
+}
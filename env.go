@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// dotenvFiles are loaded into the service's environment (if they exist) when
+// -dotenv is set. Later files override earlier ones.
+var dotenvFiles = []string{".env", ".env.local"}
+
+// serviceEnv is the environment the service is started with: lrt's own
+// environment, plus anything set in the .env files that isn't already set,
+// and then anything set by -env-file and -env.
+func serviceEnv() []string {
+	env := os.Environ()
+
+	if *dotenvFlag {
+		vars := map[string]string{}
+		keys := []string{}
+		for _, file := range dotenvFiles {
+			fileVars, err := parseEnvFile(file)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					fmt.Fprintf(stderr, "lrt: %s\n", err)
+				}
+				continue
+			}
+			for _, kv := range fileVars {
+				if _, ok := vars[kv[0]]; !ok {
+					keys = append(keys, kv[0])
+				}
+				vars[kv[0]] = kv[1]
+			}
+		}
+
+		for _, key := range keys {
+			if _, ok := os.LookupEnv(key); !ok {
+				env = append(env, key+"="+vars[key])
+			}
+		}
+	}
+
+	for _, file := range *envFileFlag {
+		fileVars, err := parseEnvFile(file)
+		if err != nil {
+			fmt.Fprintf(stderr, "lrt: %s\n", err)
+			continue
+		}
+		for _, kv := range fileVars {
+			env = setEnv(env, kv[0], kv[1])
+		}
+	}
+
+	for _, kv := range *envFlag {
+		parts := strings.SplitN(kv, "=", 2)
+		env = setEnv(env, parts[0], parts[1])
+	}
+	return env
+}
+
+// setEnv sets key to value in env, replacing any existing value
+func setEnv(env []string, key, value string) []string {
+	result := env[:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			result = append(result, kv)
+		}
+	}
+	return append(result, key+"="+value)
+}
+
+// parseEnvFile reads KEY=VALUE lines from a file, ignoring blank lines and
+// comments. Values may be "double quoted" (with escapes) or 'single quoted'.
+func parseEnvFile(file string) ([][2]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := [][2]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", file, n)
+		}
+
+		value := strings.TrimSpace(parts[1])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value for %s", file, n, key)
+			}
+		case strings.HasPrefix(value, "'"):
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value for %s", file, n, key)
+			}
+			value = value[1 : len(value)-1]
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		vars = append(vars, [2]string{key, value})
+	}
+	return vars, scanner.Err()
+}
+
+// watchEnvFiles restarts the service when one of the .env files, or a file
+// passed to -env-file, changes
+func watchEnvFiles() {
+	files := append([]string{}, *envFileFlag...)
+	if *dotenvFlag {
+		files = append(files, dotenvFiles...)
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	envWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		exit(1)
+	}
+	watching := map[string]bool{}
+	for i, file := range files {
+		files[i] = filepath.Clean(file)
+		dir := filepath.Dir(files[i])
+		if watching[dir] {
+			continue
+		}
+		if err := envWatcher.Add(dir); err != nil {
+			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+			exit(1)
+		}
+		watching[dir] = true
+	}
+
+	restart := debounceCallable(*debounceFlag, *debounceMaxFlag, func() {
+		infof("lrt: environment changed\n")
+		restartService()
+	})
+
+	go func() {
+		for {
+			select {
+			case ev := <-envWatcher.Events:
+				if ev.Op == fsnotify.Chmod {
+					continue
+				}
+				for _, file := range files {
+					if filepath.Clean(ev.Name) == file {
+						go restart()
+					}
+				}
+
+			case err := <-envWatcher.Errors:
+				fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+				exit(1)
+			}
+		}
+	}()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// writeErrorResponse responds with the current build or boot error. Browsers
+// get a page where each file:line is a link that opens it in -editor, and
+// clients that accept JSON get the error (and any compiler errors) as JSON.
+func writeErrorResponse(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		body := errorJSON{Error: "boot", Message: string(errorResponse), Diagnostics: []diagnostic{}}
+		if buildFailed {
+			body.Error = "build"
+			body.Diagnostics = parseDiagnostics(errorResponse)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(body)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusBadGateway)
+		errorTemplate.Execute(w, linkFiles(string(errorResponse)))
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+	w.Write(errorResponse)
+}
+
+// errorJSON is the body of error responses for clients that accept JSON
+type errorJSON struct {
+	Error       string       `json:"error"` // build or boot
+	Message     string       `json:"message"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<title>lrt: error</title>
+<style>body { font-family: sans-serif } pre { background: #fff0f0; padding: 8px; white-space: pre-wrap } a { color: inherit }</style>
+<pre>{{ . }}</pre>
+`))
+
+// fileLocation matches file:line or file:line:col in build errors and stack traces
+var fileLocation = regexp.MustCompile(`([^\s:()]+\.go):(\d+)(?::(\d+))?`)
+
+// linkFiles escapes text for HTML, and turns each file:line into a link
+func linkFiles(text string) template.HTML {
+	var b strings.Builder
+	last := 0
+	for _, m := range fileLocation.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(template.HTMLEscapeString(text[last:m[0]]))
+		file, line, col := text[m[2]:m[3]], text[m[4]:m[5]], "1"
+		if m[6] >= 0 {
+			col = text[m[6]:m[7]]
+		}
+		b.WriteString(`<a href="` + template.HTMLEscapeString(editorLink(file, line, col)) + `">`)
+		b.WriteString(template.HTMLEscapeString(text[m[0]:m[1]]))
+		b.WriteString("</a>")
+		last = m[1]
+	}
+	b.WriteString(template.HTMLEscapeString(text[last:]))
+	return template.HTML(b.String())
+}
+
+// editors are the -editor values lrt knows how to link to
+var editors = map[string]string{
+	"vscode":   "vscode://file/{file}:{line}:{col}",
+	"cursor":   "cursor://file/{file}:{line}:{col}",
+	"idea":     "idea://open?file={file}&line={line}&column={col}",
+	"goland":   "goland://open?file={file}&line={line}&column={col}",
+	"sublime":  "subl://open?url=file://{file}&line={line}&column={col}",
+	"textmate": "txmt://open?url=file://{file}&line={line}&column={col}",
+}
+
+// editorLink returns the link to open file at line and col in -editor
+func editorLink(file string, line string, col string) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	link, ok := editors[*editorFlag]
+	if !ok {
+		link = *editorFlag
+	}
+	if strings.Contains(link, "?") {
+		file = url.QueryEscape(file)
+	}
+	return strings.NewReplacer("{file}", file, "{line}", line, "{col}", col).Replace(link)
+}
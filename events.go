@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// event is something that happened to the service, as reported by -json and
+// -events-socket. Fields are added as appropriate for the type of event.
+type event map[string]interface{}
+
+// with returns the event with an extra field set
+func (e event) with(key string, value interface{}) event {
+	e[key] = value
+	return e
+}
+
+var (
+	eventsLock        sync.Mutex
+	eventsSubscribers = map[chan event]bool{}
+	recentEvents      []event
+)
+
+// recentEventsLimit is how many events are kept for the status page
+const recentEventsLimit = 50
+
+// emit sends an event to everyone who is listening. Events are dropped for
+// subscribers that can't keep up, rather than slowing lrt down.
+func emit(typ string, fields event) {
+	e := event{"time": time.Now().Format(time.RFC3339Nano), "type": typ, "build": atomic.LoadInt32(&buildNumber)}
+	for k, v := range fields {
+		e[k] = v
+	}
+
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	recentEvents = append(recentEvents, e)
+	if len(recentEvents) > recentEventsLimit {
+		recentEvents = recentEvents[1:]
+	}
+	for ch := range eventsSubscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func subscribeEvents() chan event {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	ch := make(chan event, 100)
+	eventsSubscribers[ch] = true
+	return ch
+}
+
+func unsubscribeEvents(ch chan event) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	delete(eventsSubscribers, ch)
+}
+
+// lastEvents returns the most recent events, oldest first
+func lastEvents() []event {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	return append([]event{}, recentEvents...)
+}
+
+// writeEvents writes events to stdout as JSON lines, for -json.
+func writeEvents() {
+	ch := subscribeEvents()
+	go func() {
+		for e := range ch {
+			line, _ := json.Marshal(e)
+			os.Stdout.Write(append(line, '\n'))
+		}
+	}()
+}
+
+// serveEvents streams events as JSON lines to anyone who connects to the
+// unix socket at path, for -events-socket.
+func serveEvents(path string) error {
+	listener, err := listenUnix(path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go streamEvents(conn)
+		}
+	}()
+	return nil
+}
+
+func streamEvents(conn net.Conn) {
+	defer conn.Close()
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+
+	// notice when the client disconnects
+	closed := make(chan bool)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case e := <-ch:
+			line, _ := json.Marshal(e)
+			if _, err := conn.Write(append(line, '\n')); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// diagnostic is an error reported by the go compiler
+type diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+var diagnosticPattern = regexp.MustCompile(`^(\S[^:]*\.go):(\d+)(?::(\d+))?: (.*)$`)
+
+// parseDiagnostics finds the file:line:column: message errors in the output
+// of go build.
+func parseDiagnostics(output []byte) []diagnostic {
+	diagnostics := []diagnostic{}
+	for _, line := range strings.Split(string(output), "\n") {
+		match := diagnosticPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		d := diagnostic{File: match[1], Message: match[4]}
+		d.Line, _ = strconv.Atoi(match[2])
+		d.Column, _ = strconv.Atoi(match[3])
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics
+}
+
+// exitFields describes how a process exited, for service-exited events
+func exitFields(state *os.ProcessState) event {
+	fields := event{"status": state.String(), "exit_code": state.ExitCode()}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		fields["signal"] = status.Signal().String()
+	}
+	return fields
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// stringsFlag is a flag that can be passed multiple times
+type stringsFlag []string
+
+// stringsVar defines a flag that can be passed multiple times
+func stringsVar(name string, usage string) *stringsFlag {
+	s := &stringsFlag{}
+	flag.Var(s, name, usage)
+	return s
+}
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// defaultStringsFlag is a stringsFlag with a default, which is replaced by
+// the first value given. Values from $LRT_ or .lrt.yaml become the default
+// for the command line (see useSettingsAsDefaults), so they are replaced too.
+type defaultStringsFlag struct {
+	stringsFlag
+	isDefault bool
+}
+
+// defaultStringsVar defines a flag that can be passed multiple times, and
+// has a default if it isn't
+func defaultStringsVar(name string, value string, usage string) *defaultStringsFlag {
+	s := &defaultStringsFlag{stringsFlag: stringsFlag{value}, isDefault: true}
+	flag.Var(s, name, usage)
+	return s
+}
+
+func (s *defaultStringsFlag) Set(value string) error {
+	if s.isDefault {
+		s.stringsFlag = nil
+		s.isDefault = false
+	}
+	return s.stringsFlag.Set(value)
+}
+
+// useSettingsAsDefaults is called once options have been set from $LRT_ and
+// .lrt.yaml, so that a repeatable option with a default (like -listen) given
+// on the command line replaces their values rather than adding to them.
+func useSettingsAsDefaults() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if s, ok := f.Value.(*defaultStringsFlag); ok {
+			s.isDefault = true
+		}
+	})
+}
+
+// statusRanges is a list of HTTP status codes parsed from a string like "200-299,304"
+type statusRanges [][2]int
+
+func parseStatusRanges(str string) (statusRanges, error) {
+	var ranges statusRanges
+	for _, part := range strings.Split(str, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("%#v is not a valid status code", bounds[0])
+		}
+		max := min
+		if len(bounds) == 2 {
+			max, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("%#v is not a valid status code", bounds[1])
+			}
+		}
+		ranges = append(ranges, [2]int{min, max})
+	}
+	return ranges, nil
+}
+
+func (s statusRanges) contains(code int) bool {
+	for _, r := range s {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// signals are the signals that can be named in flags
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// parseSignal parses a signal name like "TERM" or "SIGTERM", or a number.
+func parseSignal(str string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(str); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signals[strings.TrimPrefix(strings.ToUpper(str), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("%#v is not a signal lrt knows about", str)
+}
+
+// parseSignalMapping parses "USR1" (forward SIGUSR1 as is) or "HUP=USR2"
+// (forward SIGHUP as SIGUSR2).
+func parseSignalMapping(str string) (from syscall.Signal, to syscall.Signal, err error) {
+	parts := strings.SplitN(str, "=", 2)
+	from, err = parseSignal(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	to = from
+	if len(parts) == 2 {
+		to, err = parseSignal(parts[1])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if from == syscall.SIGKILL || from == syscall.SIGINT || from == syscall.SIGTERM {
+		return 0, 0, fmt.Errorf("%s can't be forwarded", from)
+	}
+	return from, to, nil
+}
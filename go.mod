@@ -6,5 +6,6 @@ require (
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/mattn/go-shellwords v1.0.3
 	github.com/sirkon/goproxy v1.4.8
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b
 	golang.org/x/sys v0.0.0-20220731174439-a90be440212d // indirect
 )
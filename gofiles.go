@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// goFiles are set when lrt is run with .go files instead of a package (like
+// go run main.go), as absolute paths. go builds them as a package of their own.
+var goFiles []string
+
+// isGoFiles is true if every argument is a .go file
+func isGoFiles(args []string) bool {
+	for _, arg := range args {
+		if !strings.HasSuffix(arg, ".go") {
+			return false
+		}
+	}
+	return len(args) > 0
+}
+
+// mustParseGoFiles checks that the files exist, are in one directory (as go
+// requires) and make up package main.
+func mustParseGoFiles(args []string) {
+	dir := ""
+	for _, arg := range args {
+		abs, err := filepath.Abs(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+			os.Exit(1)
+		}
+		if strings.HasSuffix(abs, "_test.go") {
+			fmt.Fprintf(os.Stderr, "lrt: cannot run test file %#v\n", arg)
+			fmt.Fprintf(os.Stderr, "     hint: to rerun tests when the code changes, use lrt test\n")
+			os.Exit(1)
+		}
+		if dir != "" && filepath.Dir(abs) != dir {
+			fmt.Fprintf(os.Stderr, "lrt: %#v is not in the same directory as %#v\n", arg, args[0])
+			fmt.Fprintf(os.Stderr, "     hint: go can only build .go files from one directory together\n")
+			os.Exit(1)
+		}
+		dir = filepath.Dir(abs)
+
+		file, err := parser.ParseFile(token.NewFileSet(), abs, nil, parser.PackageClauseOnly)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "lrt: cannot find file %#v\n", arg)
+			} else {
+				fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+			}
+			os.Exit(1)
+		}
+		if file.Name.Name != "main" {
+			fmt.Printf("lrt: %#v does not contain package \"main\".\n", arg)
+			os.Exit(1)
+		}
+		goFiles = append(goFiles, abs)
+	}
+	// go list doesn't know where the files are (it calls them
+	// command-line-arguments), so lrt watches the directory itself
+	packageDir = dir
+}
+
+// packageArgs are what go build and go list are given: the package, or the
+// .go files
+func packageArgs() []string {
+	if len(goFiles) > 0 {
+		return goFiles
+	}
+	return []string{packageName}
+}
+
+// isOtherGoFile is true for .go files next to the ones lrt was given that
+// aren't part of the build, so changing them shouldn't cause a rebuild
+func isOtherGoFile(name string) bool {
+	if len(goFiles) == 0 || filepath.Dir(name) != filepath.Dir(goFiles[0]) {
+		return false
+	}
+	for _, file := range goFiles {
+		if file == name {
+			return false
+		}
+	}
+	return true
+}
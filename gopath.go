@@ -0,0 +1,66 @@
+package main
+
+import (
+	"go/build"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirkon/goproxy/gomod"
+)
+
+// localPackageDir is the directory of the package with import path p, if it
+// is code you might be editing, or "" if it isn't. In a module that is the
+// module itself and any module replaced by a local directory (relative to
+// go.mod); modules downloaded to the module cache are left alone. In GOPATH
+// mode it is any package in the src directory of one of the $GOPATH entries,
+// the first one it is found in winning as it does for go build.
+func localPackageDir(p string) (string, error) {
+	if goModule != nil {
+		// as for go build, the longest module path that p is in wins, so
+		// that a nested module can be replaced separately from its parent
+		dir, longest := "", -1
+		if hasPathPrefix(p, goModule.Name) {
+			dir, longest = filepath.Join(goModuleDir, strings.TrimPrefix(p, goModule.Name)), len(goModule.Name)
+		}
+		for path, replace := range goModule.Replace {
+			if !hasPathPrefix(p, path) || len(path) <= longest {
+				continue
+			}
+			dir, longest = "", len(path)
+			if r, ok := replace.(gomod.RelativePath); ok {
+				root := string(r)
+				if !filepath.IsAbs(root) {
+					root = filepath.Join(goModuleDir, root)
+				}
+				dir = filepath.Join(root, strings.TrimPrefix(p, path))
+			}
+		}
+		return dir, nil
+	}
+
+	pkg, err := build.Default.Import(p, ".", build.FindOnly)
+	if err != nil {
+		return "", err
+	}
+	if pkg.Goroot {
+		return "", nil
+	}
+	return pkg.Dir, nil
+}
+
+// hasPathPrefix is true if the import path p is prefix or a package inside it
+func hasPathPrefix(p string, prefix string) bool {
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// gopathSrcOf returns the src directory of the $GOPATH entry that dir is in,
+// or "" if it isn't in one
+func gopathSrcOf(dir string) string {
+	for _, entry := range filepath.SplitList(build.Default.GOPATH) {
+		src := filepath.Join(entry, "src")
+		if dir == src || strings.HasPrefix(dir, src+string(filepath.Separator)) {
+			return src
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	shellwords "github.com/mattn/go-shellwords"
+)
+
+// testLock ensures only one go test runs at a time
+var testLock sync.Mutex
+
+// runTestsOnChange implements lrt test, which reruns go test for the given
+// packages whenever they (or their dependencies, or their tests) change.
+func runTestsOnChange(args []string) {
+	testFlags := flag.NewFlagSet("lrt test", flag.ExitOnError)
+	runFlag := testFlags.String("run", "", "only run tests matching this regular expression (passed to go test -run)")
+	// these are shared with the main command
+	for _, name := range []string{"build-args", "debounce", "debounce-max", "go"} {
+		f := flag.Lookup(name)
+		testFlags.Var(f.Value, f.Name, f.Usage)
+	}
+	testFlags.Usage = func() {
+		fmt.Print(`Usage: lrt test [options] [packages]
+
+lrt test watches the given packages and their dependencies and reruns go test
+whenever any of them, or their tests, change.
+
+parameters:
+  packages
+	the go packages to test (default ".")
+
+options:
+`)
+		testFlags.PrintDefaults()
+		os.Exit(2)
+	}
+	testFlags.Parse(args)
+
+	packages := testFlags.Args()
+	if len(packages) == 0 {
+		packages = []string{"."}
+	}
+
+	testArgs, err := shellwords.Parse(*buildArgsFlag)
+	if err != nil {
+		panic(err) // can only happen if shellwords.ParseBacktick is true, and it isn't
+	}
+	testArgs = append([]string{"test"}, testArgs...)
+	if *runFlag != "" {
+		testArgs = append(testArgs, "-run", *runFlag)
+	}
+	testArgs = append(testArgs, packages...)
+
+	figureOutToolchain()
+	figureOutModules()
+
+	watchForChanges(func() {
+		retest(packages, testArgs)
+	}, true)
+}
+
+// retest watches the dependencies of the packages, and then runs go test,
+// finishing with a summary line so the result is easy to spot.
+func retest(packages []string, testArgs []string) {
+	testLock.Lock()
+	defer testLock.Unlock()
+
+	// the dependencies may have changed since last time, so we list them on
+	// every run; -test includes the packages that are only imported by tests.
+	listArgs := append([]string{"list", "-deps", "-test", "-f", "{{ .ImportPath }}"}, packages...)
+	output, err := exec.Command(*goFlag, listArgs...).CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+			os.Exit(1)
+		}
+		// if the packages don't compile, go test will explain why
+		fmt.Print(string(output))
+	} else {
+		watchListedPackages(output)
+	}
+
+	fmt.Printf("lrt: running go %s\n", strings.Join(testArgs, " "))
+	start := time.Now()
+
+	cmd := exec.Command(*goFlag, testArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	duration := time.Since(start).Round(10 * time.Millisecond)
+
+	if err == nil {
+		fmt.Printf("lrt: PASS (%s)\n", duration)
+	} else if _, ok := err.(*exec.ExitError); ok {
+		fmt.Printf("lrt: FAIL (%s)\n", duration)
+	} else {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// healthClient sends HTTP health checks to the service
+var healthClient = &http.Client{Transport: serviceTransport}
+
+// grpcClient talks HTTP/2, usually without TLS (h2c) as gRPC servers in
+// development usually do, but also over TLS with -service-scheme https.
+var grpcClient = &http.Client{
+	Transport: &http2.Transport{
+		// http2.Transport always "dials TLS", so we only add it for https
+		AllowHTTP: true,
+		DialTLS: func(network string, addr string, config *tls.Config) (net.Conn, error) {
+			conn, err := dialService(context.Background(), network, addr)
+			if err != nil || serviceURL.Scheme != "https" {
+				return conn, err
+			}
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+	Timeout: time.Second,
+}
+
+// waitUntilReady waits for the service to be ready to receive requests at target,
+// either by waiting for it to log a line matching -ready-log-pattern (in which
+// case logReady receives a value), or by waiting until it is healthy.
+// With -no-proxy and no -ready-log-pattern, the service is ready as soon as
+// it has started.
+func waitUntilReady(target *url.URL, logReady <-chan bool, stop <-chan bool) bool {
+	if readyLogPattern == nil {
+		// without a proxy, there are no requests to wait for
+		if *noProxyFlag {
+			return true
+		}
+		return waitUntilHealthy(target, stop)
+	}
+
+	select {
+	case <-logReady:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// waitUntilHealthy polls isHealthy until it succeeds or stop is closed.
+// After an initial -health-check-delay, the wait between attempts starts at
+// -health-check-interval and doubles up to -health-check-max-interval so
+// that slow booting services aren't hammered with requests.
+func waitUntilHealthy(target *url.URL, stop <-chan bool) bool {
+	wait := *healthDelayFlag
+	interval := *healthIntervalFlag
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(wait):
+		}
+
+		if isHealthy(target) {
+			debugf("lrt: health check %d of %s: healthy\n", attempt, target)
+			return true
+		}
+		debugf("lrt: health check %d of %s: not healthy yet, trying again in %s\n", attempt, target, interval)
+
+		wait = interval
+		interval *= 2
+		if interval > *healthMaxWaitFlag {
+			interval = *healthMaxWaitFlag
+		}
+	}
+}
+
+// isHealthy makes a single attempt to check whether the service is ready to
+// receive requests.
+//
+// target is usually healthCheckURL. By default a service is healthy once it returns a 2xx (or the
+// response matches the -health-check-status and -health-check-body), but with
+// -health-check tcp we only wait for the port to accept connections, as some
+// services don't have an HTTP handler that returns 2xx at a well known path.
+//
+// For gRPC services -health-check grpc calls grpc.health.v1.Health/Check (for
+// the service named after the colon, if any) and waits for it to be SERVING.
+//
+// For services that don't speak HTTP at all, -health-check-cmd runs a command
+// (with $PORT set) and the service is healthy once it exits successfully.
+func isHealthy(target *url.URL) bool {
+	if healthCheckCmd != nil {
+		return runHealthCheckCmd(target.Port())
+	}
+
+	switch target.Scheme {
+	case "tcp":
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conn, err := dialService(ctx, "tcp", target.Host)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+
+	case "grpc":
+		return isGRPCServing(target)
+
+	default:
+		return isHTTPHealthy(target)
+	}
+}
+
+// isHTTPHealthy sends the health check request (customised by the -health-check-*
+// flags) and checks whether the response has the expected status and body.
+func isHTTPHealthy(target *url.URL) bool {
+	req, err := http.NewRequest(*healthMethodFlag, target.String(), nil)
+	if err != nil {
+		return false
+	}
+	for name, values := range healthCheckHeader {
+		if name == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[name] = values
+	}
+
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if !healthCheckStatus.contains(resp.StatusCode) {
+		return false
+	}
+	if *healthBodyFlag != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil || !strings.Contains(string(body), *healthBodyFlag) {
+			return false
+		}
+	}
+	return true
+}
+
+// runHealthCheckCmd runs -health-check-cmd once, expanding $PORT (and $SOCKET) in its arguments
+func runHealthCheckCmd(port string) bool {
+	expand := func(name string) string {
+		if name == "PORT" {
+			return port
+		}
+		if name == "SOCKET" {
+			return serviceSocket
+		}
+		return os.Getenv(name)
+	}
+	args := make([]string, len(healthCheckCmd))
+	for i, arg := range healthCheckCmd {
+		args[i] = os.Expand(arg, expand)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeoutFlag)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "PORT="+port, "SOCKET="+serviceSocket)
+	return cmd.Run() == nil
+}
+
+// isGRPCServing implements the standard grpc.health.v1 health checking protocol,
+// https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+// The messages are simple enough that we encode them by hand rather than
+// depending on protobuf.
+func isGRPCServing(target *url.URL) bool {
+	// message HealthCheckRequest { string service = 1; }
+	var msg []byte
+	if service := target.Path[1:]; service != "" {
+		length := make([]byte, binary.MaxVarintLen64)
+		msg = append(msg, 0x0a)
+		msg = append(msg, length[:binary.PutUvarint(length, uint64(len(service)))]...)
+		msg = append(msg, service...)
+	}
+
+	// each gRPC message is prefixed by a compression flag and a 4 byte length
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	req, err := http.NewRequest("POST", serviceURL.Scheme+"://"+target.Host+"/grpc.health.v1.Health/Check", bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := grpcClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false
+	}
+
+	// errors without a response body are sent as headers, not trailers
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if resp.StatusCode != http.StatusOK || status != "0" || len(data) < 5 {
+		return false
+	}
+
+	// message HealthCheckResponse { ServingStatus status = 1; } where SERVING = 1
+	msg = data[5:]
+	return len(msg) >= 2 && msg[0] == 0x08 && msg[1] == 0x01
+}
+
+// healthCheckName describes the health check for use in error messages
+func healthCheckName() string {
+	if readyLogPattern != nil {
+		return "output matching " + readyLogPattern.String()
+	}
+	if healthCheckCmd != nil {
+		return "`" + *healthCmdFlag + "`"
+	}
+	return healthCheckURL.String()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// hint is a suggestion shown when a build or boot fails with output that
+// matches a regular expression
+type hint struct {
+	Match string `json:"match"`
+	Hint  string `json:"hint"`
+	re    *regexp.Regexp
+
+	// lrt is set for hints about lrt's own errors, rather than the service's.
+	// These can refer to submatches of Match, like $1.
+	lrt bool
+}
+
+// hints are checked against the output of failed builds and boots. Teams can
+// add their own in -hints.
+var hints = []hint{
+	{Match: `address already in use`, Hint: "your service may be listening on a fixed port, instead of $PORT"},
+	{Match: `cannot find package|no required module provides package`, Hint: "try go mod tidy, or go get the missing package"},
+
+	{Match: `^listen tcp .*:(\d+): bind: address already in use`, Hint: "Are you already running a development server somewhere else?\nif so try `lsof -i:$1` to find the process id\nor use -listen-fallback 10 to listen on the next free port instead", lrt: true},
+	{Match: `^listen unix (.*): bind: address already in use`, Hint: "Are you already running a development server somewhere else?\nif so try `lsof $1` to find the process id", lrt: true},
+	{Match: `too many open files`, Hint: "you may need to increase the number of open files you are allowed, try:\nsudo launchctl limit maxfiles 1000000 1000000", lrt: true},
+	{Match: `no space left on device`, Hint: "you may need to increase the number of inotify watches you are allowed, try:\nsudo sysctl fs.inotify.max_user_watches=524288", lrt: true},
+}
+
+func init() {
+	for i := range hints {
+		hints[i].re = regexp.MustCompile(hints[i].Match)
+	}
+}
+
+// loadHints adds the hints in file, a JSON list of {"match": "regexp",
+// "hint": "text"} objects, to the built in ones.
+func loadHints(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	extra := []hint{}
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	for i, h := range extra {
+		extra[i].re, err = regexp.Compile(h.Match)
+		if err != nil {
+			return fmt.Errorf("%s: %#v is not a valid regular expression: %s", file, h.Match, err)
+		}
+	}
+	// a team's own hints are more specific, so they come first
+	hints = append(extra, hints...)
+	return nil
+}
+
+// hintsFor returns hint lines for anything in output that matches a hint
+func hintsFor(output string) string {
+	return matchingHints(output, false)
+}
+
+// lrtHintsFor returns hint lines for one of lrt's own errors
+func lrtHintsFor(err error) string {
+	return matchingHints(err.Error(), true)
+}
+
+func matchingHints(output string, lrt bool) string {
+	result := ""
+	for _, h := range hints {
+		if h.lrt != lrt {
+			continue
+		}
+		match := h.re.FindStringSubmatchIndex(output)
+		if match == nil {
+			continue
+		}
+		text := h.Hint
+		if lrt {
+			text = string(h.re.ExpandString(nil, text, output, match))
+		}
+		result += "     hint: " + strings.Replace(text, "\n", "\n           ", -1) + "\n"
+	}
+	return result
+}
+
+// mustLoadHints loads -hints, or .lrt-hints.json if it exists
+func mustLoadHints() {
+	file := *hintsFlag
+	if file == "" {
+		if _, err := os.Stat(".lrt-hints.json"); err != nil {
+			return
+		}
+		file = ".lrt-hints.json"
+	}
+	if err := loadHints(file); err != nil {
+		fmt.Printf("lrt: -hints is invalid: %s. See lrt --help for details\n", err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// historyEntry is a line in the -history file
+type historyEntry struct {
+	Time     time.Time `json:"time"`
+	Package  string    `json:"package"`
+	Trigger  []string  `json:"trigger,omitempty"`
+	Duration int64     `json:"duration_ms"`
+	Success  bool      `json:"success"`
+	Size     int64     `json:"size,omitempty"`
+}
+
+// The history file is trimmed to the most recent historyLimit builds once it
+// grows past historyMaxSize, so that it doesn't grow forever
+var (
+	historyLimit   = 10000
+	historyMaxSize = int64(4 << 20)
+)
+
+// historyFile is where builds are recorded, or "" if they shouldn't be
+func historyFile() string {
+	if *historyFlag == "none" {
+		return ""
+	}
+	if *historyFlag != "" {
+		return *historyFlag
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "lrt", "history.jsonl")
+}
+
+// historyPackage identifies a package in the history file: relative paths are
+// made absolute, so that builds of the same package from different directories
+// are grouped together.
+func historyPackage(name string) string {
+	if strings.HasPrefix(name, ".") {
+		if abs, err := filepath.Abs(name); err == nil {
+			return abs
+		}
+	}
+	return name
+}
+
+// recordBuild appends a build to the history file. Failing to do so isn't
+// worth interrupting anyone for, so errors are ignored.
+func recordBuild(trigger []string, duration time.Duration, success bool) {
+	file := historyFile()
+	if file == "" {
+		return
+	}
+
+	entry := historyEntry{Time: time.Now(), Package: historyPackage(packageName), Trigger: trigger, Duration: duration.Milliseconds(), Success: success}
+	if success {
+		if info, err := os.Stat(tmpFile.Name()); err == nil {
+			entry.Size = info.Size()
+		}
+	}
+
+	os.MkdirAll(filepath.Dir(file), 0755)
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	line, _ := json.Marshal(entry)
+	f.Write(append(line, '\n'))
+	info, err := f.Stat()
+	f.Close()
+	if err == nil && info.Size() > historyMaxSize {
+		trimHistory(file)
+	}
+}
+
+// trimHistory removes all but the last historyLimit builds from the history
+// file. The rest are written to a new file that replaces it, so that lrt stats
+// never sees a partly written file.
+func trimHistory(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > historyLimit {
+		lines = lines[len(lines)-historyLimit:]
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bytes.Join(lines, nil))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// readHistory reads the builds recorded in the history file since the given time
+func readHistory(file string, since time.Time) ([]historyEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []historyEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry historyEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if entry.Time.After(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// summarizeHistory describes how many builds there were and how long they took
+func summarizeHistory(entries []historyEntry) string {
+	if len(entries) == 0 {
+		return "no builds"
+	}
+
+	failed := 0
+	durations := []int64{}
+	total := int64(0)
+	for _, e := range entries {
+		if !e.Success {
+			failed++
+		}
+		durations = append(durations, e.Duration)
+		total += e.Duration
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	percentile := func(p int) time.Duration {
+		return time.Duration(durations[(len(durations)-1)*p/100]) * time.Millisecond
+	}
+
+	builds := "builds"
+	if len(entries) == 1 {
+		builds = "build"
+	}
+	return fmt.Sprintf("%d %s (%d failed), median %s, p90 %s, %s in total",
+		len(entries), builds, failed, percentile(50), percentile(90), time.Duration(total)*time.Millisecond)
+}
+
+// printStats implements lrt stats, which summarizes the builds recorded in
+// the history file.
+func printStats(args []string) {
+	statsFlags := flag.NewFlagSet("lrt stats", flag.ExitOnError)
+	packageFlag := statsFlags.String("package", "", "only include builds of this package")
+	// this is shared with the main command
+	f := flag.Lookup("history")
+	statsFlags.Var(f.Value, f.Name, f.Usage)
+	statsFlags.Usage = func() {
+		fmt.Print(`Usage: lrt stats [options]
+
+lrt stats summarizes how many times lrt has rebuilt your services over the past
+day and week, and how long those builds took.
+
+options:
+`)
+		statsFlags.PrintDefaults()
+		os.Exit(2)
+	}
+	statsFlags.Parse(args)
+
+	file := historyFile()
+	if file == "" {
+		fmt.Println("lrt: build history is turned off (-history=none)")
+		os.Exit(1)
+	}
+	entries, err := readHistory(file, time.Now().Add(-7*24*time.Hour))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+
+	pkg := historyPackage(*packageFlag)
+	day, week := []historyEntry{}, []historyEntry{}
+	triggers := map[string]int{}
+	for _, e := range entries {
+		if pkg != "" && e.Package != pkg {
+			continue
+		}
+		week = append(week, e)
+		if e.Time.After(time.Now().Add(-24 * time.Hour)) {
+			day = append(day, e)
+		}
+		for _, t := range e.Trigger {
+			triggers[t]++
+		}
+	}
+
+	fmt.Printf("past day:  %s\n", summarizeHistory(day))
+	fmt.Printf("past week: %s\n", summarizeHistory(week))
+
+	files := []string{}
+	for t := range triggers {
+		files = append(files, t)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if triggers[files[i]] != triggers[files[j]] {
+			return triggers[files[i]] > triggers[files[j]]
+		}
+		return files[i] < files[j]
+	})
+	if len(files) > 5 {
+		files = files[:5]
+	}
+	if len(files) > 0 {
+		fmt.Printf("most changed files:\n")
+		for _, f := range files {
+			fmt.Printf("  %4d  %s\n", triggers[f], f)
+		}
+	}
+}
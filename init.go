@@ -0,0 +1,306 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	shellwords "github.com/mattn/go-shellwords"
+	"github.com/sirkon/goproxy/gomod"
+)
+
+// healthPaths are the paths lrt init looks for in your service, to use as
+// its health check
+var healthPaths = []string{"/healthz", "/health", "/livez", "/readyz", "/ping", "/status"}
+
+// runInit implements lrt init, which writes a starting configFile for the
+// package in the current directory.
+func runInit(args []string) {
+	initFlags := flag.NewFlagSet("lrt init", flag.ExitOnError)
+	forceFlag := initFlags.Bool("force", false, "overwrite "+configFile+" if it already exists")
+	// this is shared with the main command
+	f := flag.Lookup("go")
+	initFlags.Var(f.Value, f.Name, f.Usage)
+	initFlags.Usage = func() {
+		fmt.Print(`Usage: lrt init [options]
+
+lrt init looks at the go module in the current directory (its main packages,
+and any Procfile or docker-compose.yml) and writes a ` + configFile + ` for lrt to
+use, which you can then edit.
+
+options:
+`)
+		initFlags.PrintDefaults()
+		os.Exit(2)
+	}
+	initFlags.Parse(args)
+
+	if _, err := os.Stat(configFile); err == nil && !*forceFlag {
+		fmt.Fprintf(os.Stderr, "lrt: %s already exists\n", configFile)
+		fmt.Fprintf(os.Stderr, "     hint: use lrt init -force to replace it\n")
+		os.Exit(1)
+	}
+
+	contents := initConfig()
+	if err := ioutil.WriteFile(configFile, []byte(contents), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("lrt: wrote %s, run lrt to start your service\n", configFile)
+}
+
+// initConfig works out the contents of configFile for the current directory
+func initConfig() string {
+	module := ""
+	if output, err := exec.Command(*goFlag, "env", "GOMOD").Output(); err == nil {
+		file := strings.TrimSpace(string(output))
+		if contents, err := ioutil.ReadFile(file); err == nil {
+			if parsed, err := gomod.Parse(file, contents); err == nil {
+				module = parsed.Name
+			}
+		}
+	}
+
+	mains := mainPackages()
+	procfileArgs := []string{}
+	pkg := ""
+	if web := procfileCommand(); web != nil {
+		pkg, procfileArgs = procfilePackage(web, mains)
+	}
+	if pkg == "" {
+		pkg = pickMainPackage(mains)
+	}
+
+	var b strings.Builder
+	if module != "" {
+		fmt.Fprintf(&b, "# lrt options for %s, written by lrt init.\n", module)
+	} else {
+		fmt.Fprintf(&b, "# lrt options, written by lrt init.\n")
+	}
+	fmt.Fprintf(&b, "# Each one is an option from lrt --help (without the -). Options given on\n")
+	fmt.Fprintf(&b, "# the command line take precedence.\n\n")
+
+	fmt.Fprintf(&b, "# the main package to build and run\n")
+	var others []string
+	for _, m := range mains {
+		if m != pkg {
+			others = append(others, m)
+		}
+	}
+	if len(others) > 0 {
+		fmt.Fprintf(&b, "# (other main packages: %s)\n", strings.Join(others, ", "))
+	}
+	fmt.Fprintf(&b, "package: %s\n\n", configQuote(pkg))
+
+	fmt.Fprintf(&b, "# where lrt listens; your service is given a $PORT to listen on\n")
+	fmt.Fprintf(&b, "listen: localhost:3000\n\n")
+
+	if len(procfileArgs) > 0 {
+		quoted := make([]string, len(procfileArgs))
+		for i, arg := range procfileArgs {
+			quoted[i] = arg
+			if arg == "" || strings.ContainsAny(arg, " \t'\"\\$`") {
+				quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+			}
+		}
+		cmdArgs := strings.Join(quoted, " ")
+		if strings.Contains(cmdArgs, "$") {
+			fmt.Fprintf(&b, "# your Procfile passes %s, but lrt doesn't expand environment variables\n", cmdArgs)
+			fmt.Fprintf(&b, "# cmd-args: %s\n\n", configQuote(cmdArgs))
+		} else {
+			fmt.Fprintf(&b, "# flags for your service, from your Procfile\n")
+			fmt.Fprintf(&b, "cmd-args: %s\n\n", configQuote(cmdArgs))
+		}
+	}
+
+	if path := findHealthPath(pkg); path != "" {
+		fmt.Fprintf(&b, "# lrt waits for this to respond with a 2xx before sending requests to a new build\n")
+		fmt.Fprintf(&b, "health-check: %s\n\n", path)
+	} else {
+		fmt.Fprintf(&b, "# lrt waits for this to respond with a 2xx before sending requests to a new build,\n")
+		fmt.Fprintf(&b, "# use a path that responds quickly once your service is ready (or \"tcp\")\n")
+		fmt.Fprintf(&b, "health-check: /\n\n")
+	}
+
+	fmt.Fprintf(&b, "# load .env and .env.local into your service's environment\n")
+	if _, err := os.Stat(".env"); err == nil {
+		fmt.Fprintf(&b, "dotenv: true\n\n")
+	} else {
+		fmt.Fprintf(&b, "# dotenv: true\n\n")
+	}
+
+	fmt.Fprintf(&b, "# how long to wait for file changes to settle before rebuilding\n")
+	fmt.Fprintf(&b, "debounce: 100ms\n\n")
+
+	fmt.Fprintf(&b, "# extra flags for go build\n")
+	fmt.Fprintf(&b, "# build-args: -tags dev\n\n")
+
+	fmt.Fprintf(&b, "# send your service SIGHUP instead of rebuilding it when these change\n")
+	fmt.Fprintf(&b, "# reload:\n#   - \"config/*.yaml\"\n")
+
+	if services := composeServices(); len(services) > 0 {
+		fmt.Fprintf(&b, "\n# docker compose services to start before your service (and stop when lrt\n")
+		fmt.Fprintf(&b, "# exits), uncomment the ones it needs\n")
+		fmt.Fprintf(&b, "# compose:\n")
+		for _, service := range services {
+			fmt.Fprintf(&b, "#   - %s\n", service)
+		}
+	}
+	return b.String()
+}
+
+// mainPackages lists the main packages in the module, relative to the
+// current directory
+func mainPackages() []string {
+	output, err := exec.Command(*goFlag, "list", "-f", `{{if eq .Name "main"}}{{.Dir}}{{end}}`, "./...").Output()
+	if err != nil {
+		return nil
+	}
+	cwd, _ := os.Getwd()
+	var mains []string
+	for _, dir := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if dir == "" {
+			continue
+		}
+		rel, err := filepath.Rel(cwd, dir)
+		if err != nil {
+			continue
+		}
+		if rel == "." {
+			mains = append(mains, ".")
+		} else {
+			mains = append(mains, "./"+filepath.ToSlash(rel))
+		}
+	}
+	return mains
+}
+
+// pickMainPackage picks the main package most likely to be the service:
+// the current directory, or the only one, or one with a name like server.
+func pickMainPackage(mains []string) string {
+	if len(mains) == 0 {
+		return "."
+	}
+	for _, m := range mains {
+		if m == "." {
+			return m
+		}
+	}
+	for _, name := range []string{"server", "api", "web", "app"} {
+		for _, m := range mains {
+			if filepath.Base(m) == name {
+				return m
+			}
+		}
+	}
+	return mains[0]
+}
+
+// procfileCommand returns the web command from the Procfile, if there is one
+func procfileCommand() []string {
+	contents, err := ioutil.ReadFile("Procfile")
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if !strings.HasPrefix(line, "web:") {
+			continue
+		}
+		args, err := shellwords.Parse(strings.TrimPrefix(line, "web:"))
+		if err != nil {
+			return nil
+		}
+		return args
+	}
+	return nil
+}
+
+// procfilePackage works out which of the main packages the Procfile's web
+// command runs (from go run ./pkg, or a binary named after it), and the flags
+// it is run with
+func procfilePackage(web []string, mains []string) (string, []string) {
+	if len(web) >= 3 && web[0] == "go" && web[1] == "run" {
+		for i, arg := range web[2:] {
+			if !strings.HasPrefix(arg, "-") {
+				return arg, web[3+i:]
+			}
+		}
+		return "", nil
+	}
+	if len(web) == 0 {
+		return "", nil
+	}
+	name := filepath.Base(web[0])
+	cwd, _ := os.Getwd()
+	for _, m := range mains {
+		if filepath.Base(m) == name || (m == "." && name == filepath.Base(cwd)) {
+			return m, web[1:]
+		}
+	}
+	return "", nil
+}
+
+// findHealthPath looks through pkg's source for a handler for one of
+// healthPaths
+func findHealthPath(pkg string) string {
+	files, _ := filepath.Glob(filepath.Join(pkg, "*.go"))
+	var source strings.Builder
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		contents, _ := ioutil.ReadFile(file)
+		source.Write(contents)
+	}
+	for _, path := range healthPaths {
+		if strings.Contains(source.String(), strconv.Quote(path)) {
+			return path
+		}
+	}
+	return ""
+}
+
+// composeServices lists the services in docker-compose.yml (or compose.yaml)
+func composeServices() []string {
+	var contents []byte
+	for _, name := range []string{"compose.yaml", "compose.yml", "docker-compose.yml", "docker-compose.yaml"} {
+		var err error
+		if contents, err = ioutil.ReadFile(name); err == nil {
+			break
+		}
+	}
+	if contents == nil {
+		return nil
+	}
+
+	var services []string
+	inServices := false
+	service := regexp.MustCompile(`^  ([A-Za-z0-9_.-]+):\s*$`)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(line, "services:") {
+			inServices = true
+			continue
+		}
+		if line != "" && line[0] != ' ' && line[0] != '#' {
+			inServices = false
+		}
+		if m := service.FindStringSubmatch(line); inServices && m != nil {
+			services = append(services, m[1])
+		}
+	}
+	return services
+}
+
+// configQuote quotes a value for configFile if it needs it
+func configQuote(s string) string {
+	if s == "" || strings.ContainsAny(s, "#\"'") || strings.TrimSpace(s) != s || strings.HasPrefix(s, "-") {
+		return strconv.Quote(s)
+	}
+	return s
+}
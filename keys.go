@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+)
+
+const keysHelp = `lrt: keyboard shortcuts:
+     r  restart the service
+     b  rebuild the service
+     u  roll back to the previous build (press again to undo)
+     p  pause (or resume) rebuilding when files change
+     w  list the directories being watched
+     c  clear the screen
+     q  quit
+`
+
+// handleKeys reads single key presses from the terminal (if there is one)
+// and acts on them.
+func handleKeys() {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return
+	}
+
+	// read key presses immediately, without waiting for enter or echoing
+	// them. ctrl-c still sends SIGINT.
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		output, err := cmd.Output()
+		return strings.TrimSpace(string(output)), err
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return
+	}
+	atExit(func() { stty(saved) })
+
+	infof("lrt: press h for keyboard shortcuts\n")
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				return
+			}
+			handleKey(buf[0])
+		}
+	}()
+}
+
+func handleKey(key byte) {
+	switch key {
+	case 'r':
+		go func() {
+			if err := restartService(); err != nil {
+				fmt.Fprintln(stderr, "lrt: "+err.Error())
+			}
+		}()
+	case 'b':
+		go rebuild()
+	case 'u':
+		go func() {
+			if err := rollback(0); err != nil {
+				fmt.Fprintln(stderr, "lrt: "+err.Error())
+			}
+		}()
+	case 'p':
+		if atomic.LoadInt32(&paused) == 1 {
+			resumeWatching()
+		} else {
+			pauseWatching()
+		}
+	case 'w':
+		printWatchSet(stdout)
+	case 'c':
+		clearScreen()
+	case 'q':
+		go shutdown()
+	case 'h', '?':
+		fmt.Fprint(stdout, keysHelp)
+	}
+}
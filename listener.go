@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// activatedListeners are the sockets systemd passed to lrt, if it was started
+// by socket activation
+var activatedListeners []net.Listener
+
+// inheritListeners returns the sockets passed in $LISTEN_FDS by systemd (see
+// sd_listen_fds(3)), which lrt listens on instead of -listen. This lets a
+// user unit start lrt on the first request to its port.
+func inheritListeners() ([]net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || count <= 0 {
+		return nil, nil
+	}
+	// they are lrt's, not the service's
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := 3; fd < 3+count; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("could not use socket %d from systemd: %s", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenerURL is the URL lrt can be reached at through a listener
+func listenerURL(listener net.Listener) *url.URL {
+	if listener.Addr().Network() == "unix" {
+		return &url.URL{Scheme: "unix", Path: listener.Addr().String()}
+	}
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+// listen opens a listener for lrt's proxy for each -listen, either on a TCP
+// host:port, or on a unix socket if it was given as unix:/path/to.sock.
+func listen() ([]net.Listener, error) {
+	if len(activatedListeners) > 0 {
+		return activatedListeners, nil
+	}
+	var listeners []net.Listener
+	for _, u := range listenURLs {
+		var listener net.Listener
+		var err error
+		if u.Scheme != "unix" {
+			listener, err = net.Listen("tcp", u.Host)
+			for tries := 0; errors.Is(err, syscall.EADDRINUSE) && tries < *listenFallbackFlag; tries++ {
+				nextListenPort(u)
+				listener, err = net.Listen("tcp", u.Host)
+			}
+		} else {
+			listener, err = listenUnix(u.Path)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// nextListenPort moves u to the next port, for -listen-fallback
+func nextListenPort(u *url.URL) {
+	port, _ := strconv.Atoi(u.Port())
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port+1))
+}
+
+// warnAboutListeners warns about each -listen address that had to move to
+// another port because of -listen-fallback, and each that other machines can
+// reach, saying how to reach it from them.
+func warnAboutListeners() {
+	for i, u := range listenURLs {
+		if u.Scheme == "unix" {
+			continue
+		}
+		if u.Host != requestedListenHosts[i] {
+			moved := u.String()
+			if useColor() {
+				moved = "\033[1m" + moved + "\033[0m"
+			}
+			fmt.Fprintf(stderr, "lrt: warning: %s is in use, so lrt is listening on %s instead\n", requestedListenHosts[i], moved)
+		}
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			continue
+		}
+		reachable := u.String()
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			if lan := lanAddress(); lan != "" {
+				reachable = u.Scheme + "://" + net.JoinHostPort(lan, u.Port())
+			}
+		}
+		fmt.Fprintf(stderr, "lrt: warning: %s is reachable from other machines on your network (e.g. %s)\n", u.Host, reachable)
+		if *basicAuthFlag == "" {
+			fmt.Fprintf(stderr, "     hint: use -basic-auth to require a password\n")
+		}
+	}
+}
+
+// lanAddress returns this machine's first non-loopback IPv4 address, if it has one
+func lanAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+	}
+	return ""
+}
+
+// listenUnix listens on the unix socket at path, and removes it on exit.
+func listenUnix(path string) (net.Listener, error) {
+	// a socket left behind by a previous lrt would stop us listening, but we
+	// don't want to remove one that's still in use (or something that isn't a socket).
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: bind: address already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	atExit(func() { os.Remove(path) })
+	return listener, nil
+}
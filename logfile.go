@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// logFile is set by -log-file, and receives every line that is added to
+// serviceLogs (both the service's output and lrt's own)
+var logFile *rotatingFile
+
+// rotatingFile appends lines to a file, and once it grows beyond maxSize
+// renames it to path.1 (moving path.1 to path.2, and so on) and starts a new
+// one, keeping at most keep old files.
+type rotatingFile struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+// writeLine writes a line of output from source, with the time it was
+// printed, so the file can be grepped later.
+func (r *rotatingFile) writeLine(t time.Time, source string, text string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	line := fmt.Sprintf("%s [%s] %s\n", t.Format("2006-01-02 15:04:05.000"), source, text)
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "lrt: warning: could not rotate -log-file: %s\n", err)
+		}
+	}
+	if r.file == nil && r.open() != nil {
+		// rotating failed, and the file can't be reopened
+		return
+	}
+	n, _ := r.file.WriteString(line)
+	r.size += int64(n)
+}
+
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+	os.Remove(r.path + "." + strconv.Itoa(r.keep))
+	for i := r.keep - 1; i > 0; i-- {
+		os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+	}
+	if r.keep > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logLine is a line printed by the service
+type logLine struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Build  int32     `json:"build"`
+	Text   string    `json:"text"`
+}
+
+// serviceLogs keeps the service's recent output, to serve at /__lrt/logs
+var serviceLogs = &logBuffer{}
+
+// logBuffer keeps the last -log-buffer lines of output
+type logBuffer struct {
+	lock        sync.Mutex
+	lines       []logLine
+	nextID      int64
+	subscribers map[chan logLine]bool
+}
+
+func (b *logBuffer) add(source string, text string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.nextID++
+	line := logLine{ID: b.nextID, Time: time.Now(), Source: source, Build: atomic.LoadInt32(&buildNumber), Text: text}
+	if logFile != nil {
+		logFile.writeLine(line.Time, source, text)
+	}
+	b.lines = append(b.lines, line)
+	if len(b.lines) > *logBufferFlag {
+		b.lines = b.lines[len(b.lines)-*logBufferFlag:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- line:
+		default:
+			// the subscriber is too slow to keep up, it will miss this line
+		}
+	}
+}
+
+// subscribe returns a channel that receives each line as it is logged
+func (b *logBuffer) subscribe() chan logLine {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = map[chan logLine]bool{}
+	}
+	ch := make(chan logLine, 100)
+	b.subscribers[ch] = true
+	return ch
+}
+
+func (b *logBuffer) unsubscribe(ch chan logLine) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subscribers, ch)
+}
+
+// since returns the lines logged after the given id or time
+func (b *logBuffer) since(id int64, t time.Time) []logLine {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	result := []logLine{}
+	for _, line := range b.lines {
+		if line.ID > id && !line.Time.Before(t) {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// parseSince parses the ?since= parameter, which can be a duration (5m),
+// a time (2006-01-02T15:04:05Z) or the id of the last line seen.
+func parseSince(r *http.Request) (id int64, t time.Time, err error) {
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		return 0, t, nil
+	}
+	if n, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return n, t, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return 0, time.Now().Add(-d), nil
+	}
+	if t, err = time.Parse(time.RFC3339, since); err != nil {
+		return 0, t, fmt.Errorf("lrt: since=%q should be a duration, a time or a line id", since)
+	}
+	return 0, t, nil
+}
+
+// serveLogs responds with the recent output of the service (and lrt).
+// ?since= limits this to recent lines, and ?format=json returns each line
+// with its metadata.
+func serveLogs(w http.ResponseWriter, r *http.Request) {
+	id, t, err := parseSince(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lines := serviceLogs.since(id, t)
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lines)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range lines {
+		fmt.Fprintln(w, line.Text)
+	}
+}
+
+// streamLogs streams lines from the service (and lrt) as server-sent events
+// as they are logged. Each event is a logLine encoded as JSON. If ?since= is
+// given (or the client reconnects with Last-Event-ID) earlier lines are sent
+// first.
+func streamLogs(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("since") == "" && r.Header.Get("Last-Event-ID") != "" {
+		r.URL.RawQuery = "since=" + url.QueryEscape(r.Header.Get("Last-Event-ID"))
+	}
+	id, t, err := parseSince(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := serviceLogs.subscribe()
+	defer serviceLogs.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(line logLine) {
+		data, _ := json.Marshal(line)
+		fmt.Fprintf(w, "id: %d\ndata: %s\n\n", line.ID, data)
+		id = line.ID
+	}
+	if !t.IsZero() || id > 0 {
+		for _, line := range serviceLogs.since(id, t) {
+			send(line)
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line := <-ch:
+			// skip lines that were already sent from the buffer
+			if line.ID > id {
+				send(line)
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -16,22 +16,24 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"go/build"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"runtime"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -42,90 +44,371 @@ import (
 
 // raw arguments
 var (
-	listenFlag      = flag.String("listen", "localhost:3000", "where lrt should listen")
-	serviceFlag     = flag.String("service", "", "where your service listens (if it does not listen on $PORT)")
-	serviceNameFlag = flag.String("service-name", "", "If you provider a service name, it will be used on the temp file.\nIt makes easy to find the correct process if you are running more than one lrt service.")
-	buildArgsFlag   = flag.String("build-args", "", "extra flags to pass to go build")
-	cmdArgsFlag     = flag.String("cmd-args", "", "extra flags to pass to the service executable")
-	healthCheckFlag = flag.String("health-check", "/", "the path lrt pings to check your service has started")
-	timeoutFlag     = flag.Duration("health-check-timeout", 10*time.Second, "how long to wait for the service to boot before assuming it has errored")
+	serviceSchemeFlag  = flag.String("service-scheme", "http", "set to https if your service serves HTTPS (its certificate is not verified)")
+	tlsFlag            = flag.Bool("tls", false, "serve HTTPS, using a certificate from mkcert if it is installed")
+	tlsCertFlag        = flag.String("tls-cert", "", "the certificate to use with -tls (defaults to generating one)")
+	tlsKeyFlag         = flag.String("tls-key", "", "the private key to use with -tls")
+	flushFlag          = flag.Duration("flush-interval", 0, "how often to flush proxied responses to the client (0 flushes after every write)")
+	proxyDialFlag      = flag.Duration("proxy-dial-timeout", 30*time.Second, "how long to wait when connecting to your service")
+	proxyHeaderFlag    = flag.Duration("proxy-header-timeout", 0, "how long to wait for your service to start responding to a request (0 waits forever)")
+	proxyIdleFlag      = flag.Duration("proxy-idle-timeout", 90*time.Second, "how long to keep idle connections to your service open")
+	proxyTimeoutFlag   = flag.Duration("proxy-timeout", 0, "the longest a proxied request may take in total, including streaming the response (0 for no limit)")
+	forwardedFlag      = flag.Bool("forwarded-headers", false, "set X-Forwarded-Proto, X-Forwarded-Host and X-Real-IP on requests to your service")
+	hostHeaderFlag     = flag.String("host-header", "preserve", "the Host header to send to your service: \"preserve\" the client's, use the \"service\" address, or any other value")
+	hostRewriteFlag    = stringsVar("host-rewrite", "change the Host header sent to your service from one host to another, e.g. *.myapp.localhost=*.myapp.com for every subdomain (may be repeated)")
+	corsFlag           = flag.Bool("cors", false, "add CORS headers to responses and answer preflight requests, so a frontend on another origin can call your service")
+	corsOriginFlag     = stringsVar("cors-origin", "an origin allowed by -cors, with credentials (may be repeated, defaults to any origin without credentials)")
+	basicAuthFlag      = flag.String("basic-auth", "", "require a username:password to access lrt (useful with -listen 0.0.0.0:3000)")
+	accessLogFlag      = flag.String("access-log", "", "log each request in the given format: short, common, combined or json")
+	captureFlag        = flag.Int("capture", 0, "keep the last N requests and responses, to view at /__lrt/requests or download as a HAR file")
+	captureBodyFlag    = flag.Int("capture-body-limit", 64*1024, "the most bytes of each request and response body to keep with -capture")
+	latencyFlag        = flag.Duration("inject-latency", 0, "delay every request by this long, to test how clients handle a slow service")
+	errorRateFlag      = flag.Float64("inject-error-rate", 0, "fail this fraction of requests (0-1) with a 503, to test how clients handle errors")
+	serveStaleFlag     = flag.Bool("serve-stale", false, "while rebuilding, respond to GET requests with the last successful response for that URL")
+	maxQueueWaitFlag   = flag.Duration("max-queue-wait", 0, "how long requests may wait for a rebuild before lrt responds with a 503 (0 waits forever)")
+	maxQueueFlag       = flag.Int("max-queue", 0, "how many requests may wait for a rebuild at once before lrt responds with a 503 (0 for no limit)")
+	retryFlag          = flag.Bool("retry", true, "if a GET or HEAD request can't reach your service (e.g. it has exited) wait for it to restart and try again")
+	drainFlag          = flag.Duration("drain", 0, "how long to let running requests finish before restarting your service (0 waits for them all)")
+	stopSignalFlag     = flag.String("stop-signal", "TERM", "the signal to send your service to stop it (e.g. INT or QUIT)")
+	stopTimeoutFlag    = flag.Duration("stop-timeout", 10*time.Second, "how long to wait for your service to exit before sending SIGKILL")
+	restartFlag        = flag.String("restart", "never", "whether to restart your service if it exits: never, on-failure or always")
+	errorLinesFlag     = flag.Int("error-lines", 30, "how many lines of your service's output to include when showing why it failed to start")
+	logBufferFlag      = flag.Int("log-buffer", 1000, "how many lines of your service's output to keep, to view at /__lrt/logs")
+	logLevelFlag       = flag.String("log-level", "info", "how much lrt says about what it is doing: error, info or debug")
+	quietFlag          = flag.Bool("quiet", false, "only print errors and your service's output (the same as -log-level error)")
+	verboseFlag        = flag.Bool("verbose", false, "also print which directories lrt watches, why it waits before rebuilding, and each health check (the same as -log-level debug)")
+	logFileFlag        = flag.String("log-file", "", "also write lrt's and your service's output to this file, with the time and source of each line")
+	logFileSizeFlag    = flag.Int("log-file-size", 10, "the size in MB at which -log-file is rotated (0 to never rotate it)")
+	logFileKeepFlag    = flag.Int("log-file-keep", 3, "how many rotated -log-file files (file.1, file.2, ...) to keep")
+	jsonFlag           = flag.Bool("json", false, "write events (like build-started and service-healthy) to stdout as JSON lines")
+	eventsSocketFlag   = flag.String("events-socket", "", "stream events as JSON lines to anyone who connects to this unix socket")
+	controlSocketFlag  = flag.String("control-socket", "", "serve an HTTP API on this unix socket to rebuild, restart, pause or check on your service")
+	keysFlag           = flag.Bool("keys", true, "when run in a terminal, use keyboard shortcuts (press h to list them)")
+	clearFlag          = flag.Bool("clear", false, "clear the terminal each time your service is rebuilt")
+	timestampsFlag     = flag.Bool("timestamps", false, "prefix each line your service prints with the time")
+	tagFlag            = flag.String("tag", "", "prefix each line your service prints with this tag, e.g. \"api\"")
+	colorFlag          = flag.String("color", "auto", "whether to color -timestamps and -tag prefixes: auto, always or never")
+	stdinFlag          = flag.Bool("stdin", false, "forward what you type into lrt to your service (instead of using keyboard shortcuts)")
+	forwardSignalFlag  = stringsVar("forward-signal", "forward this signal to your service, e.g. USR1 or HUP=USR2 (default USR1, USR2 and HUP)")
+	reloadFlag         = stringsVar("reload", "send -reload-signal to your service instead of rebuilding it when a file matching this pattern changes, e.g. \"config/*.yaml\"")
+	browserReloadFlag  = stringsVar("browser-reload", "reload the page in your browser, without rebuilding or restarting your service, when a file matching this pattern changes, e.g. \"templates/*.tmpl\"")
+	reloadSignalFlag   = flag.String("reload-signal", "HUP", "the signal to send your service when a -reload file changes")
+	dotenvFlag         = flag.Bool("dotenv", false, "load .env and .env.local into your service's environment, and restart it when they change (lrt init turns this on if you have a .env)")
+	envFlag            = stringsVar("env", "set an environment variable for your service, e.g. -env DEBUG=1")
+	envFileFlag        = stringsVar("env-file", "load environment variables for your service from this file, and restart it when it changes")
+	execFlag           = flag.String("exec", "", "run your service under this command, e.g. \"nice -n 19\" or \"rr record\"")
+	debugFlag          = flag.Bool("debug", false, "build your service without optimizations and run it under delve, so you can attach a debugger")
+	debugListenFlag    = flag.String("debug-listen", "localhost:2345", "where delve should listen when using -debug")
+	pprofFlag          = flag.String("pprof", "/debug/pprof/", "where your service serves net/http/pprof, either a path or host:port[/path]; lrt forwards /__lrt/pprof/ to it")
+	historyFlag        = flag.String("history", "", "record each build to this file, for lrt stats (default in your user cache directory, or \"none\")")
+	notifyFlag         = flag.Bool("notify", false, "show a desktop notification when the build fails, and when it is fixed")
+	webhookFlag        = flag.String("webhook", "", "post to this URL when the build fails, and when it is fixed (compatible with Slack's incoming webhooks)")
+	quickfixFlag       = flag.String("quickfix", "", "write build errors to this file in quickfix format (file:line:col: message) for your editor, or - for stdout")
+	editorFlag         = flag.String("editor", "vscode", "the editor that file:line links on error pages open: vscode, cursor, idea, goland, sublime, textmate, or a URL with {file}, {line} and {col} in it")
+	hintsFlag          = flag.String("hints", "", "a JSON file of extra hints to show when your service fails to build or boot (default .lrt-hints.json, if it exists)")
+	keepLastGoodFlag   = flag.Bool("keep-last-good", false, "if a rebuild fails, keep the last good build running (with a Warning header on responses) instead of responding with the error")
+	keepBuildsFlag     = flag.Int("keep-builds", 1, "how many previous builds to keep, to roll back to")
+	warmupFlag         = flag.Int("warmup", 0, "remember this many recent GET requests, and replay them each time your service restarts before sending it new requests")
+	warmupPathFlag     = flag.String("warmup-path", "", "a regular expression: with -warmup, only replay requests whose path matches it")
+	replicasFlag       = flag.Int("replicas", 1, "run this many copies of your service, each on its own $PORT, and send requests to each in turn (to find state that isn't shared between them)")
+	shadowFlag         = flag.Duration("shadow", 0, "after a rebuild, run the new build alongside the old one for this long, mirroring GET requests to it and logging any differences in its responses, before switching over")
+	pidFileFlag        = flag.String("pid-file", "", "write lrt's pid to this file, and refuse to start if another lrt is using it (default one per -listen address in the temp directory, or \"none\")")
+	listenFlag         = defaultStringsVar("listen", "localhost:3000", "where lrt should listen, either host:port or unix:/path/to.sock (may be repeated, e.g. to also listen on 0.0.0.0:3001 for other devices)")
+	listenFallbackFlag = flag.Int("listen-fallback", 0, "if a -listen port is in use, try up to this many ports after it instead of exiting")
+	staticFlag         = stringsVar("static", "serve the files in a directory at a path directly, without waiting for your service, e.g. /assets=./public (may be repeated)")
+	routeFlag          = stringsVar("route", "send requests for this host (or *.host for its subdomains) to another package, run by its own lrt, or to an address, e.g. api.localhost=./cmd/api or admin.localhost=localhost:8080 (may be repeated)")
+	serviceFlag        = flag.String("service", "", "where your service listens (if it does not listen on $PORT), or unix[:path] to have your service listen on the unix socket in $SOCKET")
+	serviceNameFlag    = flag.String("service-name", "", "If you provider a service name, it will be used on the temp file.\nIt makes easy to find the correct process if you are running more than one lrt service.")
+	buildArgsFlag      = flag.String("build-args", "", "extra flags to pass to go build")
+	cmdArgsFlag        = flag.String("cmd-args", "", "extra flags to pass to the service executable")
+	healthCheckFlag    = flag.String("health-check", "/", "the path lrt pings to check your service has started, \"tcp\" to wait for the service to accept connections, or \"grpc[:service]\" to use the gRPC health checking protocol")
+	healthMethodFlag   = flag.String("health-check-method", "GET", "the HTTP method to use for the health check")
+	healthHeaderFlag   = stringsVar("health-check-header", "an extra header to send with the health check, e.g. \"Authorization: Bearer dev\" (may be repeated)")
+	healthStatusFlag   = flag.String("health-check-status", "200-299", "the status codes that mean your service has started, e.g. \"200,204,300-399\"")
+	healthBodyFlag     = flag.String("health-check-body", "", "if set, the health check response must also contain this string")
+	healthCmdFlag      = flag.String("health-check-cmd", "", "a command to run to check your service has started, e.g. \"grpc_health_probe -addr=:$PORT\"")
+	healthDelayFlag    = flag.Duration("health-check-delay", 0, "how long to wait after starting the service before the first health check")
+	healthIntervalFlag = flag.Duration("health-check-interval", 50*time.Millisecond, "how long to wait between the first health checks (this doubles after each attempt)")
+	healthMaxWaitFlag  = flag.Duration("health-check-max-interval", time.Second, "the longest to wait between health checks")
+	noProxyFlag        = flag.Bool("no-proxy", false, "run a worker (or any program that doesn't serve HTTP): rebuild and restart it on change without listening for requests")
+	detectPortFlag     = flag.Bool("detect-port", false, "forward requests to whichever port your service actually listens on, even if it ignores $PORT")
+	readyPatternFlag   = flag.String("ready-log-pattern", "", "a regular expression that your service logs once it has started (replaces the health check)")
+	timeoutFlag        = flag.Duration("health-check-timeout", 10*time.Second, "how long to wait for the service to boot before assuming it has errored")
+	debounceFlag       = flag.Duration("debounce", 100*time.Millisecond, "how long to wait for file changes to settle before rebuilding")
+	debounceMaxFlag    = flag.Duration("debounce-max", 0, "the longest to delay a rebuild while file changes are still happening (0 waits for them to settle)")
+	goosFlag           = flag.String("goos", "", "build your service for this GOOS, e.g. linux (with -deploy)")
+	goarchFlag         = flag.String("goarch", "", "build your service for this GOARCH, e.g. arm64 (with -deploy)")
+	deployFlag         = flag.String("deploy", "", "a shell command that deploys each build ($BINARY) instead of running it, e.g. \"scp $BINARY pi@device: && ssh pi@device sudo systemctl restart app\"; use with -service device:port")
+	waitForFlag        = stringsVar("wait-for", "don't start your service until this is reachable, e.g. tcp://localhost:5432 or http://localhost:9200/_health (may be repeated)")
+	waitForTimeoutFlag = flag.Duration("wait-for-timeout", 30*time.Second, "how long to wait for -wait-for before showing an error (lrt keeps waiting, and starts your service once they are reachable)")
+	composeFlag        = stringsVar("compose", "a docker compose service your service needs (e.g. postgres), started before it and stopped when lrt exits (may be repeated)")
+	composeFileFlag    = flag.String("compose-file", "", "the compose file for -compose (default docker compose's, e.g. compose.yaml)")
+	composeTimeoutFlag = flag.Duration("compose-timeout", time.Minute, "how long to wait for -compose services to be healthy and accept connections")
+	portForwardFlag    = stringsVar("port-forward", "keep a kubectl port-forward open to something your service needs, e.g. svc/postgres=5432 or staging/svc/api=8081:80 (may be repeated)")
+	kubeContextFlag    = flag.String("kube-context", "", "the kubectl context to use for -port-forward (default the current one)")
+	remoteFlag         = flag.String("remote", "", "build and run your service on this host over ssh (host or host:dir), copying your code there with rsync on each change and forwarding its port back")
+	goFlag             = flag.String("go", "go", "the go command to build your service with (GOTOOLCHAIN is also respected)")
+	noSelfUpdateFlag   = flag.Bool("no-self-update", false, "don't reinstall lrt when the go version changes")
+	watchRootFlag      = flag.Bool("watch-root", false, "watch every directory in your module instead of running go list to find your package's dependencies first, so lrt starts sooner on huge projects")
+	watchIgnoreFlag    = stringsVar("watch-ignore", "with -watch-root, a directory not to watch, by name or path relative to your module, e.g. web/dist (may be repeated)")
+	warmBuildFlag      = flag.Bool("warm-build", true, "build your dependencies in the background while lrt starts up, so that the first build only has to wait for your code")
+	ramBuildFlag       = flag.Bool("ram-build", false, "build your service (and keep go build's temporary files) on a RAM-backed filesystem (/dev/shm), to save disk I/O on each rebuild on machines with slow disks or antivirus software that scans every file; go's build cache stays on disk")
+	dryRunFlag         = flag.Bool("dry-run", false, "print the options lrt would use, what it would watch, and the commands it would build and run your service with, without starting anything")
+	versionVarFlag     = flag.String("version-var", "", "a string variable (e.g. main.buildVersion) that lrt sets to <git sha>-<timestamp> on every build")
 )
 
 // parsed arguments, see mustParseArgs
 var (
-	packageName    string
-	listenURL      *url.URL
-	serviceURL     *url.URL
-	healthCheckURL *url.URL
+	packageName          string
+	packageDir           string     // where packageName (or the .go files) are
+	listenURL            *url.URL   // the first of listenURLs
+	listenURLs           []*url.URL // one for each -listen
+	requestedListenHosts []string   // the host:port of each -listen, before -listen-fallback
+	tlsConfig            *tls.Config
+	serviceURL           *url.URL
+	serviceSocket        string
+	healthCheckURL       *url.URL
+	healthCheckHeader    http.Header
+	healthCheckStatus    statusRanges
+	healthCheckCmd       []string
+	readyLogPattern      *regexp.Regexp
+	warmupPathPattern    *regexp.Regexp
+	stopSignal           syscall.Signal
+	reloadSignal         syscall.Signal
+	forwardSignals       map[os.Signal]syscall.Signal
 
 	buildArgs []string
 	cmdArgs   []string
+	execArgs  []string
 )
 
+// crashLoopLimit is how many times in a row the service can crash soon after
+// starting before lrt stops restarting it
+const crashLoopLimit = 5
+
 // internal state
 var (
 	proxyLock     sync.RWMutex
+	buildLock     sync.Mutex // held while rebuilding, restarting or rolling back
 	errorResponse []byte
 	builtOnce     bool
-
-	service *exec.Cmd
-	waiter  sync.WaitGroup
-	tmpFile *os.File
+	buildNumber   int32 // counts successful builds, accessed atomically
+	rebuilding    int32 // set while rebuilding, accessed atomically
+	restarting    int32 // set while restarting without rebuilding, accessed atomically
+	queued        int32 // requests waiting for the proxy, accessed atomically
+	lastBuildTime int64 // how long the last build took in ms, accessed atomically
+	buildFailed   bool
+
+	lastGoodWarning string // set when -keep-last-good is serving an old build
+	servingBuild    int32  // the build that is running, usually the latest
+
+	paused             int32 // set while watching is paused, accessed atomically
+	changedWhilePaused int32
+
+	service         *exec.Cmd
+	serviceStopCh   chan bool // closed when lrt stops the service
+	serviceExitedCh chan bool // closed when the service has exited
+	crashes         int       // how many times in a row the service has crashed soon after starting
+	waiter          sync.WaitGroup
+	tmpFile         *os.File
 
 	watcher    *fsnotify.Watcher
+	watchLock  sync.Mutex // held while changing watchedDir
 	watchedDir = map[string]bool{}
 
 	goModule    *gomod.Module
 	goModuleDir string
+
+	exitLock  sync.Mutex
+	exitHooks []func()
 )
 
 // main
 func main() {
+	mustLoadEnv()
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		runTestsOnChange(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		runCompletion(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		runInit(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		runDoctor(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		printStats(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "start" || os.Args[1] == "stop" || os.Args[1] == "status" || os.Args[1] == "logs") {
+		runDaemonCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	flag.Usage = usage
+	mustLoadConfig()
+	useSettingsAsDefaults()
+	flag.Parse()
+
 	rebuildIfNecessary()
+	figureOutToolchain()
 
 	mustParseArgs()
-	defer os.Remove(tmpFile.Name())
+	if *dryRunFlag {
+		printDryRun()
+		removeBuildOutput()
+		return
+	}
+	mustLockPidFile()
+	atExit(removeBuildOutput)
+	atExit(stopShadow)
 
 	figureOutModules()
+	if *remoteFlag != "" {
+		remoteHost, remoteDir = parseRemote(*remoteFlag, syncRoot())
+		mustCheckRemote()
+	} else if *warmBuildFlag {
+		startWarmBuild()
+	}
+
+	if *logFileFlag != "" {
+		f, err := openRotatingFile(*logFileFlag, int64(*logFileSizeFlag)*1024*1024, *logFileKeepFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+			exit(1)
+		}
+		logFile = f
+	}
+	if *jsonFlag {
+		// keep stdout for events
+		stdout.(*lineWriter).out = os.Stderr
+		serviceStdout = os.Stderr
+		writeEvents()
+	}
+	if *notifyFlag {
+		notifyOnBuildResult()
+	}
+	if *webhookFlag != "" {
+		postToWebhook(*webhookFlag)
+	}
+	if *quickfixFlag != "" {
+		writeQuickfix(*quickfixFlag)
+	}
+	if *eventsSocketFlag != "" {
+		if err := serveEvents(*eventsSocketFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+			exit(1)
+		}
+	}
 
-	fmt.Printf("lrt: listening on %s (forwarding to %s)\n", listenURL, serviceURL)
+	if *controlSocketFlag != "" {
+		if err := serveControl(*controlSocketFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+			exit(1)
+		}
+	}
 
-	go rebuildOnChange()
+	if len(*composeFlag) > 0 {
+		startComposeServices()
+	}
+	if len(portForwards) > 0 {
+		startPortForwards()
+	}
 
-	proxy := &blockingProxy{httputil.NewSingleHostReverseProxy(serviceURL)}
+	if *stdinFlag {
+		forwardStdin()
+	} else if *keysFlag {
+		handleKeys()
+	}
 
-	err := http.ListenAndServe(listenURL.Host, proxy)
-	if err != nil {
+	if *noProxyFlag {
+		infof("lrt: running %s (without a proxy)\n", packageName)
+		rebuildOnChange()
+		return
+	}
+
+	if err := startRoutes(); err != nil {
 		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
-		if strings.Contains(err.Error(), "address already in use") {
-			fmt.Fprintf(os.Stderr, "     hint: Are you already running a development server somewhere else?\n")
-			fmt.Fprintf(os.Stderr, "           if so try `lsof -i:%v` to find the process id\n", listenURL.Port())
+		exit(1)
+	}
+
+	listeners, err := listen()
+	if err == nil {
+		mustRelockPidFile()
+		for _, u := range listenURLs {
+			infof("lrt: listening on %s (forwarding to %s)\n", u, serviceAddress())
 		}
-		os.Exit(1)
+		warnAboutListeners()
+
+		go rebuildOnChange()
+
+		server := &http.Server{Handler: newHandler()}
+		if tlsConfig != nil {
+			server.TLSConfig = tlsConfig
+		}
+		errs := make(chan error, len(listeners))
+		for _, listener := range listeners {
+			go func(listener net.Listener) {
+				if tlsConfig != nil {
+					errs <- server.ServeTLS(listener, "", "")
+				} else {
+					errs <- server.Serve(listener)
+				}
+			}(listener)
+		}
+		err = <-errs
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		fmt.Fprint(os.Stderr, lrtHintsFor(err))
+		exit(1)
+	}
+}
+
+// atExit registers f to be run when lrt exits
+func atExit(f func()) {
+	exitLock.Lock()
+	defer exitLock.Unlock()
+	exitHooks = append(exitHooks, f)
+}
+
+// exit runs everything registered with atExit, and then exits with the given code
+func exit(code int) {
+	exitLock.Lock()
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
 	}
+	os.Exit(code)
 }
 
 // We noticed since switching to go modules that the commands we were using
 // to rebuild go were very slow. If run in the context of a go module, lrt will
 // use a faster rebuild mechanism.
 func figureOutModules() {
-	output, err := exec.Command("go", "env", "GOMOD").CombinedOutput()
+	output, err := exec.Command(*goFlag, "env", "GOMOD").CombinedOutput()
 	if err != nil {
 		fmt.Fprint(os.Stderr, "lrt: "+string(output))
 		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
-		os.Exit(1)
+		exit(1)
 	}
 	goModuleFile := strings.TrimSpace(string(output))
-	if goModuleFile != "" {
+	// outside a module (e.g. for a lone main.go) go prints /dev/null
+	if goModuleFile != "" && goModuleFile != os.DevNull {
 		modContents, err := ioutil.ReadFile(goModuleFile)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
-			os.Exit(1)
+			exit(1)
 		}
 		parsed, err := gomod.Parse(goModuleFile, modContents)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
-			os.Exit(1)
+			exit(1)
 		}
 		goModule = parsed
 		goModuleDir = filepath.Dir(goModuleFile)
@@ -133,43 +416,42 @@ func figureOutModules() {
 
 }
 
-// rebuildIfNecessary notices if the go version has changed since lrt was compiled
-// and, if so, recompiles it.
-// N.B. If a recompilation is neceessary, rebuildIfNecessary will re-exec the current process
-// so after calling this method the latest lrt will continue.
-func rebuildIfNecessary() {
-	// TODO what else should we check?
-	output, err := exec.Command("go", "version").CombinedOutput()
+// figureOutToolchain points go/build at the GOROOT of the go command we're
+// building with, so that standard library packages are recognised (and not
+// watched) even if the service is built with a different go than lrt was. It
+// also uses go's GOPATH, which may list several directories, and may have been
+// set with go env -w rather than in lrt's environment.
+func figureOutToolchain() {
+	output, err := exec.Command(*goFlag, "env", "GOROOT", "GOPATH").CombinedOutput()
 	if err != nil {
 		if _, ok := err.(*exec.ExitError); ok {
 			fmt.Fprint(os.Stderr, "lrt: "+string(output))
 		} else {
 			fmt.Fprint(os.Stderr, "lrt: "+err.Error()+"\n")
+			if *goFlag != "go" {
+				fmt.Fprintf(os.Stderr, "     hint: -go should be the path to a go binary, e.g. \"$HOME/sdk/go1.20/bin/go\"\n")
+			}
 		}
 		os.Exit(1)
 	}
-	if !strings.Contains(string(output), " "+runtime.Version()+" ") {
-		fmt.Printf("lrt: new go version detected, reinstalling lrt for %v...\n", string(output))
+	env := strings.Split(strings.TrimSpace(string(output)), "\n")
+	build.Default.GOROOT = strings.TrimSpace(env[0])
+	if len(env) > 1 {
+		build.Default.GOPATH = strings.TrimSpace(env[1])
+	}
+}
 
-		output, err = exec.Command("go", "install", "github.com/superhuman/lrt").CombinedOutput()
-		if err != nil {
-			if _, ok := err.(*exec.ExitError); ok {
-				fmt.Fprint(os.Stderr, "lrt: "+string(output))
-			} else {
-				fmt.Fprint(os.Stderr, "lrt: "+err.Error()+"\n")
-			}
-			os.Exit(1)
-		}
-		binary, err := exec.LookPath(os.Args[0])
-		if err != nil {
-			fmt.Fprint(os.Stderr, "lrt: "+err.Error()+"\n")
-			os.Exit(1)
-		}
-		if err := syscall.Exec(binary, os.Args, os.Environ()); err != nil {
-			fmt.Fprint(os.Stderr, "lrt: "+err.Error()+"\n")
-			os.Exit(1)
-		}
+// usingOtherToolchain returns true if the service should be built with a go other than
+// the one on the $PATH, either because -go was passed or because GOTOOLCHAIN selects one.
+func usingOtherToolchain() bool {
+	if *goFlag != "go" {
+		return true
+	}
+	switch os.Getenv("GOTOOLCHAIN") {
+	case "", "local", "auto", "path":
+		return false
 	}
+	return true
 }
 
 type blockingProxy struct {
@@ -177,9 +459,108 @@ type blockingProxy struct {
 }
 
 func (b *blockingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	proxyLock.RLock()
+	start := time.Now()
+	defer func() { requestDuration.observe(time.Since(start)) }()
+
+	ok := waitForProxy()
+	queueWaitDuration.observe(time.Since(start))
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("lrt: rebuilding, try again shortly\n"))
+		return
+	}
 	defer proxyLock.RUnlock()
 
+	r, done := trackRequest(r)
+	defer done()
+
+	if *proxyTimeoutFlag > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), *proxyTimeoutFlag)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// if a GET or HEAD request can't reach the service (usually because it
+	// has exited) we wait for it to come back and try again.
+	retry := &retryState{}
+	if *retryFlag && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		r = r.WithContext(context.WithValue(r.Context(), retryKey{}, retry))
+	}
+	deadline := time.Now().Add(*timeoutFlag)
+
+	for {
+		if errorResponse != nil {
+			writeErrorResponse(w, r)
+			return
+		}
+
+		if lastGoodWarning != "" {
+			w.Header().Set("Warning", lastGoodWarning)
+		}
+
+		retry.allowed = time.Now().Before(deadline)
+		retry.failed = false
+		b.proxy.ServeHTTP(w, r)
+		if !retry.failed {
+			return
+		}
+
+		proxyLock.RUnlock()
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+		lockForRequest()
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+}
+
+// waitForProxy takes a read lock on the proxy, waiting while the service is
+// (re)built. If -max-queue or -max-queue-wait are set it gives up instead of
+// waiting too long, and returns false.
+func waitForProxy() bool {
+	if *maxQueueFlag == 0 && *maxQueueWaitFlag == 0 {
+		lockForRequest()
+		return true
+	}
+
+	defer atomic.AddInt32(&queued, -1)
+	if n := atomic.AddInt32(&queued, 1); *maxQueueFlag > 0 && n > int32(*maxQueueFlag) {
+		return false
+	}
+
+	acquired := make(chan bool, 1)
+	go func() {
+		lockForRequest()
+		acquired <- true
+	}()
+
+	if *maxQueueWaitFlag == 0 {
+		<-acquired
+		return true
+	}
+
+	select {
+	case <-acquired:
+		return true
+	case <-time.After(*maxQueueWaitFlag):
+		go func() {
+			<-acquired
+			proxyLock.RUnlock()
+		}()
+		return false
+	}
+}
+
+// lockForRequest takes a read lock on the proxy once the service has been
+// built for the first time.
+func lockForRequest() {
+	proxyLock.RLock()
+
 	// on first boot we want to ensure we don't pass any
 	// requests through until we've built the service.
 	for !builtOnce {
@@ -187,56 +568,128 @@ func (b *blockingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(100 * time.Millisecond)
 		proxyLock.RLock()
 	}
+}
+
+// rebuildOnChange sets up all the watches and the rebuilder
+func rebuildOnChange() {
+	go func() {
+
+		shutdownCh := make(chan os.Signal, 1)
+		signal.Notify(shutdownCh, syscall.SIGTERM)
+		signal.Notify(shutdownCh, syscall.SIGINT)
+		<-shutdownCh
+		shutdown()
+	}()
+
+	go forwardSignalsToService()
+	watchReloadPatterns()
+	watchBrowserReloadPatterns()
+	watchEnvFiles()
+
+	watchForChanges(func() {
+		if atomic.LoadInt32(&paused) == 1 {
+			atomic.StoreInt32(&changedWhilePaused, 1)
+			return
+		}
+		rebuild()
+	}, false)
+}
 
-	if errorResponse != nil {
-		w.WriteHeader(http.StatusBadGateway)
-		w.Write(errorResponse)
+// forwardSignalsToService passes the signals in -forward-signal on to the
+// running service
+func forwardSignalsToService() {
+	if len(forwardSignals) == 0 {
 		return
 	}
+	signalCh := make(chan os.Signal, 1)
+	for sig := range forwardSignals {
+		signal.Notify(signalCh, sig)
+	}
+	for sig := range signalCh {
+		proxyLock.RLock()
+		if service != nil {
+			signalService(forwardSignals[sig])
+		} else {
+			fmt.Fprintf(stderr, "lrt: received %s, but your service isn't running\n", sig)
+		}
+		proxyLock.RUnlock()
+	}
+}
 
-	b.proxy.ServeHTTP(w, r)
+// signalService sends a signal to the running service. If it is running under
+// -exec, the signal is sent to the whole process group so that it reaches the
+// service, not just the wrapper.
+func signalService(sig syscall.Signal) {
+	if len(execArgs) > 0 {
+		syscall.Kill(-service.Process.Pid, sig)
+	} else {
+		service.Process.Signal(sig)
+	}
+	signalReplicas(sig)
 }
 
-// rebuildOnChange sets up all the watches and the rebuilder
-func rebuildOnChange() {
+// shutdown stops the service and exits
+func shutdown() {
+	lockProxy()
+	defer proxyLock.Unlock()
+
+	stopRunningService()
+	waiter.Wait()
+	exit(0)
+}
+
+// watchForChanges calls onChange once to begin with, and then again whenever a .go
+// file changes in one of the watched directories. Changes to _test.go files are
+// ignored unless includeTests is true.
+func watchForChanges(onChange func(), includeTests bool) {
 	var err error
 	watcher, err = fsnotify.NewWatcher()
 	if err != nil {
 		fmt.Fprint(os.Stderr, "lrt: "+err.Error())
-		os.Exit(1)
+		exit(1)
 	}
 	defer watcher.Close()
 
-	rebuilder := debounceCallable(100*time.Millisecond, rebuild)
-	go rebuilder()
-
-	go func() {
-
-		shutdownCh := make(chan os.Signal, 1)
-		signal.Notify(shutdownCh, syscall.SIGTERM)
-		signal.Notify(shutdownCh, syscall.SIGINT)
-		<-shutdownCh
-
-		proxyLock.Lock()
-		defer proxyLock.Unlock()
+	changed := debounceCallable(*debounceFlag, *debounceMaxFlag, onChange)
+	go changed()
 
-		stopRunningService()
-		waiter.Wait()
-		os.Exit(0)
-	}()
+	onEvent := func(ev fsnotify.Event) {
+		if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && forgetWatchedDir(ev.Name) {
+			missedEvents(ev.Name+" was removed", changed)
+			return
+		}
+		if *watchRootFlag && ev.Op&fsnotify.Create != 0 {
+			if info, err := os.Stat(ev.Name); err == nil && info.IsDir() && !isIgnoredDir(ev.Name) {
+				watchTree(ev.Name)
+			}
+		}
+		if (strings.HasSuffix(ev.Name, ".go") && (includeTests || !strings.HasSuffix(ev.Name, "_test.go"))) && ev.Op != fsnotify.Chmod && !isOtherGoFile(ev.Name) {
+			if !isBuiltFile(ev.Name) {
+				debugf("lrt: ignoring %s: %s, it isn't part of %s\n", strings.ToLower(ev.Op.String()), ev.Name, packageName)
+				return
+			}
+			debugf("lrt: %s: %s\n", strings.ToLower(ev.Op.String()), ev.Name)
+			recordChange(ev.Name, ev.Op)
+			go changed()
+		}
+	}
 
 	for {
 		select {
 		// watch for events
 		case ev := <-watcher.Events:
-			if (strings.HasSuffix(ev.Name, ".go") && !strings.HasSuffix(ev.Name, "_test.go")) && ev.Op != fsnotify.Chmod {
-				go rebuilder()
-			}
+			onEvent(ev)
+		case ev := <-pollEvents:
+			onEvent(ev)
 
 			// watch for errors
 		case err := <-watcher.Errors:
+			if err == fsnotify.ErrEventOverflow {
+				missedEvents("too many files changed at once for fsnotify to keep up", changed)
+				continue
+			}
 			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
-			os.Exit(1)
+			exit(1)
 		}
 	}
 }
@@ -245,146 +698,557 @@ func rebuildOnChange() {
 // if there are compilation errors it sets errorResponse.
 // if new packages have been added, it watches them
 func rebuild() {
-	proxyLock.Lock()
+	// -shadow releases the proxy lock part way through, so don't rely on
+	// it to stop two rebuilds (or a rebuild and a restart) running at once
+	buildLock.Lock()
+	defer buildLock.Unlock()
+
+	atomic.StoreInt32(&rebuilding, 1)
+	defer atomic.StoreInt32(&rebuilding, 0)
+
+	lockProxy()
 	defer proxyLock.Unlock()
 
+	// which files the service is built from is found again after the first
+	// build, after a failed build, or if lrt may have missed changes
+	rescan := atomic.SwapInt32(&rescanNeeded, 0) == 1
+	findAgain := !builtOnce || errorResponse != nil || buildFailed || rescan
+
 	if builtOnce {
-		fmt.Printf("lrt: rebuilding...\n")
+		if *clearFlag {
+			clearScreen()
+		}
+		if changes := describeChanges(); changes != "" {
+			infof("lrt: rebuilding (%s)...\n", changes)
+		} else {
+			infof("lrt: rebuilding...\n")
+		}
 	}
 
 	// Usually we can rely on `go build -v` to give us a list of package names,
 	// but it will only list packages that need recompiling.
 	// On first run, or if the last build failed, we get all the dependencies and
 	// watch them explicitly.
-	if !builtOnce || errorResponse != nil {
-		output, err := exec.Command("go", "list", "-f", `{{ join .Deps  "\n"}}`, packageName).CombinedOutput()
-		if err != nil {
+	if !builtOnce && *watchRootFlag {
+		// findDependencies runs once the service has been built
+		watchTree(watchRootDir())
+	} else if !builtOnce && loadWatchCache() {
+		// watch what was cached straight away, and catch up with any
+		// packages that have been imported since in the background
+		go refreshWatchCache()
+	} else if findAgain {
+		if rescan && *watchRootFlag {
+			watchTree(watchRootDir())
+		}
+		output, err := listDependencies()
+		if err != nil && rescan {
+			// if the package has gone, the build will say so
+			debugf("lrt: could not list dependencies: %s\n", err)
+		} else if err != nil {
 			if _, ok := err.(*exec.ExitError); ok {
 				fmt.Fprint(os.Stderr, "lrt: "+string(output))
 			} else {
 				fmt.Fprint(os.Stderr, "lrt: "+err.Error())
 			}
-			os.Exit(1)
+			exit(1)
+		} else {
+			watchDependencies(output)
+			saveWatchCache()
 		}
-
-		watchListedPackages([]byte(packageName))
-		watchListedPackages(output)
 	}
 
-	builtOnce = true
-	errorResponse = nil
+	// with -keep-last-good (or -shadow) the healthy service keeps running
+	// until the new build succeeds, so it is built to a different file.
+	keepRunning := (*keepLastGoodFlag || *shadowFlag > 0) && builtOnce && errorResponse == nil && service != nil
+	binary := tmpFile.Name()
+	if keepRunning {
+		binary += "-next"
+	} else {
+		if builtOnce && errorResponse == nil {
+			keepPreviousBuild()
+		}
+		builtOnce = true
+		errorResponse = nil
+		crashes = 0
 
-	stopRunningService()
+		stopRunningService()
+	}
 
-	args := append(buildArgs, "-o", tmpFile.Name(), "-v", packageName)
-	output, err := exec.Command("go", append([]string{"build"}, args...)...).CombinedOutput()
+	rebuildsTotal.inc()
+	trigger := takeChanges()
+	emit("build-started", nil)
+	buildStarted := time.Now()
+	args := buildArgs
+	if *versionVarFlag != "" {
+		args = withLdflags(args, "-X "+*versionVarFlag+"="+buildVersion())
+	}
+	var output []byte
+	var err error
+	if *remoteFlag != "" {
+		output, err = buildRemotely(args)
+	} else {
+		waitForWarmBuild()
+		output, err = buildCommand(args, binary).CombinedOutput()
+	}
+	buildTime := time.Since(buildStarted)
+	buildDuration.observe(buildTime)
+	atomic.StoreInt64(&lastBuildTime, buildTime.Milliseconds())
 
+	buildFailed = err != nil
+	if buildFailed {
+		buildFailuresTotal.inc()
+	}
+	recordBuild(trigger, buildTime, !buildFailed)
 	if err != nil {
 		if _, ok := err.(*exec.ExitError); ok {
-			errorResponse = output
-			fmt.Print(string(output))
+			output = append(output, hintsFor(string(output))...)
+			fmt.Fprint(stdout, string(output))
+			emit("build-failed", event{"output": string(output), "diagnostics": parseDiagnostics(output)})
+			if keepRunning && *keepLastGoodFlag {
+				lastGoodWarning = fmt.Sprintf(`199 lrt "the build failed, serving build %d"`, atomic.LoadInt32(&buildNumber))
+				fmt.Fprintf(stderr, "lrt: still serving the last good build (-keep-last-good)\n")
+			} else {
+				if keepRunning {
+					stopRunningService()
+				}
+				errorResponse = output
+			}
 		} else {
 			fmt.Fprint(os.Stderr, "lrt: "+err.Error())
-			os.Exit(1)
+			exit(1)
 		}
 		return
 	}
 
+	if keepRunning {
+		if *shadowFlag > 0 {
+			shadowBuild(binary, atomic.LoadInt32(&buildNumber)+1)
+		}
+		lastGoodWarning = ""
+		crashes = 0
+		stopRunningService()
+		keepPreviousBuild()
+		if err := os.Rename(binary, tmpFile.Name()); err != nil {
+			fmt.Fprint(os.Stderr, "lrt: "+err.Error())
+			exit(1)
+		}
+	}
+
 	watchListedPackages(output)
+	// the build may have imported packages (or files) it didn't before
+	if findAgain || dependenciesMayHaveChanged(trigger) {
+		go findDependencies()
+	}
+	servingBuild = atomic.AddInt32(&buildNumber, 1)
+	emit("build-succeeded", event{"duration_ms": buildTime.Milliseconds()})
+
+	bootStarted := time.Now()
+	startService()
+	printBuildSummary(trigger, buildTime, time.Since(bootStarted), errorResponse == nil)
+}
 
+// startService starts the most recently built service, and waits for it to
+// be ready. The caller must hold the write lock on the proxy.
+func startService() {
 	// wait for previous service to finish
 	waiter.Wait()
 
-	service = exec.Command(tmpFile.Name(), cmdArgs...)
-	// disable ctrl-c to child process; we'll do that ourselves
-	service.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true,
-		Pgid:    0,
+	if err := waitForDependencies(); err != nil {
+		msg := "lrt: error: not starting your service, as " + err.Error() + "\n" +
+			"     hint: lrt will start it once it is reachable. Is it running?\n"
+		fmt.Fprint(stderr, msg)
+		errorResponse = []byte(msg)
+		stopCh := make(chan bool)
+		serviceStopCh = stopCh
+		go startWhenReachable(stopCh)
+		return
+	}
+
+	if serviceSocket != "" {
+		// don't let a socket left behind by the previous process get in the way
+		os.Remove(serviceSocket)
+	}
+	service = primaryCommand()
+	recentOutput.reset()
+	logReadyCh := make(chan bool, 1)
+	onLine := func(source string) func(string) {
+		return func(line string) {
+			serviceLogs.add(source, line)
+			recentOutput.add(line)
+			if readyLogPattern != nil && readyLogPattern.MatchString(line) {
+				select {
+				case logReadyCh <- true:
+				default:
+				}
+			}
+		}
+	}
+	service.Stdout = &lineWriter{out: serviceStdout, onLine: onLine("stdout"), prefix: outputPrefix("stdout")}
+	service.Stderr = &lineWriter{out: os.Stderr, onLine: onLine("stderr"), prefix: outputPrefix("stderr")}
+	if *stdinFlag {
+		pipe, err := service.StdinPipe()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		setServiceStdin(pipe)
 	}
-	service.Env = append(os.Environ(), "PORT="+serviceURL.Port())
-	service.Stdout = os.Stdout
-	service.Stderr = os.Stderr
-	err = service.Start()
+	err := service.Start()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		exit(1)
 	}
 
 	exitCh := make(chan bool, 1)
-	listeningCh := make(chan bool, 1)
+	listeningCh := make(chan string, 1)
+
+	cmd := service
+	pid := service.Process.Pid
+	stopCh := make(chan bool)
+	serviceStopCh = stopCh
+	exited := make(chan bool)
+	serviceExitedCh = exited
+	deployed := make(chan bool)
+	started := time.Now()
+	emit("service-started", event{"pid": pid})
 
 	waiter.Add(1)
 	go func() {
 		defer waiter.Done()
-		service.Wait()
+		cmd.Wait()
+		if *deployFlag != "" && cmd.ProcessState.Success() {
+			// the deploy hook has restarted the service on the target, so
+			// it can now be health checked
+			emit("deployed", event{"duration_ms": time.Since(started).Milliseconds()})
+			debugf("lrt: deployed in %s\n", time.Since(started).Round(time.Millisecond))
+			close(deployed)
+			close(exited)
+			return
+		}
+		expected := false
+		select {
+		case <-stopCh:
+			expected = true
+		default:
+		}
+		emit("service-exited", exitFields(cmd.ProcessState).with("expected", expected))
+		// the service runs in its own process group, make sure that any
+		// processes it started don't outlive it (and keep its port open).
+		syscall.Kill(-pid, syscall.SIGKILL)
+		close(exited)
 		exitCh <- true
 	}()
 
+	stopHealthCheck := make(chan bool)
+	defer close(stopHealthCheck)
+
 	go func() {
-		for {
-			resp, err := http.Get(healthCheckURL.String())
-			if err != nil {
-				continue
+		// until the deploy hook has finished, the health check would reach
+		// the previous build still running on the target. (A hook that keeps
+		// running says when the service is ready with -ready-log-pattern.)
+		if *deployFlag != "" && readyLogPattern == nil {
+			select {
+			case <-deployed:
+			case <-stopHealthCheck:
+				return
 			}
-			resp.Body.Close()
-			if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-				break
+		}
+
+		target := *healthCheckURL
+		if *detectPortFlag {
+			host, ok := detectServiceHost(pid, stopHealthCheck)
+			if !ok {
+				return
 			}
+			target.Host = host
 		}
 
-		listeningCh <- true
+		if waitUntilReady(&target, logReadyCh, stopHealthCheck) {
+			listeningCh <- target.Host
+		}
 	}()
 
 	select {
 	case <-exitCh:
-		errorResponse = []byte("lrt: error: service unexpectedly exited before responding to " + healthCheckURL.String() + "\n" +
-			"     hint: check the terminal output to see if any errors were logged.\n")
-		fmt.Fprintf(os.Stderr, string(errorResponse))
+		msg := "lrt: error: service unexpectedly exited before responding to " + healthCheckName() + " (" + cmd.ProcessState.String() + ")\n" +
+			hintsFor(strings.Join(recentOutput.all(), "\n")) +
+			dependencyHint() +
+			"     hint: check the terminal output to see if any errors were logged.\n"
+		fmt.Fprint(stderr, msg)
+		errorResponse = withRecentOutput(msg)
+		bootFailuresTotal.inc()
+
+		// if the service was restarted after crashing, keep trying
+		if crashes > 0 {
+			go restartAfterCrash(cmd, stopCh, started)
+		}
 
 	case <-time.After(*timeoutFlag):
-		errorResponse = []byte("lrt: error: service is still not responding on " + healthCheckURL.String() + " after " + (*timeoutFlag).String() + "\n" +
+		msg := "lrt: error: service is still not responding on " + healthCheckName() + " after " + (*timeoutFlag).String() + "\n" +
+			hintsFor(strings.Join(recentOutput.all(), "\n")) +
+			deployHint(deployed) +
 			"     hint: ensure your service listens on $PORT. For example: http.ListenAndServe(\"localhost:\" + os.Getenv(\"PORT\"), nil)\n" +
-			"           also, check the terminal output to see if any errors were logged.\n")
-		fmt.Fprintf(os.Stderr, string(errorResponse))
+			"           also, check the terminal output to see if any errors were logged.\n"
+		fmt.Fprint(stderr, msg)
+		errorResponse = withRecentOutput(msg)
+		bootFailuresTotal.inc()
+
+	case host := <-listeningCh:
+		if host != serviceURL.Host {
+			fmt.Fprintf(stderr, "lrt: warning: service is listening on %s, not %s; forwarding requests there instead\n", host, serviceURL.Host)
+			serviceURL.Host = host
+			healthCheckURL.Host = host
+		}
 
-	case <-listeningCh:
+		bootDuration.observe(time.Since(started))
+		if *serveStaleFlag {
+			clearStaleResponses()
+		}
+		if *warmupFlag > 0 {
+			replayWarmup()
+		}
+		emit("service-healthy", event{"address": serviceAddress(), "duration_ms": time.Since(started).Milliseconds()})
+		if len(replicaURLs) > 0 {
+			startReplicas()
+		}
 
+		if *restartFlag != "never" {
+			go restartOnExit(cmd, exitCh, stopCh, started)
+		}
 	}
 
 }
 
-// stopRunningService implements graceful shutdown by sending SIGTERM, waiting up to 10 seconds, and then SIGKILL
-func stopRunningService() {
-	if service != nil {
-		service.Process.Signal(syscall.SIGTERM)
-		go func() {
-			deadChan := make(chan bool, 1)
-			go func() {
-				service.Process.Wait()
-				deadChan <- true
-			}()
-			select {
-			case <-time.After(10 * time.Second):
-				fmt.Fprintf(os.Stderr, "timeout expired; sending SIGKILL")
-				service.Process.Kill()
-				service.Process.Wait()
-			case <-deadChan:
-			}
-		}()
+// primaryCommand returns the command for the service (as opposed to the
+// other -replicas), with where to listen in its environment
+func primaryCommand() *exec.Cmd {
+	cmd := serviceCommand()
+	if serviceSocket != "" {
+		cmd.Env = append(cmd.Env, "SOCKET="+serviceSocket)
+	} else if !*noProxyFlag {
+		cmd.Env = append(cmd.Env, "PORT="+serviceURL.Port())
 	}
+	if len(replicaURLs) > 0 {
+		cmd.Env = append(cmd.Env, "REPLICA=1")
+	}
+	if *deployFlag != "" {
+		cmd.Env = append(cmd.Env, "BINARY="+tmpFile.Name(), "ARGS="+*cmdArgsFlag)
+	}
+	if *remoteFlag != "" {
+		cmd = remoteCommand(cmd)
+	}
+	return cmd
 }
 
-// watchListedPackages takes a list of newline separated package names,
-// such as generated by:
-//   go build -v
-//   go list -f '{{ join .Deps "\n" }}'
-// and adds them to the watch list
-func watchListedPackages(output []byte) {
-
-	packages := strings.Split(strings.TrimSpace(string(output)), "\n")
-
+// serviceCommand returns the command that runs the most recent build: the
+// -deploy hook, the -exec wrapper, or the binary itself.
+func serviceCommand() *exec.Cmd {
+	var cmd *exec.Cmd
+	if *deployFlag != "" {
+		cmd = deployCommand()
+	} else if len(execArgs) > 0 {
+		args := append([]string{}, execArgs[1:]...)
+		args = append(args, tmpFile.Name())
+		if *debugFlag {
+			// dlv exec needs -- before the arguments for the service
+			args = append(args, "--")
+		}
+		cmd = exec.Command(execArgs[0], append(args, cmdArgs...)...)
+	} else {
+		cmd = exec.Command(tmpFile.Name(), cmdArgs...)
+	}
+	// disable ctrl-c to child process; we'll do that ourselves
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+		Pgid:    0,
+	}
+	cmd.Env = serviceEnv()
+	return cmd
+}
+
+// restartOnExit waits for the service to exit, and if it wasn't stopped by
+// lrt, restarts it according to -restart.
+func restartOnExit(cmd *exec.Cmd, exitCh chan bool, stopCh chan bool, started time.Time) {
+	select {
+	case <-stopCh:
+		return
+	case <-exitCh:
+	}
+	select {
+	case <-stopCh:
+		return
+	default:
+	}
+
+	fmt.Fprintf(stderr, "lrt: service exited unexpectedly (%s)\n", cmd.ProcessState)
+	if *restartFlag == "on-failure" && cmd.ProcessState.Success() {
+		return
+	}
+	restartAfterCrash(cmd, stopCh, started)
+}
+
+// restartAfterCrash restarts the service after it has exited. If it keeps
+// exiting soon after starting we back off exponentially (up to 10 seconds)
+// between restarts, and give up after crashLoopLimit attempts.
+func restartAfterCrash(cmd *exec.Cmd, stopCh chan bool, started time.Time) {
+	lockProxy()
+	select {
+	case <-stopCh:
+		// lrt has started rebuilding in the meantime
+		proxyLock.Unlock()
+		return
+	default:
+	}
+
+	if time.Since(started) < 10*time.Second {
+		crashes++
+	} else {
+		crashes = 1
+	}
+	if crashes >= crashLoopLimit {
+		errorResponse = withRecentOutput(fmt.Sprintf("lrt: error: service keeps exiting (%s), it has crashed %d times in a row soon after starting\n", cmd.ProcessState, crashes) +
+			"     hint: lrt will not restart it again until you change a file.\n")
+		fmt.Fprintf(stderr, "lrt: error: service keeps exiting (%s), not restarting it until you change a file\n", cmd.ProcessState)
+		proxyLock.Unlock()
+		return
+	}
+	backoff := 100 * time.Millisecond << uint(crashes-1)
+	if backoff > 10*time.Second {
+		backoff = 10 * time.Second
+	}
+	proxyLock.Unlock()
+
+	select {
+	case <-stopCh:
+		return
+	case <-time.After(backoff):
+	}
+
+	// if it crashed because something it needs went away, wait for it to
+	// come back rather than crashing again
+	if !waitUntilReachable(stopCh) {
+		return
+	}
+
+	buildLock.Lock()
+	defer buildLock.Unlock()
+	atomic.StoreInt32(&restarting, 1)
+	defer atomic.StoreInt32(&restarting, 0)
+	lockProxy()
+	defer proxyLock.Unlock()
+	select {
+	case <-stopCh:
+		return
+	default:
+	}
+
+	infof("lrt: restarting service...\n")
+	errorResponse = nil
+	startService()
+}
+
+// buildCommand returns the go build command that builds the service to binary
+// with the given go build arguments
+func buildCommand(args []string, binary string) *exec.Cmd {
+	args = append(append(append([]string{"build"}, args...), "-o", binary, "-v"), packageArgs()...)
+	build := exec.Command(*goFlag, args...)
+	build.Env = append(append(os.Environ(), targetGoEnv...), ramBuildEnv()...)
+	return build
+}
+
+// buildVersion returns a version string that identifies the current save,
+// made up of the current git sha and a timestamp.
+func buildVersion() string {
+	sha := "unknown"
+	output, err := exec.Command("git", "rev-parse", "--short", "HEAD").Output()
+	if err == nil {
+		sha = strings.TrimSpace(string(output))
+	}
+	return sha + "-" + time.Now().Format("20060102150405")
+}
+
+// withLdflags returns a copy of args with extra appended to the linker flags.
+// If args already contains -ldflags the extra flags are added to the existing
+// value, as go build only respects the last -ldflags it is given.
+func withLdflags(args []string, extra string) []string {
+	result := append([]string{}, args...)
+	for i := len(result) - 1; i >= 0; i-- {
+		arg := strings.TrimPrefix(result[i], "-")
+		if arg == "-ldflags" || arg == "ldflags" {
+			if i+1 < len(result) {
+				result[i+1] += " " + extra
+				return result
+			}
+		}
+		if strings.HasPrefix(arg, "-ldflags=") || strings.HasPrefix(arg, "ldflags=") {
+			result[i] += " " + extra
+			return result
+		}
+	}
+	return append(result, "-ldflags", extra)
+}
+
+// stopRunningService implements graceful shutdown by sending -stop-signal
+// (SIGTERM), waiting up to -stop-timeout (10 seconds), and then SIGKILL to the
+// service's process group, so that any processes it started are stopped too.
+func stopRunningService() {
+	stopReplicas()
+	if serviceStopCh != nil {
+		close(serviceStopCh)
+		serviceStopCh = nil
+	}
+	if service != nil {
+		pgid := service.Process.Pid
+		exited := serviceExitedCh
+		service = nil
+		syscall.Kill(-pgid, stopSignal)
+		go func() {
+			select {
+			case <-time.After(*stopTimeoutFlag):
+				fmt.Fprintf(stderr, "lrt: service did not exit within %s of %s; sending SIGKILL\n", *stopTimeoutFlag, stopSignal)
+				syscall.Kill(-pgid, syscall.SIGKILL)
+			case <-exited:
+			}
+		}()
+	}
+}
+
+// listDependencies runs go list to find all of the package's dependencies
+func listDependencies() ([]byte, error) {
+	list := exec.Command(*goFlag, append([]string{"list", "-f", `{{ join .Deps  "\n"}}`}, packageArgs()...)...)
+	// when cross-compiling, list the files that will be built
+	list.Env = append(os.Environ(), targetGoEnv...)
+	return list.CombinedOutput()
+}
+
+// watchDependencies watches the package (or .go files) and the dependencies
+// listed by listDependencies
+func watchDependencies(output []byte) {
+	if packageDir != "" {
+		addDependencyDir(packageDir)
+		watchDir(packageDir)
+	} else {
+		watchListedPackages([]byte(packageName))
+	}
+	watchListedPackages(output)
+}
+
+// watchListedPackages takes a list of newline separated package names,
+// such as generated by:
+//   go build -v
+//   go list -f '{{ join .Deps "\n" }}'
+// and adds them to the watch list
+func watchListedPackages(output []byte) {
+
+	packages := strings.Split(strings.TrimSpace(string(output)), "\n")
+
 	for _, p := range packages {
-		if p == "" {
+		// test variants are listed as "pkg [pkg.test]"
+		if i := strings.Index(p, " ["); i > 0 {
+			p = p[:i]
+		}
+		// .go files are built as a package called command-line-arguments
+		if p == "" || strings.HasSuffix(p, ".test") || p == "command-line-arguments" {
 			continue
 		}
 		// HACK:CI work around  https://github.com/golang/go/issues/36025
@@ -394,45 +1258,50 @@ func watchListedPackages(output []byte) {
 			continue
 		}
 
-		dir := ""
-
-		if goModule != nil {
-			if strings.HasPrefix(p, goModule.Name) {
-				dir = goModuleDir + strings.TrimPrefix(p, goModule.Name)
-			}
-			for path, replace := range goModule.Replace {
-				if strings.HasPrefix(p, path) {
-					if r, ok := replace.(gomod.RelativePath); ok {
-						dir = string(r) + strings.TrimPrefix(p, path)
-					}
-				}
-			}
-		} else {
-			pkg, err := build.Default.Import(p, ".", build.FindOnly)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "lrt: "+err.Error(), "\n")
-				os.Exit(1)
-			}
-			if !pkg.Goroot {
-				dir = pkg.Dir
-			}
+		dir, err := localPackageDir(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+			exit(1)
 		}
-
-		if dir != "" && !watchedDir[dir] {
-			err := watcher.Add(dir)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "lrt: "+err.Error()+"\n")
-				if strings.Contains(err.Error(), "too many open files") {
-					fmt.Fprintf(os.Stderr, "     hint: you may need to increase the number of open files you are allowed, try:\n")
-					fmt.Fprintf(os.Stderr, "           sudo launchctl limit maxfiles 1000000 1000000\n")
-				}
-				os.Exit(1)
-			}
-			watchedDir[dir] = true
+		if dir != "" {
+			addDependencyDir(dir)
+			watchDir(dir)
 		}
 	}
 }
 
+// watchDir adds dir to the watcher, unless it is already being watched
+func watchDir(dir string) {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	if watchedDir[dir] {
+		return
+	}
+	if *dryRunFlag {
+		// -dry-run only lists what would be watched
+		watchedDir[dir] = true
+		debugf("lrt: would watch %s\n", dir)
+		return
+	}
+	if isPolled(dir) {
+		watchedDir[dir] = true
+		debugf("lrt: watching %s (by polling)\n", dir)
+		return
+	}
+	err := watcher.Add(dir)
+	if err != nil && isOutOfWatches(err) {
+		pollSiblings(dir, err)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lrt: "+err.Error()+"\n")
+		fmt.Fprint(os.Stderr, lrtHintsFor(err))
+		exit(1)
+	}
+	watchedDir[dir] = true
+	debugf("lrt: watching %s\n", dir)
+}
+
 // generateServiceURL asks the kernel for a free open port that is ready to use,
 // falling back to 1xxxx where xxxx is the listen port.
 // https://github.com/phayes/freeport/blob/master/freeport.go
@@ -449,31 +1318,101 @@ func generateServiceURL(listenURL *url.URL) *url.URL {
 	return &url.URL{Scheme: listenURL.Scheme, Host: net.JoinHostPort(listenURL.Hostname(), strconv.Itoa(l.Addr().(*net.TCPAddr).Port))}
 }
 
-// debounceCallable slows down rebuilds in case of a large number of simultaneously file changes
+// changedFiles are the files that have changed since the last rebuild, and
+// changedOps what happened to each of them
+var (
+	changedLock  sync.Mutex
+	changedFiles []string
+	changedOps   = map[string]fsnotify.Op{}
+)
+
+func recordChange(name string, op fsnotify.Op) {
+	changedLock.Lock()
+	defer changedLock.Unlock()
+	if _, ok := changedOps[name]; !ok {
+		changedFiles = append(changedFiles, name)
+	}
+	changedOps[name] |= op
+}
+
+// takeChanges returns the files that have changed since it was last called
+func takeChanges() []string {
+	changedLock.Lock()
+	defer changedLock.Unlock()
+	files := changedFiles
+	changedFiles = nil
+	changedOps = map[string]fsnotify.Op{}
+	return files
+}
+
+// describeChanges says which files have changed since the last rebuild, and
+// how, e.g. "changed: api/server.go; removed: api/old.go"
+func describeChanges() string {
+	changedLock.Lock()
+	defer changedLock.Unlock()
+	kinds := []string{"created", "changed", "renamed", "removed"}
+	byKind := map[string][]string{}
+	for _, file := range changedFiles {
+		op := changedOps[file]
+		kind := "changed"
+		switch {
+		case op&fsnotify.Remove != 0:
+			kind = "removed"
+		case op&fsnotify.Rename != 0:
+			kind = "renamed"
+		case op&fsnotify.Create != 0:
+			kind = "created"
+		}
+		byKind[kind] = append(byKind[kind], file)
+	}
+	parts := []string{}
+	for _, kind := range kinds {
+		if files := byKind[kind]; len(files) > 0 {
+			parts = append(parts, kind+": "+strings.Join(relativeFiles(files), ", "))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// debounceCallable slows down rebuilds in case of a large number of simultaneously file changes.
+// f is called once there have been no calls for interval, or maxDelay after the first call
+// if calls keep coming (a maxDelay of 0 waits for things to settle however long that takes).
 // https://gist.github.com/leolara/d62b87797b0ef5e418cd#gistcomment-2243168
-func debounceCallable(interval time.Duration, f func()) func() {
+func debounceCallable(interval time.Duration, maxDelay time.Duration, f func()) func() {
+	var mutex sync.Mutex
 	var timer *time.Timer
+	var first time.Time
 
 	return func() {
-		if timer == nil {
-			timer = time.NewTimer(interval)
-
-			go func() {
-				<-timer.C
-				timer.Stop()
-				timer = nil
-				f()
-			}()
-		} else {
-			timer.Reset(interval)
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		// if the timer has already fired (or never started) this is the start of a new burst
+		inBurst := timer != nil && timer.Stop()
+		if !inBurst {
+			first = time.Now()
 		}
+
+		wait := interval
+		if maxDelay > 0 && time.Until(first.Add(maxDelay)) < wait {
+			wait = time.Until(first.Add(maxDelay))
+			debugf("lrt: debounce: changes have kept coming for %s, going ahead in %s (-debounce-max)\n", time.Since(first).Round(time.Millisecond), wait.Round(time.Millisecond))
+		} else if inBurst {
+			debugf("lrt: debounce: another change, waiting %s for things to settle\n", wait)
+		}
+		timer = time.AfterFunc(wait, f)
 	}
 }
 
-func mustParseArgs() {
-
-	flag.Usage = func() {
-		fmt.Print(`Usage: lrt [options] <package>
+func usage() {
+	fmt.Print(`Usage: lrt [options] <package | files.go>
+       lrt test [options] [packages]
+       lrt stats [options]
+       lrt init [options]
+       lrt doctor [options] [package]
+       lrt start [options] <package>
+       lrt stop|status|logs [-f]
+       lrt completion bash|zsh|fish
 
 lrt wraps a go http service and reloads it whenever the source code changes.
 lrt acts as a "Live Reload Tool" by proxying requests to the service, queueing
@@ -482,71 +1421,369 @@ ensuring that requests never hit an old version of the code.
 
 parameters:
   package
-	the go package to build (default ".")
+	the go package to build (default the package in .lrt.yaml, or ".")
+  files.go
+	instead of a package, build and run these .go files (like go run main.go)
+
+commands:
+  test
+	rerun go test whenever the code changes, see lrt test --help
+  stats
+	summarize how long rebuilds have taken recently, see lrt stats --help
+  init
+	write a ` + configFile + ` with options for your package, see lrt init --help
+  doctor
+	check that lrt can build, run and watch your package, see lrt doctor --help
+  start
+	run lrt in the background, see lrt start --help
+  stop, status, logs
+	stop, check on, or print the output of lrt running in the background
+  completion
+	print a script to complete lrt's options and packages in your shell, see lrt completion --help
 
 options:
 `)
-		flag.PrintDefaults()
+	flag.PrintDefaults()
+
+	fmt.Print(`
+Options can also be set in .lrt.yaml, or with environment variables named after them
+(e.g. LRT_LISTEN for -listen, or LRT_BUILD_ARGS for -build-args).
 
-		fmt.Print(`
 lrt listens on localhost:3000 and boots your service with a PORT environment variable set.
 Your service should start an HTTP server on the provided port. For more details see:
 https://github.com/superhuman/lrt
 `)
-		os.Exit(2)
+	os.Exit(2)
+}
+
+func mustParseArgs() {
+
+	if os.Getenv(routedEnv) != "" {
+		// the lrt that started this one owns these, and passes -listen last
+		*composeFlag = nil
+		*portForwardFlag = nil
+		listenFlag.stringsFlag = listenFlag.stringsFlag[len(listenFlag.stringsFlag)-1:]
 	}
 
-	flag.Parse()
+	if inherited, err := inheritListeners(); err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	} else {
+		activatedListeners = inherited
+	}
+	for _, listener := range activatedListeners {
+		listenURLs = append(listenURLs, listenerURL(listener))
+		requestedListenHosts = append(requestedListenHosts, listenURLs[len(listenURLs)-1].Host)
+	}
 
-	listenURL = argToURL("-listen", listenFlag)
+	seen := map[string]bool{}
+	for _, listen := range listenFlag.stringsFlag {
+		if len(activatedListeners) > 0 {
+			break
+		}
+		if seen[listen] {
+			continue
+		}
+		seen[listen] = true
+		if strings.HasPrefix(listen, "unix:") {
+			listenURLs = append(listenURLs, &url.URL{Scheme: "unix", Path: strings.TrimPrefix(strings.TrimPrefix(listen, "unix:"), "//")})
+		} else {
+			listenURLs = append(listenURLs, argToURL("-listen", &listen))
+		}
+		requestedListenHosts = append(requestedListenHosts, listenURLs[len(listenURLs)-1].Host)
+	}
+	listenURL = listenURLs[0]
 
-	if *serviceFlag == "" {
+	if os.Getenv(routedEnv) == "" {
+		for _, value := range *routeFlag {
+			r, err := parseRoute(value)
+			if err != nil {
+				fmt.Printf("lrt: -route %s is invalid: %s. See lrt --help for details\n", value, err)
+				os.Exit(2)
+			}
+			if *noProxyFlag {
+				fmt.Printf("lrt: -route cannot be used with -no-proxy. See lrt --help for details\n")
+				os.Exit(2)
+			}
+			routes = append(routes, r)
+		}
+	}
+	for _, value := range *waitForFlag {
+		u, err := parseWaitFor(value)
+		if err != nil {
+			fmt.Printf("lrt: -wait-for %s is invalid: %s. See lrt --help for details\n", value, err)
+			os.Exit(2)
+		}
+		waitForURLs = append(waitForURLs, u)
+	}
+	for _, value := range *portForwardFlag {
+		p, err := parsePortForward(value)
+		if err != nil {
+			fmt.Printf("lrt: -port-forward %s is invalid: %s. See lrt --help for details\n", value, err)
+			os.Exit(2)
+		}
+		portForwards = append(portForwards, p)
+	}
+	for _, value := range *staticFlag {
+		m, err := parseStatic(value)
+		if err != nil {
+			fmt.Printf("lrt: -static %s is invalid: %s. See lrt --help for details\n", value, err)
+			os.Exit(2)
+		}
+		staticMounts = append(staticMounts, m)
+	}
+	sortStaticMounts()
+	for _, value := range *hostRewriteFlag {
+		rewrite, err := parseHostRewrite(value)
+		if err != nil {
+			fmt.Printf("lrt: -host-rewrite %s is invalid: %s. See lrt --help for details\n", value, err)
+			os.Exit(2)
+		}
+		hostRewrites = append(hostRewrites, rewrite)
+	}
+
+	if *serviceFlag == "" && listenURL.Scheme == "unix" {
+		serviceURL = generateServiceURL(&url.URL{Scheme: "http", Host: "localhost:3000"})
+	} else if *serviceFlag == "" {
 		serviceURL = generateServiceURL(listenURL)
+	} else if *serviceFlag == "unix" || strings.HasPrefix(*serviceFlag, "unix:") {
+		serviceSocket = strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(*serviceFlag, "unix"), ":"), "//")
+		if serviceSocket == "" {
+			serviceSocket = filepath.Join(os.TempDir(), fmt.Sprintf("lrt-%d.sock", os.Getpid()))
+		}
+		serviceSocket, _ = filepath.Abs(serviceSocket)
+		atExit(func() { os.Remove(serviceSocket) })
+		// requests are sent over the socket, so the host is only used for the Host header
+		serviceURL = &url.URL{Scheme: "http", Host: "localhost"}
+
+		if *detectPortFlag {
+			fmt.Printf("lrt: -detect-port cannot be used with -service %s. See lrt --help for details\n", *serviceFlag)
+			os.Exit(2)
+		}
 	} else {
 		serviceURL = argToURL("-service", serviceFlag)
 	}
 
-	var err error
-	healthCheckURL, err = url.Parse(*healthCheckFlag)
-	if err != nil {
-		fmt.Printf("lrt: -started-probe %#v is not a valid url. See lrt --help for details\n", *healthCheckFlag)
-		os.Exit(1)
+	switch *serviceSchemeFlag {
+	case "http":
+	case "https":
+		serviceURL.Scheme = "https"
+		serviceTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	default:
+		fmt.Printf("lrt: -service-scheme must be http or https. See lrt --help for details\n")
+		os.Exit(2)
 	}
 
-	if serviceURL.ResolveReference(healthCheckURL).Host != serviceURL.Host {
-		fmt.Printf("lrt: -started-probe %#v is not relative to -service %#v. See lrt --help for details\n", *healthCheckFlag, *serviceFlag)
-		os.Exit(1)
+	if *basicAuthFlag != "" && !strings.Contains(*basicAuthFlag, ":") {
+		fmt.Printf("lrt: -basic-auth must be in the format username:password. See lrt --help for details\n")
+		os.Exit(2)
 	}
-	healthCheckURL = serviceURL.ResolveReference(healthCheckURL)
 
-	if len(flag.Args()) == 1 {
-		packageName = flag.Args()[0]
-	} else {
-		packageName = "."
+	if *errorRateFlag < 0 || *errorRateFlag > 1 {
+		fmt.Printf("lrt: -inject-error-rate must be between 0 and 1. See lrt --help for details\n")
+		os.Exit(2)
 	}
 
-	pkg, err := build.Default.Import(packageName, ".", 0)
-	if err != nil {
-		if strings.HasPrefix(err.Error(), "cannot find package") {
-			fmt.Fprintf(os.Stderr, "lrt: cannot find package %#v\n", packageName)
-			_, err = os.Stat(packageName)
-			if err == nil {
-				fmt.Fprintf(os.Stderr, "     hint: go packages are specified by package name, e.g. \"github.com/superhuman/lrt\"\n")
-				fmt.Fprintf(os.Stderr, "           to use a relative directory start with ./, e.g. \"./lrt\"\n")
-				if strings.HasSuffix(packageName, ".go") {
-					fmt.Fprintf(os.Stderr, "           running individual go files is not yet supported.\n")
-				}
+	switch *accessLogFlag {
+	case "", "short", "common", "combined", "json":
+	default:
+		fmt.Printf("lrt: -access-log must be one of short, common, combined or json. See lrt --help for details\n")
+		os.Exit(2)
+	}
+
+	serviceTransport.ResponseHeaderTimeout = *proxyHeaderFlag
+	serviceTransport.IdleConnTimeout = *proxyIdleFlag
+
+	if *tlsFlag {
+		tlsConfig = mustLoadTLSConfig()
+		for _, u := range listenURLs {
+			if u.Scheme == "http" {
+				u.Scheme = "https"
 			}
+		}
+	}
+
+	var err error
+	if *healthCheckFlag == "tcp" {
+		healthCheckURL = &url.URL{Scheme: "tcp", Host: serviceURL.Host}
+	} else if *healthCheckFlag == "grpc" || strings.HasPrefix(*healthCheckFlag, "grpc:") {
+		healthCheckURL = &url.URL{Scheme: "grpc", Host: serviceURL.Host, Path: "/" + strings.TrimPrefix(strings.TrimPrefix(*healthCheckFlag, "grpc"), ":")}
+	} else {
+		healthCheckURL, err = url.Parse(*healthCheckFlag)
+		if err != nil {
+			fmt.Printf("lrt: -started-probe %#v is not a valid url. See lrt --help for details\n", *healthCheckFlag)
 			os.Exit(1)
+		}
 
-		} else {
-			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		if serviceURL.ResolveReference(healthCheckURL).Host != serviceURL.Host {
+			fmt.Printf("lrt: -started-probe %#v is not relative to -service %#v. See lrt --help for details\n", *healthCheckFlag, *serviceFlag)
 			os.Exit(1)
 		}
+		healthCheckURL = serviceURL.ResolveReference(healthCheckURL)
 	}
-	if pkg.Name != "main" {
-		fmt.Printf("lrt: %#v does not contain package \"main\".\n", packageName)
-		os.Exit(1)
+
+	healthCheckHeader = http.Header{}
+	for _, header := range *healthHeaderFlag {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			fmt.Printf("lrt: -health-check-header %#v is invalid. Expected something like \"Authorization: Bearer dev\". See lrt --help for details\n", header)
+			os.Exit(2)
+		}
+		healthCheckHeader.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	healthCheckStatus, err = parseStatusRanges(*healthStatusFlag)
+	if err != nil {
+		fmt.Printf("lrt: -health-check-status is invalid: %s. See lrt --help for details\n", err)
+		os.Exit(2)
+	}
+
+	healthCheckCmd, err = shellwords.Parse(*healthCmdFlag)
+	if err != nil {
+		panic(err) // can only happen if shellwords.ParseBacktick is true, and it isn't
+	}
+	if len(healthCheckCmd) == 0 {
+		healthCheckCmd = nil
+	}
+
+	if *readyPatternFlag != "" {
+		readyLogPattern, err = regexp.Compile(*readyPatternFlag)
+		if err != nil {
+			fmt.Printf("lrt: -ready-log-pattern is invalid: %s. See lrt --help for details\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if *warmupPathFlag != "" {
+		warmupPathPattern, err = regexp.Compile(*warmupPathFlag)
+		if err != nil {
+			fmt.Printf("lrt: -warmup-path is invalid: %s. See lrt --help for details\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if *logBufferFlag < 0 {
+		fmt.Printf("lrt: -log-buffer must be 0 or more. See lrt --help for details\n")
+		os.Exit(2)
+	}
+
+	if *errorLinesFlag < 0 {
+		fmt.Printf("lrt: -error-lines must be 0 or more. See lrt --help for details\n")
+		os.Exit(2)
+	}
+	recentOutput.size = *errorLinesFlag
+
+	switch *colorFlag {
+	case "auto", "always", "never":
+	default:
+		fmt.Printf("lrt: -color must be one of auto, always or never. See lrt --help for details\n")
+		os.Exit(2)
+	}
+
+	switch {
+	case *quietFlag && *verboseFlag:
+		fmt.Printf("lrt: -quiet and -verbose cannot be used together. See lrt --help for details\n")
+		os.Exit(2)
+	case *quietFlag:
+		logLevel = levelError
+	case *verboseFlag:
+		logLevel = levelDebug
+	default:
+		level, ok := logLevels[*logLevelFlag]
+		if !ok {
+			fmt.Printf("lrt: -log-level must be one of error, info or debug. See lrt --help for details\n")
+			os.Exit(2)
+		}
+		logLevel = level
+	}
+
+	switch *restartFlag {
+	case "never", "on-failure", "always":
+	default:
+		fmt.Printf("lrt: -restart must be one of never, on-failure or always. See lrt --help for details\n")
+		os.Exit(2)
+	}
+
+	stopSignal, err = parseSignal(*stopSignalFlag)
+	if err != nil {
+		fmt.Printf("lrt: -stop-signal is invalid: %s. See lrt --help for details\n", err)
+		os.Exit(2)
+	}
+
+	reloadSignal, err = parseSignal(*reloadSignalFlag)
+	if err != nil {
+		fmt.Printf("lrt: -reload-signal is invalid: %s. See lrt --help for details\n", err)
+		os.Exit(2)
+	}
+	for _, pattern := range *reloadFlag {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			fmt.Printf("lrt: -reload %#v is invalid: %s. See lrt --help for details\n", pattern, err)
+			os.Exit(2)
+		}
+	}
+
+	if _, ok := editors[*editorFlag]; !ok && !strings.Contains(*editorFlag, "{file}") {
+		fmt.Printf("lrt: -editor must be one of vscode, cursor, idea, goland, sublime or textmate, or contain {file}. See lrt --help for details\n")
+		os.Exit(2)
+	}
+
+	mustLoadHints()
+
+	if *webhookFlag != "" {
+		if u, err := url.Parse(*webhookFlag); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			fmt.Printf("lrt: -webhook must be an http or https URL. See lrt --help for details\n")
+			os.Exit(2)
+		}
+	}
+
+	for _, kv := range *envFlag {
+		if !strings.Contains(kv, "=") || strings.HasPrefix(kv, "=") {
+			fmt.Printf("lrt: -env %#v is invalid: expected KEY=VALUE. See lrt --help for details\n", kv)
+			os.Exit(2)
+		}
+	}
+	for _, file := range *envFileFlag {
+		if _, err := parseEnvFile(file); err != nil {
+			fmt.Printf("lrt: -env-file is invalid: %s. See lrt --help for details\n", err)
+			os.Exit(2)
+		}
+	}
+
+	forwardSignals = map[os.Signal]syscall.Signal{
+		syscall.SIGUSR1: syscall.SIGUSR1,
+		syscall.SIGUSR2: syscall.SIGUSR2,
+		syscall.SIGHUP:  syscall.SIGHUP,
+	}
+	if len(*forwardSignalFlag) > 0 {
+		forwardSignals = map[os.Signal]syscall.Signal{}
+	}
+	for _, str := range *forwardSignalFlag {
+		if str == "none" {
+			continue
+		}
+		from, to, err := parseSignalMapping(str)
+		if err != nil {
+			fmt.Printf("lrt: -forward-signal is invalid: %s. See lrt --help for details\n", err)
+			os.Exit(2)
+		}
+		forwardSignals[from] = to
+	}
+
+	if isGoFiles(flag.Args()) {
+		packageName = strings.Join(flag.Args(), " ")
+		mustParseGoFiles(flag.Args())
+	} else if len(flag.Args()) > 1 {
+		fmt.Printf("lrt: expected one package, got %d: %s. See lrt --help for details\n", len(flag.Args()), strings.Join(flag.Args(), " "))
+		os.Exit(2)
+	} else {
+		if len(flag.Args()) == 1 {
+			packageName = flag.Args()[0]
+		} else if configPackage != "" {
+			packageName = configPackage
+		} else {
+			packageName = "."
+		}
+		mustImportPackage()
 	}
 
 	buildArgs, err = shellwords.Parse(*buildArgsFlag)
@@ -559,17 +1796,101 @@ https://github.com/superhuman/lrt
 		panic(err) // can only happen if shellwords.ParseBacktick is true, and it isn't
 	}
 
-	pattern := "lrt-service"
-	if *serviceNameFlag != "" {
-		pattern += "-" + *serviceNameFlag + "-"
+	execArgs, err = shellwords.Parse(*execFlag)
+	if err != nil {
+		panic(err) // can only happen if shellwords.ParseBacktick is true, and it isn't
+	}
+
+	if *debugFlag {
+		if len(execArgs) > 0 {
+			fmt.Printf("lrt: -debug and -exec cannot be used together. See lrt --help for details\n")
+			os.Exit(2)
+		}
+		if _, err := exec.LookPath("dlv"); err != nil {
+			fmt.Fprintln(os.Stderr, "lrt: -debug needs delve, but dlv is not in your $PATH")
+			fmt.Fprintln(os.Stderr, "     hint: install it with go install github.com/go-delve/delve/cmd/dlv@latest")
+			os.Exit(1)
+		}
+		// disable optimizations and inlining so the debugger can see everything
+		buildArgs = append(buildArgs, "-gcflags=all=-N -l")
+		execArgs = []string{"dlv", "exec", "--headless", "--accept-multiclient", "--api-version=2", "--continue", "--listen=" + *debugListenFlag}
+	}
+
+	if *shadowFlag > 0 && (serviceSocket != "" || *noProxyFlag) {
+		fmt.Printf("lrt: -shadow runs the new build on a second $PORT, so it cannot be used with -no-proxy or a unix socket. See lrt --help for details\n")
+		os.Exit(2)
+	}
+
+	if *replicasFlag < 1 {
+		fmt.Printf("lrt: -replicas must be at least 1. See lrt --help for details\n")
+		os.Exit(2)
+	}
+	if *replicasFlag > 1 {
+		if serviceSocket != "" || *noProxyFlag || *serviceFlag != "" || *detectPortFlag || *debugFlag || *remoteFlag != "" || *deployFlag != "" {
+			fmt.Printf("lrt: -replicas runs each copy here on its own $PORT, so it cannot be used with -no-proxy, -service, -detect-port, -debug, -remote or -deploy. See lrt --help for details\n")
+			os.Exit(2)
+		}
+		for i := 1; i < *replicasFlag; i++ {
+			replicaURLs = append(replicaURLs, generateServiceURL(serviceURL))
+		}
+	}
+
+	if *remoteFlag != "" && (len(execArgs) > 0 || *keepLastGoodFlag || *shadowFlag > 0 || *detectPortFlag || serviceSocket != "" || *serviceFlag != "") {
+		fmt.Printf("lrt: -remote cannot be used with -exec, -debug, -keep-last-good, -shadow, -detect-port or -service. See lrt --help for details\n")
+		os.Exit(2)
+	}
+
+	if *goosFlag != "" {
+		targetGoEnv = append(targetGoEnv, "GOOS="+*goosFlag)
+	}
+	if *goarchFlag != "" {
+		targetGoEnv = append(targetGoEnv, "GOARCH="+*goarchFlag)
+	}
+	if *deployFlag != "" && (*serviceFlag == "" || serviceSocket != "") {
+		fmt.Printf("lrt: -deploy needs -service to say where the deployed service listens, e.g. -service device.local:8080. See lrt --help for details\n")
+		os.Exit(2)
+	}
+	if *deployFlag != "" && (len(execArgs) > 0 || *remoteFlag != "" || *shadowFlag > 0 || *detectPortFlag) {
+		fmt.Printf("lrt: -deploy cannot be used with -exec, -debug, -remote, -shadow or -detect-port. See lrt --help for details\n")
+		os.Exit(2)
+	}
+	if *remoteFlag != "" && len(targetGoEnv) > 0 {
+		fmt.Printf("lrt: -remote builds for the remote host, so it cannot be used with -goos or -goarch. See lrt --help for details\n")
+		os.Exit(2)
+	}
+
+	if *ramBuildFlag && *remoteFlag != "" {
+		fmt.Printf("lrt: -ram-build cannot be used with -remote, which builds on the remote host. See lrt --help for details\n")
+		os.Exit(2)
 	}
+	mustFindRAMDir()
+	mustOpenBuildOutput()
+}
 
-	tmpFile, err = ioutil.TempFile("", pattern)
+// mustImportPackage checks that packageName can be found, and is package main
+func mustImportPackage() {
+	pkg, err := build.Default.Import(packageName, ".", 0)
+	// relative packages are found relative to ".", so pkg.Dir may be too
+	packageDir, _ = filepath.Abs(pkg.Dir)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "lrt: "+err.Error())
+		if strings.HasPrefix(err.Error(), "cannot find package") {
+			fmt.Fprintf(os.Stderr, "lrt: cannot find package %#v\n", packageName)
+			_, err = os.Stat(packageName)
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "     hint: go packages are specified by package name, e.g. \"github.com/superhuman/lrt\"\n")
+				fmt.Fprintf(os.Stderr, "           to use a relative directory start with ./, e.g. \"./lrt\"\n")
+			}
+			os.Exit(1)
+
+		} else {
+			fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+			os.Exit(1)
+		}
+	}
+	if pkg.Name != "main" {
+		fmt.Printf("lrt: %#v does not contain package \"main\".\n", packageName)
 		os.Exit(1)
 	}
-
 }
 
 // argToURL converts a go-style host:port pair into a URL, exiting early if the arg is invalid.
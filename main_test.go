@@ -1,18 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirkon/goproxy/gomod"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var baseListenURL = &url.URL{Scheme: "http", Host: "localhost:3000"}
@@ -24,6 +41,10 @@ var testPackagePath = packagePath + "/test"
 
 var executable string
 
+// cacheDir is the user cache directory for the lrts started by tests, so that
+// they don't leave builds in yours
+var cacheDir string
+
 func init() {
 	path, err := ioutil.TempFile("", "lrt-test")
 	if err != nil {
@@ -37,12 +58,31 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	// go's build cache is in the user cache directory too, so keep it where it is
+	goCache, err := exec.Command("go", "env", "GOCACHE").Output()
+	if err != nil {
+		panic(err)
+	}
+	cacheDir, err = ioutil.TempDir("", "lrt-test-cache")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("GOCACHE", strings.TrimSpace(string(goCache)))
+	os.Setenv("XDG_CACHE_HOME", cacheDir)
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	os.RemoveAll(cacheDir)
+	os.Exit(code)
 }
 
 func startLrtForTests(t *testing.T, args ...string) (*url.URL, func()) {
 	listenURL := generateServiceURL(baseListenURL)
 
-	args = append(args, "-listen", listenURL.Host, testPackagePath)
+	// so that tests don't fill up your build history (tests of it set -history again)
+	args = append(append([]string{"-history", "none"}, args...), "-listen", listenURL.Host, testPackagePath)
 
 	cmd := exec.Command(executable, args...)
 	cmd.Stdout = os.Stdout
@@ -111,6 +151,31 @@ func waitForFsNotify() {
 	time.Sleep(100 * time.Millisecond)
 }
 
+// waitForRebuild waits until lrt has noticed a change and started rebuilding,
+// which is at least -debounce after the change
+func waitForRebuild(t *testing.T, listenURL *url.URL) {
+	since := time.Now()
+	for deadline := since.Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(listenURL.String() + "/__lrt/status?format=json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page struct {
+			Events []event `json:"events"`
+		}
+		json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+
+		for _, e := range page.Events {
+			at, _ := time.Parse(time.RFC3339Nano, fmt.Sprint(e["time"]))
+			if e["type"] == "build-started" && at.After(since) {
+				return
+			}
+		}
+	}
+	t.Fatal("timeout: lrt did not start rebuilding")
+}
+
 func TestLrt(t *testing.T) {
 	listenURL, stop := startLrtForTests(t)
 	defer stop()
@@ -141,7 +206,7 @@ func TestLrt_Rebuild(t *testing.T) {
 		 }`),
 		0644)
 
-	waitForFsNotify()
+	waitForRebuild(t, listenURL)
 
 	response = getStringResponse(t, listenURL)
 	if response != "lrt/test: OVERRIDE" {
@@ -149,6 +214,173 @@ func TestLrt_Rebuild(t *testing.T) {
 	}
 }
 
+func TestLrt_EventStream(t *testing.T) {
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	resp, err := http.Get(listenURL.String() + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "data: lrt/test: OK\n" {
+		t.Errorf("Got unexpected event from lrt: %q", line)
+	}
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 func init() {
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected stream to end cleanly, got: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout: stream was not closed on rebuild")
+	}
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OVERRIDE" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
+func TestLrt_ProxyTimeout(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-proxy-header-timeout", "100ms")
+	defer stop()
+
+	resp, err := http.Get(listenURL.String() + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 from lrt, got %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), "-proxy-header-timeout") {
+		t.Errorf("Got unexpected response from lrt: %s", body)
+	}
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
+func TestLrt_ForwardedHeaders(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-forwarded-headers", "-host-header", "example.test")
+	defer stop()
+
+	response := getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/headers"})
+
+	for _, header := range []string{
+		"Host: example.test\r\n",
+		"X-Forwarded-Host: " + listenURL.Host + "\r\n",
+		"X-Forwarded-Proto: http\r\n",
+		"X-Forwarded-For: 127.0.0.1\r\n",
+		"X-Real-Ip: 127.0.0.1\r\n",
+	} {
+		if !strings.Contains(response, header) {
+			t.Errorf("Expected %q in headers, got:\n%s", header, response)
+		}
+	}
+}
+
+func TestLrt_CORS(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-cors")
+	defer stop()
+
+	req, _ := http.NewRequest("OPTIONS", listenURL.String()+"/", nil)
+	req.Header.Set("Origin", "http://localhost:8080")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected preflight to return 204, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Access-Control-Allow-Methods") != "PUT" || resp.Header.Get("Access-Control-Allow-Headers") != "Content-Type" {
+		t.Errorf("Got unexpected preflight headers from lrt: %v", resp.Header)
+	}
+
+	req, _ = http.NewRequest("GET", listenURL.String()+"/", nil)
+	req.Header.Set("Origin", "http://localhost:8080")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", body)
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" || resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("Expected any origin to be allowed without credentials, got: %v", resp.Header)
+	}
+}
+
+func TestCORSOrigin(t *testing.T) {
+	defer func(saved stringsFlag) { *corsOriginFlag = saved }(*corsOriginFlag)
+	*corsOriginFlag = stringsFlag{"http://localhost:8080"}
+
+	if origin, credentials := corsOrigin("http://LOCALHOST:8080"); origin != "http://LOCALHOST:8080" || !credentials {
+		t.Errorf("Expected a listed origin to be allowed with credentials, got: %q %v", origin, credentials)
+	}
+	if origin, _ := corsOrigin("http://evil.example"); origin != "" {
+		t.Errorf("Expected other origins not to be allowed, got: %q", origin)
+	}
+
+	*corsOriginFlag = append(*corsOriginFlag, "*")
+	if origin, credentials := corsOrigin("http://evil.example"); origin != "*" || credentials {
+		t.Errorf("Expected * to allow other origins without credentials, got: %q %v", origin, credentials)
+	}
+}
+
+func TestLrt_BasicAuth(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-basic-auth", "dev:secret")
+	defer stop()
+
+	resp, err := http.Get(listenURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", resp.StatusCode)
+	}
+
+	authedURL := *listenURL
+	authedURL.User = url.UserPassword("dev", "secret")
+	response := getStringResponse(t, &authedURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
 func TestLrt_BuildError(t *testing.T) {
 	defer os.Remove("test/override.go")
 	ioutil.WriteFile("test/override.go", []byte(
@@ -168,7 +400,7 @@ func TestLrt_BuildError(t *testing.T) {
 		`package main`),
 		0644)
 
-	waitForFsNotify()
+	waitForRebuild(t, listenURL)
 
 	response = getStringResponse(t, listenURL)
 	if response != "lrt/test: OK" {
@@ -176,6 +408,27 @@ func TestLrt_BuildError(t *testing.T) {
 	}
 }
 
+func TestLrt_HealthCheckBackoff(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 import "time"
+
+		 func init() {
+		 	time.Sleep(time.Second)
+		 }`),
+		0644)
+
+	listenURL, stop := startLrtForTests(t, "-health-check-delay", "100ms", "-health-check-interval", "10ms", "-health-check-max-interval", "200ms")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Expected a slow-starting service to become healthy, got: %s", response)
+	}
+}
+
 func TestLrt_BootError(t *testing.T) {
 	defer os.Remove("test/override.go")
 	ioutil.WriteFile("test/override.go", []byte(
@@ -200,7 +453,7 @@ func TestLrt_BootError(t *testing.T) {
 		`package main`),
 		0644)
 
-	waitForFsNotify()
+	waitForRebuild(t, listenURL)
 
 	response = getStringResponse(t, listenURL)
 	if response != "lrt/test: OK" {
@@ -234,7 +487,7 @@ func TestLrt_BootTimeout(t *testing.T) {
 		`package main`),
 		0644)
 
-	waitForFsNotify()
+	waitForRebuild(t, listenURL)
 
 	response = getStringResponse(t, listenURL)
 	if response != "lrt/test: OK" {
@@ -259,3 +512,3597 @@ func TestLrt_ServiceArg(t *testing.T) {
 		t.Errorf("Got unexpected response from lrt/test: %s", response)
 	}
 }
+
+func TestLrt_VersionVar(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		var buildVersion string
+
+		func init() {
+			response = "version: " + buildVersion
+		}
+		`),
+		0644)
+
+	listenURL, stop := startLrtForTests(t, "-version-var", "main.buildVersion")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if !strings.HasPrefix(response, "version: ") || response == "version: " {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
+func TestWithLdflags(t *testing.T) {
+	cases := []struct {
+		args     []string
+		expected []string
+	}{
+		{nil, []string{"-ldflags", "-X a.b=c"}},
+		{[]string{"-race"}, []string{"-race", "-ldflags", "-X a.b=c"}},
+		{[]string{"-ldflags", "-s"}, []string{"-ldflags", "-s -X a.b=c"}},
+		{[]string{"-ldflags=-s", "-race"}, []string{"-ldflags=-s -X a.b=c", "-race"}},
+		{[]string{"--ldflags=-s"}, []string{"--ldflags=-s -X a.b=c"}},
+	}
+
+	for _, c := range cases {
+		result := withLdflags(c.args, "-X a.b=c")
+		if !reflect.DeepEqual(result, c.expected) {
+			t.Errorf("withLdflags(%#v): got %#v, expected %#v", c.args, result, c.expected)
+		}
+	}
+}
+
+func TestLrt_GoFlag(t *testing.T) {
+	goBinary, err := exec.LookPath("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listenURL, stop := startLrtForTests(t, "-go", goBinary)
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
+func TestDebounceCallable(t *testing.T) {
+	var calls int32
+	debounced := debounceCallable(50*time.Millisecond, 0, func() {
+		atomic.AddInt32(&calls, 1)
+	})
+
+	for i := 0; i < 10; i++ {
+		debounced()
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Expected 1 call after changes settled, got %d", n)
+	}
+}
+
+func TestDebounceCallable_MaxDelay(t *testing.T) {
+	var calls int32
+	debounced := debounceCallable(50*time.Millisecond, 100*time.Millisecond, func() {
+		atomic.AddInt32(&calls, 1)
+	})
+
+	for i := 0; i < 30; i++ {
+		debounced()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&calls); n < 2 {
+		t.Errorf("Expected calls while changes were ongoing, got %d", n)
+	}
+}
+
+func TestLrt_HealthCheckTCP(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		func init() {
+			status = 503
+		}
+		`),
+		0644)
+
+	listenURL, stop := startLrtForTests(t, "-health-check", "tcp", "-health-check-timeout", "2s")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
+func TestLrt_HealthCheckCmd(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		func init() {
+			status = 503
+		}
+		`),
+		0644)
+
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl is not installed")
+	}
+
+	listenURL, stop := startLrtForTests(t, "-health-check-cmd", "curl -s -o /dev/null http://localhost:$PORT/", "-health-check-timeout", "2s")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
+func TestIsHealthy_GRPC(t *testing.T) {
+	servingStatus := byte(1)
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.ProtoMajor != 2 || r.URL.Path != "/grpc.health.v1.Health/Check" || string(body[5:]) != "\x0a\x04test" {
+			w.Header().Set("Grpc-Status", "12")
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, servingStatus})
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	serviceURL = serverURL
+	healthCheckURL = &url.URL{Scheme: "grpc", Host: serverURL.Host, Path: "/test"}
+	defer func() { serviceURL, healthCheckURL = nil, nil }()
+
+	if !isHealthy(healthCheckURL) {
+		t.Errorf("Expected SERVING gRPC service to be healthy")
+	}
+
+	servingStatus = 2
+	if isHealthy(healthCheckURL) {
+		t.Errorf("Expected NOT_SERVING gRPC service not to be healthy")
+	}
+
+	healthCheckURL.Path = "/other"
+	servingStatus = 1
+	if isHealthy(healthCheckURL) {
+		t.Errorf("Expected unknown gRPC service not to be healthy")
+	}
+}
+
+func TestLrt_HealthCheckMatching(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		func init() {
+			status = 503
+		}
+		`),
+		0644)
+
+	listenURL, stop := startLrtForTests(t,
+		"-health-check-method", "POST",
+		"-health-check-header", "Authorization: Bearer dev",
+		"-health-check-status", "200-299,503",
+		"-health-check-body", "OK",
+		"-health-check-timeout", "2s")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
+func TestParseStatusRanges(t *testing.T) {
+	ranges, err := parseStatusRanges("200-299, 304")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for code, expected := range map[int]bool{199: false, 200: true, 299: true, 300: false, 304: true} {
+		if ranges.contains(code) != expected {
+			t.Errorf("Expected contains(%d) to be %v", code, expected)
+		}
+	}
+
+	if _, err := parseStatusRanges("2xx"); err == nil {
+		t.Errorf("Expected an error for an invalid status code")
+	}
+}
+
+func TestLrt_ReadyLogPattern(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		import (
+			"fmt"
+			"net"
+			"os"
+			"time"
+		)
+
+		func init() {
+			status = 503
+			go func() {
+				for {
+					conn, err := net.Dial("tcp", "localhost:"+os.Getenv("PORT"))
+					if err == nil {
+						conn.Close()
+						fmt.Println("lrt/test: listening")
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+		}
+		`),
+		0644)
+
+	listenURL, stop := startLrtForTests(t, "-ready-log-pattern", "lrt/test: listen", "-health-check-timeout", "2s")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
+func TestLrt_DetectPort(t *testing.T) {
+	anotherURL := generateServiceURL(baseListenURL)
+
+	listenURL, stop := startLrtForTests(t, "-cmd-args", "-override-port "+anotherURL.Port(), "-detect-port", "-health-check-timeout", "2s")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+
+	// -pprof is on the service, so it should follow it to the detected port
+	response = getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/pprof/cmdline"})
+	if !strings.Contains(response, anotherURL.Port()) {
+		t.Errorf("Expected /__lrt/pprof/ to be forwarded to the detected port, got: %s", response)
+	}
+}
+
+func TestLrt_NoProxy(t *testing.T) {
+	serviceURL := generateServiceURL(baseListenURL)
+
+	cmd := exec.Command(executable, "-no-proxy", "-cmd-args", "-override-port "+serviceURL.Port(), testPackagePath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Process.Wait()
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(serviceURL.String())
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Errorf("timeout: service did not boot under lrt -no-proxy"))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	response := getStringResponse(t, serviceURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt/test: %s", response)
+	}
+}
+
+func TestLrt_JSONOutput(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 import "fmt"
+
+		 func init() {
+		 	fmt.Println("lrt/test: starting")
+		 }`),
+		0644)
+
+	cmd := exec.Command(executable, "-history", "none", "-json", "-replicas", "2", "-listen", generateServiceURL(baseListenURL).Host, testPackagePath)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Process.Wait()
+	}()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	// the replicas are started once the service is healthy
+	timeout, healthy := time.After(10*time.Second), (<-chan time.Time)(nil)
+	for {
+		select {
+		case line := <-lines:
+			var e map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("Expected only events on stdout with -json, got: %s", line)
+			}
+			if e["type"] == "service-healthy" {
+				healthy = time.After(time.Second)
+			}
+		case <-healthy:
+			return
+		case <-timeout:
+			t.Fatalf("timeout: lrt -json did not report the service-healthy event")
+		}
+	}
+}
+
+func TestLrtTest(t *testing.T) {
+	cmd := exec.Command(executable, "test", testPackagePath)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Process.Wait()
+	}()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	waitForLine := func(prefix string) {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case line := <-lines:
+				if strings.HasPrefix(line, prefix) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timeout: lrt test did not print %#v", prefix)
+			}
+		}
+	}
+
+	waitForLine("lrt: PASS")
+
+	defer os.Remove("test/override_test.go")
+	ioutil.WriteFile("test/override_test.go", []byte(
+		`package main
+
+		import "testing"
+
+		func TestFail(t *testing.T) {
+			t.Fail()
+		}
+		`),
+		0644)
+
+	waitForLine("lrt: FAIL")
+}
+
+func TestLrt_ListenUnixSocket(t *testing.T) {
+	socket := fmt.Sprintf("%s/lrt-test-%d.sock", os.TempDir(), os.Getpid())
+
+	cmd := exec.Command(executable, "-listen", "unix:"+socket, testPackagePath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+
+	deadline := time.Now().Add(10 * time.Second)
+	var resp *http.Response
+	for {
+		resp, err = client.Get("http://lrt/")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Errorf("timeout: lrt did not listen on %s", socket))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", body)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Process.Wait()
+
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected lrt to remove %s on exit", socket)
+	}
+}
+
+func TestLrt_ServiceUnixSocket(t *testing.T) {
+	socket := fmt.Sprintf("%s/lrt-test-service-%d.sock", os.TempDir(), os.Getpid())
+
+	listenURL, stop := startLrtForTests(t, "-service", "unix:"+socket)
+	defer func() {
+		stop()
+		if _, err := os.Stat(socket); !os.IsNotExist(err) {
+			t.Errorf("Expected lrt to remove %s on exit", socket)
+		}
+	}()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+
+	// the rebuilt service can only listen once the old socket is removed
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 func init() {
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+	waitForRebuild(t, listenURL)
+
+	response = getStringResponse(t, listenURL)
+	if response != "lrt/test: OVERRIDE" {
+		t.Errorf("Got unexpected response from lrt after rebuilding: %s", response)
+	}
+}
+
+func TestLrt_TLS(t *testing.T) {
+	if _, err := exec.LookPath("mkcert"); err == nil {
+		t.Skip("mkcert is installed, so lrt would use it instead of a self-signed certificate")
+	}
+
+	listenURL, stop := startLrtForTests(t, "-tls")
+	defer stop()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + listenURL.Host + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if string(body) != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", body)
+	}
+	if len(resp.TLS.PeerCertificates) == 0 || resp.TLS.PeerCertificates[0].VerifyHostname("localhost") != nil {
+		t.Errorf("Expected a certificate for localhost")
+	}
+}
+
+func TestCertificateName(t *testing.T) {
+	if certificateName([]string{"localhost", "a.test"}) != certificateName([]string{"a.test", "localhost"}) {
+		t.Errorf("Expected the certificate name not to depend on the order of the hosts")
+	}
+	if certificateName([]string{"localhost", "a.test"}) == certificateName([]string{"localhost", "a.test", "b.test"}) {
+		t.Errorf("Expected a new certificate name when a host is added")
+	}
+}
+
+func TestLrt_ServiceSchemeHTTPS(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-service-scheme", "https", "-cmd-args", "-tls")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
+func TestFormatAccessLog(t *testing.T) {
+	r := httptest.NewRequest("GET", "/users?page=2", nil)
+	r.RemoteAddr = "127.0.0.1:51234"
+	r.Header.Set("User-Agent", "curl/8.0")
+	start := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	line := formatAccessLog("combined", r, 200, 512, start, 12*time.Millisecond, 3)
+	expected := `127.0.0.1 - - [02/Jan/2020:15:04:05 +0000] "GET /users?page=2 HTTP/1.1" 200 512 "-" "curl/8.0"`
+	if line != expected {
+		t.Errorf("Got unexpected combined log line:\n%s\nexpected:\n%s", line, expected)
+	}
+
+	line = formatAccessLog("json", r, 404, 0, start, 12*time.Millisecond, 3)
+	for _, field := range []string{`"method":"GET"`, `"path":"/users?page=2"`, `"status":404`, `"duration_ms":12`, `"build":3`} {
+		if !strings.Contains(line, field) {
+			t.Errorf("Expected %s in json log line: %s", field, line)
+		}
+	}
+
+	line = formatAccessLog("short", r, 200, 512, start, 12*time.Millisecond, 3)
+	if line != "lrt: GET /users?page=2 200 12ms 512B (build 3)" {
+		t.Errorf("Got unexpected short log line: %s", line)
+	}
+}
+
+func TestLrt_Capture(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-capture", "10")
+	defer stop()
+
+	resp, err := http.Post(listenURL.String()+"/?q=1", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(listenURL.String() + "/__lrt/requests.har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var har struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					Method   string
+					URL      string
+					PostData struct{ Text string }
+				}
+				Response struct {
+					Status  int
+					Content struct{ Text string }
+				}
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&har); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(har.Log.Entries) != 1 {
+		t.Fatalf("Expected 1 captured request, got %d", len(har.Log.Entries))
+	}
+	entry := har.Log.Entries[0]
+	if entry.Request.Method != "POST" || !strings.HasSuffix(entry.Request.URL, "/?q=1") || entry.Request.PostData.Text != "hello" {
+		t.Errorf("Got unexpected captured request: %+v", entry.Request)
+	}
+	if entry.Response.Status != 200 || entry.Response.Content.Text != "lrt/test: OK" {
+		t.Errorf("Got unexpected captured response: %+v", entry.Response)
+	}
+}
+
+func TestLrt_InjectFaults(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-inject-latency", "300ms", "-inject-error-rate", "1")
+	defer stop()
+
+	start := time.Now()
+	resp, err := http.Get(listenURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if time.Since(start) < 300*time.Millisecond {
+		t.Errorf("Expected request to be delayed, took %s", time.Since(start))
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected injected 503, got %d", resp.StatusCode)
+	}
+}
+
+func TestLrt_ServeStale(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-serve-stale")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 import "time"
+
+		 func init() {
+		 	time.Sleep(2 * time.Second)
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(listenURL.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.Header.Get("X-Lrt-Stale") == "true" {
+			if string(body) != "lrt/test: OK" {
+				t.Errorf("Got unexpected stale response from lrt: %s", body)
+			}
+			break
+		}
+		if string(body) == "lrt/test: OVERRIDE" || time.Now().After(deadline) {
+			t.Fatal("Expected a stale response while rebuilding")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for {
+		resp, err := http.Get(listenURL.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.Header.Get("X-Lrt-Stale") == "" {
+			if string(body) != "lrt/test: OVERRIDE" {
+				t.Errorf("Got unexpected response from lrt: %s", body)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a fresh response once rebuilt")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestLrt_MaxQueueWait(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-max-queue-wait", "200ms")
+	defer stop()
+
+	// the first build may well take longer than 200ms
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		response := getStringResponse(t, listenURL)
+		if response == "lrt/test: OK" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got unexpected response from lrt: %s", response)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 import "time"
+
+		 func init() {
+		 	time.Sleep(2 * time.Second)
+		 }`),
+		0644)
+
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(listenURL.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			if resp.Header.Get("Retry-After") == "" {
+				t.Errorf("Expected a Retry-After header, got: %v", resp.Header)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a 503 while rebuilding")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestLrt_RetryAfterExit(t *testing.T) {
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	resp, err := http.Post(listenURL.String()+"/exit", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// POST requests are not retried
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 from lrt, got %d", resp.StatusCode)
+	}
+
+	responseCh := make(chan string, 1)
+	go func() {
+		responseCh <- getStringResponse(t, listenURL)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 func init() {
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+
+	select {
+	case response := <-responseCh:
+		if response != "lrt/test: OVERRIDE" {
+			t.Errorf("Got unexpected response from lrt: %s", response)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout: request was not retried")
+	}
+}
+
+func TestLrt_Drain(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-drain", "200ms")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+
+	statusCh := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(listenURL.String() + "/slow")
+		if err != nil {
+			statusCh <- 0
+			return
+		}
+		resp.Body.Close()
+		statusCh <- resp.StatusCode
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 func init() {
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+
+	if status := <-statusCh; status != http.StatusServiceUnavailable {
+		t.Errorf("Expected slow request to be cancelled with a 503, got %d", status)
+	}
+
+	response = getStringResponse(t, listenURL)
+	if response != "lrt/test: OVERRIDE" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for str, expected := range map[string]syscall.Signal{
+		"TERM":    syscall.SIGTERM,
+		"SIGINT":  syscall.SIGINT,
+		"quit":    syscall.SIGQUIT,
+		"sigusr1": syscall.SIGUSR1,
+		"9":       syscall.SIGKILL,
+	} {
+		sig, err := parseSignal(str)
+		if err != nil || sig != expected {
+			t.Errorf("parseSignal(%#v) = %v, %v; expected %v", str, sig, err, expected)
+		}
+	}
+
+	if _, err := parseSignal("NOPE"); err == nil {
+		t.Errorf("Expected an error for an unknown signal")
+	}
+}
+
+func TestLrt_KillProcessGroup(t *testing.T) {
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	response := getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/spawn"})
+	pid, err := strconv.Atoi(response)
+	if err != nil {
+		t.Fatalf("Got unexpected response from lrt: %s", response)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 func init() {
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+
+	waitForRebuild(t, listenURL)
+	getStringResponse(t, listenURL)
+
+	// once killed, the child may be a zombie until it is reaped.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stat, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if syscall.Kill(pid, 0) != nil || strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the service's child process to be killed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestLrt_RestartOnFailure(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-restart", "on-failure", "-retry=false")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+
+	resp, err := http.Post(listenURL.String()+"/exit", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		time.Sleep(100 * time.Millisecond)
+		response = getStringResponse(t, listenURL)
+		if response == "lrt/test: OK" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the service to be restarted, got: %s", response)
+		}
+	}
+}
+
+func TestLrt_CrashLoop(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 import (
+		 	"fmt"
+		 	"os"
+		 	"time"
+		 )
+
+		 func init() {
+		 	go func() {
+		 		time.Sleep(200 * time.Millisecond)
+		 		fmt.Println("lrt/test: crashing")
+		 		os.Exit(3)
+		 	}()
+		 }`),
+		0644)
+
+	listenURL, stop := startLrtForTests(t, "-restart", "always", "-retry=false")
+	defer stop()
+
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		response := getStringResponse(t, listenURL)
+		if strings.Contains(response, "service keeps exiting (exit status 3)") {
+			if !strings.Contains(response, "lrt/test: crashing") {
+				t.Errorf("Expected the error to include the service's output, got: %s", response)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected lrt to detect the crash loop, got: %s", response)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestLrt_BootErrorOutput(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		func init() {
+			panic("oops")
+		}
+		`),
+		0644)
+
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+
+	if !strings.Contains(response, "(exit status 2)") {
+		t.Errorf("Expected the exit status in the response from lrt: %s", response)
+	}
+	if !strings.Contains(response, "panic: oops") {
+		t.Errorf("Expected the service's output in the response from lrt: %s", response)
+	}
+}
+
+func TestLrt_Logs(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 import "fmt"
+
+		 func init() {
+		 	fmt.Println("lrt/test: hello")
+		 }`),
+		0644)
+
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	getStringResponse(t, listenURL)
+	logsURL := &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/logs", RawQuery: "format=json"}
+
+	resp, err := http.Get(logsURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []logLine
+	err = json.NewDecoder(resp.Body).Decode(&lines)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hello *logLine
+	for i, line := range lines {
+		if line.Text == "lrt/test: hello" && line.Source == "stdout" {
+			hello = &lines[i]
+		}
+	}
+	if hello == nil {
+		t.Fatalf("Got unexpected logs from lrt: %+v", lines)
+	}
+
+	logsURL.RawQuery = "since=" + strconv.FormatInt(lines[len(lines)-1].ID, 10)
+	response := getStringResponse(t, logsURL)
+	if response != "" {
+		t.Errorf("Expected no logs since the last line, got: %s", response)
+	}
+}
+
+func TestLrt_LogStream(t *testing.T) {
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	getStringResponse(t, listenURL)
+
+	resp, err := http.Get(listenURL.String() + "/__lrt/logs/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 import "fmt"
+
+		 func init() {
+		 	fmt.Println("lrt/test: streamed")
+		 }`),
+		0644)
+
+	found := make(chan []string, 1)
+	go func() {
+		var sources []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var line logLine
+			if !strings.HasPrefix(scanner.Text(), "data: ") || json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &line) != nil {
+				continue
+			}
+			sources = append(sources, line.Source+": "+line.Text)
+			if line.Text == "lrt/test: streamed" {
+				break
+			}
+		}
+		found <- sources
+	}()
+
+	select {
+	case sources := <-found:
+		if len(sources) < 2 || !strings.HasPrefix(sources[0], "lrt: lrt: rebuilding (") || sources[len(sources)-1] != "stdout: lrt/test: streamed" {
+			t.Errorf("Got unexpected log stream from lrt: %v", sources)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout: log line was not streamed")
+	}
+}
+
+func TestLogBuffer_Empty(t *testing.T) {
+	defer func(size int) { *logBufferFlag = size }(*logBufferFlag)
+	*logBufferFlag = 0
+
+	b := &logBuffer{}
+	ch := b.subscribe()
+	b.add("stdout", "hello")
+
+	if lines := b.since(0, time.Time{}); len(lines) != 0 {
+		t.Errorf("Expected -log-buffer 0 to keep nothing, got: %v", lines)
+	}
+	select {
+	case line := <-ch:
+		if line.Text != "hello" {
+			t.Errorf("Got unexpected line from the stream: %v", line)
+		}
+	default:
+		t.Errorf("Expected the line to be streamed anyway")
+	}
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	output := []byte("# github.com/superhuman/lrt/test\n" +
+		"test/override.go:1:14: syntax error: unexpected name syntax\n" +
+		"./main.go:12: undefined: foo\n")
+
+	expected := []diagnostic{
+		{File: "test/override.go", Line: 1, Column: 14, Message: "syntax error: unexpected name syntax"},
+		{File: "./main.go", Line: 12, Message: "undefined: foo"},
+	}
+	if diagnostics := parseDiagnostics(output); !reflect.DeepEqual(diagnostics, expected) {
+		t.Errorf("Got unexpected diagnostics: %+v", diagnostics)
+	}
+}
+
+func TestLrt_EventsSocket(t *testing.T) {
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-events-test-%d.sock", os.Getpid()))
+	listenURL, stop := startLrtForTests(t, "-events-socket", socket)
+	defer stop()
+
+	getStringResponse(t, listenURL)
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(`package main`), 0644)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var types []string
+	exited := false
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var e struct {
+			Type     string
+			Expected bool
+		}
+		json.Unmarshal(scanner.Bytes(), &e)
+		// the old service exits at some point while the new one is built
+		if e.Type == "service-exited" {
+			exited = e.Expected
+			continue
+		}
+		types = append(types, e.Type)
+		if e.Type == "service-healthy" {
+			break
+		}
+	}
+
+	expected := []string{"build-started", "build-succeeded", "service-started", "service-healthy"}
+	if !reflect.DeepEqual(types, expected) || !exited {
+		t.Errorf("Got unexpected events from lrt: %v (service-exited: %v)", types, exited)
+	}
+}
+
+func TestLrt_ControlSocket(t *testing.T) {
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-control-test-%d.sock", os.Getpid()))
+	listenURL, stop := startLrtForTests(t, "-control-socket", socket)
+	defer stop()
+
+	getStringResponse(t, listenURL)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	control := func(method string, path string) map[string]interface{} {
+		req, _ := http.NewRequest(method, "http://lrt"+path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return status
+	}
+
+	status := control("GET", "/status")
+	if status["state"] != "ready" || status["build"] != 1.0 || status["watched_dirs"].(float64) < 1 {
+		t.Errorf("Got unexpected status from lrt: %v", status)
+	}
+	pid := status["pid"]
+
+	status = control("POST", "/restart")
+	if status["state"] != "ready" || status["build"] != 1.0 || status["pid"] == pid {
+		t.Errorf("Expected the service to be restarted without rebuilding: %v", status)
+	}
+
+	status = control("POST", "/pause")
+	if status["paused"] != true {
+		t.Errorf("Expected lrt to be paused: %v", status)
+	}
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 func init() {
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+	waitForFsNotify()
+	time.Sleep(200 * time.Millisecond)
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Expected changes to be ignored while paused, got: %s", response)
+	}
+
+	control("POST", "/resume")
+	time.Sleep(100 * time.Millisecond)
+	response = getStringResponse(t, listenURL)
+	if response != "lrt/test: OVERRIDE" {
+		t.Errorf("Expected lrt to rebuild on resume, got: %s", response)
+	}
+}
+
+func TestCurrentStatus_Restarting(t *testing.T) {
+	defer func(u *url.URL) { serviceURL = u }(serviceURL)
+	serviceURL = &url.URL{Scheme: "http", Host: "localhost:3001"}
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+	atomic.StoreInt32(&restarting, 1)
+	defer atomic.StoreInt32(&restarting, 0)
+
+	done := make(chan status, 1)
+	go func() { done <- currentStatus() }()
+	select {
+	case s := <-done:
+		if s.State != "restarting" {
+			t.Errorf("Expected the status to say lrt is restarting, got: %s", s.State)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the status not to wait for the restart")
+	}
+}
+
+func TestHandleKey_Pause(t *testing.T) {
+	defer atomic.StoreInt32(&paused, 0)
+
+	handleKey('p')
+	if atomic.LoadInt32(&paused) != 1 {
+		t.Errorf("Expected p to pause watching")
+	}
+	handleKey('p')
+	if atomic.LoadInt32(&paused) != 0 {
+		t.Errorf("Expected p to resume watching")
+	}
+}
+
+func TestLineWriter_Prefix(t *testing.T) {
+	out := &bytes.Buffer{}
+	lines := []string{}
+	w := &lineWriter{
+		out:    out,
+		onLine: func(line string) { lines = append(lines, line) },
+		prefix: func() string { return "[api] " },
+	}
+
+	w.Write([]byte("one\ntw"))
+	if out.String() != "[api] one\n" {
+		t.Errorf("Expected partial lines to be held back, got: %q", out.String())
+	}
+	w.Write([]byte("o\r\n"))
+	if out.String() != "[api] one\n[api] two\n" {
+		t.Errorf("Expected each line to be prefixed, got: %q", out.String())
+	}
+	if len(lines) != 2 || lines[1] != "two" {
+		t.Errorf("Expected lines without prefixes, got: %q", lines)
+	}
+}
+
+func TestLineWriter_PartialLines(t *testing.T) {
+	out := &bytes.Buffer{}
+	lines := make(chan string, 10)
+	w := &lineWriter{
+		out:    out,
+		onLine: func(line string) { lines <- line },
+		prefix: func() string { return "[api] " },
+	}
+
+	w.Write([]byte("> "))
+	select {
+	case line := <-lines:
+		if line != "> " {
+			t.Errorf("Expected the prompt as a line, got: %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a prompt to be written once the output is idle")
+	}
+
+	w.Write(bytes.Repeat([]byte("x"), partialLineLimit))
+	if line := <-lines; len(line) != partialLineLimit {
+		t.Errorf("Expected a long partial line to be written straight away, got %d bytes", len(line))
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.partial) != 0 || !strings.HasPrefix(out.String(), "[api] > \n[api] xxx") {
+		t.Errorf("Got unexpected output: %q", out.String()[:20])
+	}
+}
+
+func TestParseSignalMapping(t *testing.T) {
+	from, to, err := parseSignalMapping("USR1")
+	if err != nil || from != syscall.SIGUSR1 || to != syscall.SIGUSR1 {
+		t.Errorf("Expected USR1 to be forwarded as is, got %v, %v, %v", from, to, err)
+	}
+
+	from, to, err = parseSignalMapping("HUP=USR2")
+	if err != nil || from != syscall.SIGHUP || to != syscall.SIGUSR2 {
+		t.Errorf("Expected HUP to be forwarded as USR2, got %v, %v, %v", from, to, err)
+	}
+
+	if _, _, err := parseSignalMapping("TERM"); err == nil {
+		t.Errorf("Expected an error for a signal lrt handles itself")
+	}
+	if _, _, err := parseSignalMapping("HUP=NOPE"); err == nil {
+		t.Errorf("Expected an error for an unknown signal")
+	}
+}
+
+func TestLrt_Reload(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-reload", "test/*.yaml")
+	defer stop()
+
+	reloadsURL := &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/reloads"}
+	response := getStringResponse(t, reloadsURL)
+	if response != "0" {
+		t.Fatalf("Got unexpected response from lrt: %s", response)
+	}
+
+	defer os.Remove("test/config.yaml")
+	ioutil.WriteFile("test/config.yaml", []byte("reload: true\n"), 0644)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for response != "1" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		response = getStringResponse(t, reloadsURL)
+	}
+	if response != "1" {
+		t.Errorf("Expected the service to be sent SIGHUP without being rebuilt, got: %s", response)
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	file := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-test-%d.env", os.Getpid()))
+	defer os.Remove(file)
+	ioutil.WriteFile(file, []byte(`# comment
+PLAIN=value # trailing comment
+export EXPORTED=yes
+
+DOUBLE="a \"quoted\"\nvalue"
+SINGLE='no $escapes\n'
+EMPTY=
+`), 0644)
+
+	vars, err := parseEnvFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][2]string{
+		{"PLAIN", "value"},
+		{"EXPORTED", "yes"},
+		{"DOUBLE", "a \"quoted\"\nvalue"},
+		{"SINGLE", `no $escapes\n`},
+		{"EMPTY", ""},
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %q, got %q", expected, vars)
+	}
+
+	ioutil.WriteFile(file, []byte("NOT A VAR\n"), 0644)
+	if _, err := parseEnvFile(file); err == nil || !strings.Contains(err.Error(), ".env:1:") {
+		t.Errorf("Expected an error with the line number, got: %v", err)
+	}
+}
+
+func TestLrt_Dotenv(t *testing.T) {
+	defer os.Remove(".env")
+	ioutil.WriteFile(".env", []byte("LRT_TEST_DOTENV=one\n"), 0644)
+
+	listenURL, stop := startLrtForTests(t, "-dotenv")
+	defer stop()
+
+	envURL := &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/env", RawQuery: "name=LRT_TEST_DOTENV"}
+	response := getStringResponse(t, envURL)
+	if response != "one" {
+		t.Fatalf("Expected .env to be loaded, got: %s", response)
+	}
+
+	ioutil.WriteFile(".env", []byte("LRT_TEST_DOTENV=two\n"), 0644)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for response != "two" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		response = getStringResponse(t, envURL)
+	}
+	if response != "two" {
+		t.Errorf("Expected the service to be restarted when .env changed, got: %s", response)
+	}
+}
+
+func TestLrt_Env(t *testing.T) {
+	defer os.Remove(".env")
+	ioutil.WriteFile(".env", []byte("LRT_TEST_ENV=dotenv\n"), 0644)
+
+	listenURL, stop := startLrtForTests(t, "-dotenv", "-env", "LRT_TEST_ENV=flag")
+	defer stop()
+
+	response := getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/env", RawQuery: "name=LRT_TEST_ENV"})
+	if response != "flag" {
+		t.Errorf("Expected -env to override .env, got: %s", response)
+	}
+}
+
+func TestLrt_Exec(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-exec", "env LRT_TEST_EXEC=wrapped")
+	defer stop()
+
+	response := getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/env", RawQuery: "name=LRT_TEST_EXEC"})
+	if response != "wrapped" {
+		t.Errorf("Expected the service to be run under -exec, got: %s", response)
+	}
+}
+
+func TestLrt_Pprof(t *testing.T) {
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	getStringResponse(t, listenURL)
+	var status struct{ Binary string }
+	json.Unmarshal([]byte(getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/status", RawQuery: "format=json"})), &status)
+	response := getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/pprof/cmdline"})
+	if status.Binary == "" || !strings.HasPrefix(response, status.Binary) {
+		t.Errorf("Expected /__lrt/pprof/ to be forwarded to the service's pprof, got: %s", response)
+	}
+}
+
+func TestPprofURL(t *testing.T) {
+	defer func(flag string, u *url.URL) { *pprofFlag, serviceURL = flag, u }(*pprofFlag, serviceURL)
+	serviceURL = &url.URL{Scheme: "http", Host: "localhost:12345"}
+
+	for flag, expected := range map[string]string{
+		"/debug/pprof/":             "http://localhost:12345/debug/pprof/",
+		"/pprof":                    "http://localhost:12345/pprof/",
+		":6060":                     "http://localhost:6060/debug/pprof/",
+		"localhost:6060/prof/":      "http://localhost:6060/prof/",
+		"127.0.0.1:6060/debug/prof": "http://127.0.0.1:6060/debug/prof/",
+	} {
+		*pprofFlag = flag
+		if u := pprofURL().String(); u != expected {
+			t.Errorf("pprofURL() for %#v = %s; expected %s", flag, u, expected)
+		}
+	}
+}
+
+func TestLrt_Metrics(t *testing.T) {
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	getStringResponse(t, listenURL)
+
+	// the request's duration is observed just after its response is sent
+	metricsURL := &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/metrics"}
+	response := getStringResponse(t, metricsURL)
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(response, "lrt_request_duration_seconds_count 1\n") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		response = getStringResponse(t, metricsURL)
+	}
+	for _, expected := range []string{
+		"lrt_rebuilds_total 1\n",
+		"lrt_build_failures_total 0\n",
+		"lrt_build_duration_seconds_count 1\n",
+		"lrt_boot_duration_seconds_count 1\n",
+		"lrt_request_duration_seconds_count 1\n",
+		"# TYPE lrt_queue_wait_seconds histogram\n",
+	} {
+		if !strings.Contains(response, expected) {
+			t.Errorf("Expected metrics to contain %q, got: %s", expected, response)
+		}
+	}
+}
+
+func TestLrt_StatusPage(t *testing.T) {
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	getStringResponse(t, listenURL)
+
+	var page struct {
+		State  string
+		Build  int
+		Events []map[string]interface{}
+	}
+	response := getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/status", RawQuery: "format=json"})
+	if err := json.Unmarshal([]byte(response), &page); err != nil {
+		t.Fatalf("Got unexpected response from lrt: %s", response)
+	}
+	if page.State != "ready" || page.Build != 1 {
+		t.Errorf("Expected the service to be ready after the first build, got: %s", response)
+	}
+	if len(page.Events) == 0 || page.Events[0]["type"] != "service-healthy" {
+		t.Errorf("Expected the most recent event first, got: %s", response)
+	}
+
+	response = getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/status"})
+	if !strings.Contains(response, "build-succeeded") || !strings.Contains(response, "/__lrt/status/stream") {
+		t.Errorf("Expected the status page to list events, got: %s", response)
+	}
+}
+
+func TestSummarizeHistory(t *testing.T) {
+	entries := []historyEntry{}
+	for i, ms := range []int64{300, 100, 200, 1000, 400} {
+		entries = append(entries, historyEntry{Duration: ms, Success: i != 3})
+	}
+	summary := summarizeHistory(entries)
+	expected := "5 builds (1 failed), median 300ms, p90 400ms, 2s in total"
+	if summary != expected {
+		t.Errorf("Expected %q, got %q", expected, summary)
+	}
+	if summarizeHistory(nil) != "no builds" {
+		t.Errorf("Expected no builds, got %q", summarizeHistory(nil))
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	history := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-trim-test-%d.jsonl", os.Getpid()))
+	defer os.Remove(history)
+	ioutil.WriteFile(history, []byte("1\n2\n3\n4\n"), 0644)
+
+	defer func(limit int) { historyLimit = limit }(historyLimit)
+	historyLimit = 3
+	if err := trimHistory(history); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(history); string(data) != "2\n3\n4\n" {
+		t.Errorf("Expected the last 3 builds to be kept, got: %q", data)
+	}
+}
+
+func TestLrt_History(t *testing.T) {
+	history := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-history-test-%d.jsonl", os.Getpid()))
+	defer os.Remove(history)
+
+	listenURL, stop := startLrtForTests(t, "-history", history)
+	defer stop()
+
+	getStringResponse(t, listenURL)
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 func init() {
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+	waitForRebuild(t, listenURL)
+	getStringResponse(t, listenURL)
+
+	// the request can arrive before the rebuild starts
+	entries, err := readHistory(history, time.Time{})
+	for deadline := time.Now().Add(10 * time.Second); err == nil && len(entries) < 2 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		entries, err = readHistory(history, time.Time{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !entries[1].Success || entries[1].Size == 0 {
+		t.Fatalf("Expected both builds to be recorded, got: %+v", entries)
+	}
+	if len(entries[1].Trigger) != 1 || !strings.HasSuffix(entries[1].Trigger[0], "override.go") {
+		t.Errorf("Expected the rebuild to be triggered by override.go, got: %v", entries[1].Trigger)
+	}
+
+	output, err := exec.Command(executable, "stats", "-history", history).CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "past day:  2 builds (0 failed)") {
+		t.Errorf("Expected lrt stats to summarize the builds, got: %s (%v)", output, err)
+	}
+}
+
+func TestFormatBuildSummary(t *testing.T) {
+	cwd, _ := os.Getwd()
+
+	summary := formatBuildSummary(nil, 1234*time.Millisecond, 8500000, 0, 340*time.Millisecond, true)
+	if summary != "lrt: built in 1.23s (8.1MB), healthy after 340ms" {
+		t.Errorf("Got unexpected summary: %s", summary)
+	}
+
+	summary = formatBuildSummary([]string{filepath.Join(cwd, "main.go")}, time.Second, 8500000, 8500000-12345, 0, false)
+	if summary != "lrt: rebuilt for main.go in 1s (8.1MB, +12KB), but it failed to start" {
+		t.Errorf("Got unexpected summary: %s", summary)
+	}
+
+	summary = formatBuildSummary([]string{"a.go", "b.go", "c.go", "d.go", "e.go"}, time.Second, 100, 200, time.Second, true)
+	if summary != "lrt: rebuilt for a.go, b.go, c.go, 2 more in 1s (100B, -100B), healthy after 1s" {
+		t.Errorf("Got unexpected summary: %s", summary)
+	}
+}
+
+func TestDescribeChanges(t *testing.T) {
+	cwd, _ := os.Getwd()
+	defer takeChanges()
+
+	recordChange(filepath.Join(cwd, "api", "server.go"), fsnotify.Write)
+	recordChange(filepath.Join(cwd, "api", "new.go"), fsnotify.Create)
+	recordChange(filepath.Join(cwd, "api", "new.go"), fsnotify.Write)
+	recordChange(filepath.Join(cwd, "api", "old.go"), fsnotify.Remove)
+	recordChange("/elsewhere/lib.go", fsnotify.Write)
+
+	description := describeChanges()
+	if description != "created: api/new.go; changed: api/server.go, /elsewhere/lib.go; removed: api/old.go" {
+		t.Errorf("Got unexpected description: %s", description)
+	}
+	if files := takeChanges(); len(files) != 4 {
+		t.Errorf("Expected each file to be recorded once, got: %v", files)
+	}
+}
+
+func TestLrt_Notify(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-notify-test-%d", os.Getpid()))
+	os.Mkdir(dir, 0755)
+	defer os.RemoveAll(dir)
+	notifications := filepath.Join(dir, "notifications")
+	ioutil.WriteFile(filepath.Join(dir, "notify-send"), []byte("#!/bin/sh\necho \"$2: $3\" >> "+notifications+"\n"), 0755)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(`package main syntax error`), 0644)
+
+	listenURL, stop := startLrtForTests(t, "-notify")
+	defer stop()
+
+	getStringResponse(t, listenURL)
+	ioutil.WriteFile("test/override.go", []byte(`package main`), 0644)
+	waitForRebuild(t, listenURL)
+	getStringResponse(t, listenURL)
+
+	output, _ := ioutil.ReadFile(notifications)
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(string(output), "build fixed") && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		output, _ = ioutil.ReadFile(notifications)
+	}
+	if !strings.Contains(string(output), "lrt: build failed: test/override.go:1:14: syntax error") ||
+		!strings.HasSuffix(string(output), "lrt: build fixed: the build succeeded again\n") {
+		t.Errorf("Expected notifications when the build failed and was fixed, got: %s", output)
+	}
+}
+
+func TestLrt_Webhook(t *testing.T) {
+	posts := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&payload)
+		posts <- payload.Text
+	}))
+	defer server.Close()
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(`package main syntax error`), 0644)
+
+	listenURL, stop := startLrtForTests(t, "-webhook", server.URL)
+	defer stop()
+
+	getStringResponse(t, listenURL)
+	ioutil.WriteFile("test/override.go", []byte(`package main`), 0644)
+	waitForRebuild(t, listenURL)
+	getStringResponse(t, listenURL)
+
+	for _, expected := range []string{"lrt: build failed", "lrt: build fixed"} {
+		select {
+		case text := <-posts:
+			if !strings.HasPrefix(text, expected) {
+				t.Errorf("Expected a post starting with %q, got: %s", expected, text)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected a post for %q", expected)
+		}
+	}
+}
+
+func TestWriteQuickfixLines(t *testing.T) {
+	cwd, _ := os.Getwd()
+	b := &bytes.Buffer{}
+	writeQuickfixLines(b, []diagnostic{
+		{File: "test/main.go", Line: 3, Column: 14, Message: "syntax error"},
+		{File: "/abs/main.go", Line: 5, Message: "undefined: foo"},
+	})
+	expected := cwd + "/test/main.go:3:14: syntax error\n/abs/main.go:5:1: undefined: foo\n"
+	if b.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, b.String())
+	}
+}
+
+func TestLinkFiles(t *testing.T) {
+	cwd, _ := os.Getwd()
+
+	html := linkFiles("test/main.go:3:14: syntax error <here>")
+	expected := `<a href="vscode://file/` + cwd + `/test/main.go:3:14">test/main.go:3:14</a>: syntax error &lt;here&gt;`
+	if string(html) != expected {
+		t.Errorf("Expected %s, got %s", expected, html)
+	}
+
+	defer func(editor string) { *editorFlag = editor }(*editorFlag)
+	*editorFlag = "idea"
+	html = linkFiles("\t/src/main.go:12 +0x1d")
+	expected = "\t" + `<a href="idea://open?file=%2Fsrc%2Fmain.go&amp;line=12&amp;column=1">/src/main.go:12</a> +0x1d`
+	if string(html) != expected {
+		t.Errorf("Expected %s, got %s", expected, html)
+	}
+}
+
+func TestHints(t *testing.T) {
+	defer func(builtin []hint) { hints = builtin }(hints)
+
+	file := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-hints-test-%d.json", os.Getpid()))
+	defer os.Remove(file)
+	ioutil.WriteFile(file, []byte(`[{"match": "DATABASE_URL is not set", "hint": "copy .env.example to .env"}]`), 0644)
+	if err := loadHints(file); err != nil {
+		t.Fatal(err)
+	}
+
+	output := "panic: DATABASE_URL is not set\nlisten tcp :8080: bind: address already in use"
+	expected := "     hint: copy .env.example to .env\n" +
+		"     hint: your service may be listening on a fixed port, instead of $PORT\n"
+	if hintsFor(output) != expected {
+		t.Errorf("Expected %q, got %q", expected, hintsFor(output))
+	}
+	if hintsFor("all good") != "" {
+		t.Errorf("Expected no hints, got %q", hintsFor("all good"))
+	}
+
+	// lrt's own errors get their own hints, not the service's
+	_, err := net.Listen("unix", "/nonexistent/lrt.sock")
+	if err == nil {
+		t.Fatal("Expected listening in a missing directory to fail")
+	}
+	if hint := lrtHintsFor(err); hint != "" {
+		t.Errorf("Expected no hints, got %q", hint)
+	}
+	err = errors.New("listen tcp 127.0.0.1:3000: bind: address already in use")
+	expected = "     hint: Are you already running a development server somewhere else?\n" +
+		"           if so try `lsof -i:3000` to find the process id\n" +
+		"           or use -listen-fallback 10 to listen on the next free port instead\n"
+	if hint := lrtHintsFor(err); hint != expected {
+		t.Errorf("Expected %q, got %q", expected, hint)
+	}
+
+	ioutil.WriteFile(file, []byte(`[{"match": "(", "hint": "oops"}]`), 0644)
+	if err := loadHints(file); err == nil {
+		t.Errorf("Expected an error for an invalid regular expression")
+	}
+}
+
+func TestLrt_JSONError(t *testing.T) {
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(`package main syntax error`), 0644)
+
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	req, _ := http.NewRequest("GET", listenURL.String(), nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Error       string
+		Message     string
+		Diagnostics []diagnostic
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("Content-Type") != "application/json" || body.Error != "build" {
+		t.Errorf("Expected a JSON build error, got: %d %s %+v", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	if len(body.Diagnostics) != 1 || body.Diagnostics[0].File != "test/override.go" || body.Diagnostics[0].Line != 1 {
+		t.Errorf("Expected the compiler error in diagnostics, got: %+v", body.Diagnostics)
+	}
+}
+
+func TestLrt_KeepLastGood(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-keep-last-good")
+	defer stop()
+
+	get := func() (string, string) {
+		resp, err := http.Get(listenURL.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), resp.Header.Get("Warning")
+	}
+	get()
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(`package main syntax error`), 0644)
+	waitForRebuild(t, listenURL)
+
+	body, warning := get()
+	deadline := time.Now().Add(5 * time.Second)
+	for warning == "" && body == "lrt/test: OK" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		body, warning = get()
+	}
+	if body != "lrt/test: OK" {
+		t.Errorf("Expected the last good build to keep serving, got: %s", body)
+	}
+	if !strings.Contains(warning, "the build failed, serving build 1") {
+		t.Errorf("Expected a warning header, got: %#v", warning)
+	}
+
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 func init() {
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+	waitForRebuild(t, listenURL)
+
+	body, warning = get()
+	deadline = time.Now().Add(5 * time.Second)
+	for body != "lrt/test: OVERRIDE" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		body, warning = get()
+	}
+	if body != "lrt/test: OVERRIDE" || warning != "" {
+		t.Errorf("Expected the fixed build to be served, got: %s (%#v)", body, warning)
+	}
+}
+
+func TestLrt_Rollback(t *testing.T) {
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-rollback-test-%d.sock", os.Getpid()))
+	listenURL, stop := startLrtForTests(t, "-control-socket", socket)
+	defer stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	rollback := func() int {
+		resp, err := client.Post("http://lrt/rollback", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	getStringResponse(t, listenURL)
+	if status := rollback(); status != http.StatusConflict {
+		t.Errorf("Expected rollback to fail without a previous build, got: %d", status)
+	}
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 func init() {
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+	waitForRebuild(t, listenURL)
+
+	response := getStringResponse(t, listenURL)
+	deadline := time.Now().Add(5 * time.Second)
+	for response != "lrt/test: OVERRIDE" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		response = getStringResponse(t, listenURL)
+	}
+
+	if status := rollback(); status != http.StatusOK {
+		t.Fatalf("Expected rollback to succeed, got: %d", status)
+	}
+	if response := getStringResponse(t, listenURL); response != "lrt/test: OK" {
+		t.Errorf("Expected the previous build to be served, got: %s", response)
+	}
+
+	rollback()
+	if response := getStringResponse(t, listenURL); response != "lrt/test: OVERRIDE" {
+		t.Errorf("Expected a second rollback to undo the first, got: %s", response)
+	}
+}
+
+func TestLrt_KeepBuilds(t *testing.T) {
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-builds-test-%d.sock", os.Getpid()))
+	listenURL, stop := startLrtForTests(t, "-control-socket", socket, "-keep-builds", "2")
+	defer stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+
+	getStringResponse(t, listenURL)
+	defer os.Remove("test/override.go")
+	for _, response := range []string{"lrt/test: ONE", "lrt/test: TWO"} {
+		ioutil.WriteFile("test/override.go", []byte(
+			`package main
+
+			 func init() {
+			 	response = "`+response+`"
+			 }`),
+			0644)
+		waitForRebuild(t, listenURL)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for getStringResponse(t, listenURL) != response && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	resp, err := client.Get("http://lrt/builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var builds []keptBuild
+	json.NewDecoder(resp.Body).Decode(&builds)
+	resp.Body.Close()
+	if len(builds) != 2 || builds[0].Build != 2 || builds[1].Build != 1 || builds[1].Size == 0 {
+		t.Fatalf("Expected builds 2 and 1 to be kept, got: %+v", builds)
+	}
+
+	resp, err = client.Post("http://lrt/rollback?build=1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if response := getStringResponse(t, listenURL); response != "lrt/test: OK" {
+		t.Errorf("Expected build 1 to be served, got: %s", response)
+	}
+}
+
+func TestLrt_Shadow(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-shadow", "1s")
+	defer stop()
+
+	if body := getStringResponse(t, listenURL); body != "lrt/test: OK" {
+		t.Fatalf("Expected the first build to be served, got: %s", body)
+	}
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		 func init() {
+		 	response = "lrt/test: OVERRIDE"
+		 }`),
+		0644)
+	waitForRebuild(t, listenURL)
+
+	body := getStringResponse(t, listenURL)
+	deadline := time.Now().Add(10 * time.Second)
+	for body != "lrt/test: OVERRIDE" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		body = getStringResponse(t, listenURL)
+	}
+	if body != "lrt/test: OVERRIDE" {
+		t.Fatalf("Expected the new build to be promoted, got: %s", body)
+	}
+
+	resp, err := http.Get(listenURL.String() + "/__lrt/status?format=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Events []map[string]interface{}
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	for _, e := range status.Events {
+		if e["type"] == "shadow-finished" {
+			if e["differed"].(float64) == 0 {
+				t.Errorf("Expected the mirrored requests to differ, got: %#v", e)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected a shadow-finished event, got: %#v", status.Events)
+}
+
+func TestLrt_ShadowStoppedOnExit(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-shadow", "10s")
+	stopped := false
+	defer func() {
+		if !stopped {
+			stop()
+		}
+	}()
+	getStringResponse(t, listenURL)
+
+	// the new build says where it is running
+	pidFile := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-shadow-test-%d.pid", os.Getpid()))
+	defer os.Remove(pidFile)
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(fmt.Sprintf(
+		`package main
+
+		 import (
+		 	"io/ioutil"
+		 	"os"
+		 	"strconv"
+		 )
+
+		 func init() {
+		 	ioutil.WriteFile(%q, []byte(strconv.Itoa(os.Getpid())), 0644)
+		 }`, pidFile)),
+		0644)
+
+	pid := 0
+	for deadline := time.Now().Add(10 * time.Second); pid == 0 && time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		data, _ := ioutil.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(string(data))
+	}
+	if pid == 0 {
+		t.Fatalf("Expected the new build to be tried out")
+	}
+
+	stop()
+	stopped = true
+	for deadline := time.Now().Add(2 * time.Second); syscall.Kill(pid, 0) == nil && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if syscall.Kill(pid, 0) == nil {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("Expected the build being tried out to be stopped when lrt exits")
+	}
+}
+
+func TestLrt_Warmup(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-warmup", "5", "-warmup-path", "^/hits$")
+	defer stop()
+
+	hitsURL := &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/hits"}
+	if hits := getStringResponse(t, hitsURL); hits != "1" {
+		t.Fatalf("Expected the first hit, got: %s", hits)
+	}
+	getStringResponse(t, listenURL)
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(`package main`), 0644)
+	waitForRebuild(t, listenURL)
+
+	// the restarted service has already seen /hits once, but not /
+	if hits := getStringResponse(t, hitsURL); hits != "2" {
+		t.Errorf("Expected /hits to be replayed after the restart, got: %s", hits)
+	}
+}
+
+func TestWarmupRecording_SkipsEventStreams(t *testing.T) {
+	defer func(size int) { *warmupFlag = size; warmupRequests = nil }(*warmupFlag)
+	*warmupFlag = 5
+
+	handler := withWarmupRecording(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stream", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+
+	if len(warmupRequests) != 1 || warmupRequests[0].uri != "/page" {
+		t.Errorf("Expected only /page to be recorded, got: %v", warmupRequests)
+	}
+}
+
+func TestLrt_Daemon(t *testing.T) {
+	defer os.RemoveAll(daemonDir)
+	listenURL := generateServiceURL(baseListenURL)
+
+	output, err := exec.Command(executable, "start", "-listen", listenURL.Host, testPackagePath).CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "started in the background") {
+		t.Fatalf("Expected lrt to start in the background, got: %s (%v)", output, err)
+	}
+	defer exec.Command(executable, "stop").Run()
+
+	if body := getStringResponse(t, listenURL); body != "lrt/test: OK" {
+		t.Errorf("Expected the service to be running, got: %s", body)
+	}
+
+	output, err = exec.Command(executable, "status").CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "state:   ready") {
+		t.Errorf("Expected lrt status to describe the service, got: %s (%v)", output, err)
+	}
+
+	output, _ = exec.Command(executable, "logs").CombinedOutput()
+	if !strings.Contains(string(output), "lrt: listening on "+listenURL.String()) {
+		t.Errorf("Expected lrt logs to print lrt's output, got: %s", output)
+	}
+
+	output, err = exec.Command(executable, "stop").CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "stopped") {
+		t.Errorf("Expected lrt to stop, got: %s (%v)", output, err)
+	}
+
+	err = exec.Command(executable, "status").Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Errorf("Expected lrt status to exit 3 once stopped, got: %v", err)
+	}
+}
+
+func TestStaleResponses(t *testing.T) {
+	defer func() { staleResponses = map[string]*staleResponse{} }()
+	handler := withStaleResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprintf(w, "fresh %s %s", r.Header.Get("Accept-Language"), r.Header.Get("Cookie"))
+	}))
+	get := func(headers ...string) string {
+		r := httptest.NewRequest("GET", "/page", nil)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Header().Get("X-Lrt-Stale") + w.Body.String()
+	}
+
+	get("Accept-Language", "en")
+	get("Accept-Language", "fr", "Cookie", "session=secret")
+
+	atomic.StoreInt32(&rebuilding, 1)
+	defer atomic.StoreInt32(&rebuilding, 0)
+	for _, test := range []struct {
+		headers  []string
+		expected string
+	}{
+		{[]string{"Accept-Language", "en"}, "truefresh en "},
+		{[]string{"Accept-Language", "de"}, "fresh de "},
+		{[]string{"Accept-Language", "en", "Cookie", "session=other"}, "fresh en session=other"},
+		{[]string{"Accept-Language", "en", "Authorization", "Bearer x"}, "fresh en "},
+	} {
+		if response := get(test.headers...); response != test.expected {
+			t.Errorf("Expected %q for %v, got: %q", test.expected, test.headers, response)
+		}
+	}
+}
+
+func TestStaleResponses_Limit(t *testing.T) {
+	defer clearStaleResponses()
+	handler := withStaleResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fresh")
+	}))
+	for i := 0; i <= staleResponseCount; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("/page?v=%d", i), nil))
+	}
+
+	if len(staleResponses) != staleResponseCount || staleResponses["/page?v=0"] != nil {
+		t.Errorf("Expected the oldest response to be forgotten, got %d responses", len(staleResponses))
+	}
+}
+
+func TestLrt_PidFile(t *testing.T) {
+	testListenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	output, err := exec.Command(executable, "-listen", testListenURL.Host, testPackagePath).CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "lrt: another lrt is already listening on "+testListenURL.String()) {
+		t.Errorf("Expected a second lrt on the same address to refuse to start, got: %s (%v)", output, err)
+	}
+
+	defer func(u *url.URL) { listenURL = u }(listenURL)
+	listenURL = testListenURL
+	contents, _ := ioutil.ReadFile(pidFile())
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(contents))); err != nil || !strings.Contains(string(output), fmt.Sprintf("(pid %d,", pid)) {
+		t.Errorf("Expected the pid file to contain just the other lrt's pid, got: %q", contents)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lrt.log")
+	f, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		f.writeLine(now, "stdout", fmt.Sprintf("line %d", i))
+	}
+
+	contents, _ := ioutil.ReadFile(path)
+	if string(contents) != "2024-01-02 03:04:05.000 [stdout] line 6\n" {
+		t.Errorf("Expected the newest line in %s, got: %q", path, contents)
+	}
+	contents, _ = ioutil.ReadFile(path + ".1")
+	if !strings.HasSuffix(string(contents), "[stdout] line 5\n") {
+		t.Errorf("Expected the previous lines in %s.1, got: %q", path, contents)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 rotated files to be kept, got: %v", err)
+	}
+}
+
+func TestLrt_LogLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, level := range []string{"-quiet", "-verbose"} {
+		path := filepath.Join(dir, level+".log")
+		listenURL, stop := startLrtForTests(t, level, "-log-file", path)
+		getStringResponse(t, listenURL)
+		stop()
+
+		contents, _ := ioutil.ReadFile(path)
+		quiet := !strings.Contains(string(contents), "lrt: built in")
+		verbose := strings.Contains(string(contents), "lrt: watching ") && strings.Contains(string(contents), ": healthy")
+		if level == "-quiet" && (!quiet || verbose) {
+			t.Errorf("Expected -quiet to only log errors, got: %s", contents)
+		}
+		if level == "-verbose" && (quiet || !verbose) {
+			t.Errorf("Expected -verbose to log watches and health checks, got: %s", contents)
+		}
+	}
+}
+
+func TestInstallGoflags(t *testing.T) {
+	goflags := installGoflags("-mod=vendor -trimpath  -modfile=dev.mod -tags=dev")
+	if goflags != "-trimpath -tags=dev" {
+		t.Errorf("Expected -mod and -modfile to be dropped, got %q", goflags)
+	}
+}
+
+func TestInstallTarget(t *testing.T) {
+	for _, c := range []struct {
+		info     *debug.BuildInfo
+		expected string
+	}{
+		{nil, "github.com/superhuman/lrt@latest"},
+		{&debug.BuildInfo{Path: "github.com/someone/lrt", Main: debug.Module{Path: "github.com/someone/lrt", Version: "v1.2.3"}}, "github.com/someone/lrt@v1.2.3"},
+		{&debug.BuildInfo{Path: "github.com/someone/lrt", Main: debug.Module{Path: "github.com/someone/lrt", Version: "(devel)"}}, "github.com/someone/lrt@latest"},
+		{&debug.BuildInfo{Path: "github.com/someone/lrt", Main: debug.Module{Path: "github.com/someone/lrt", Version: "v1.2.4-0.20250102150405-abcdef123456+dirty"}}, "github.com/someone/lrt@latest"},
+		{&debug.BuildInfo{Path: "github.com/someone/lrt", Main: debug.Module{Path: "github.com/someone/lrt", Version: "v0.0.0-20250102150405-abcdef123456"}}, "github.com/someone/lrt@latest"},
+		{&debug.BuildInfo{Path: "github.com/superhuman/lrt", Main: debug.Module{Path: "example.com/app"}, Deps: []*debug.Module{
+			{Path: "github.com/superhuman/lrt", Version: "v0.0.0-20250102150405-abcdef123456"},
+		}}, "github.com/superhuman/lrt@v0.0.0-20250102150405-abcdef123456"},
+		{&debug.BuildInfo{Path: "github.com/superhuman/lrt", Main: debug.Module{Path: "example.com/app"}, Deps: []*debug.Module{
+			{Path: "github.com/superhuman/lrt", Version: "v0.4.0"},
+		}}, "github.com/superhuman/lrt@v0.4.0"},
+	} {
+		if target := installTarget(c.info); target != c.expected {
+			t.Errorf("Expected %s, got %s", c.expected, target)
+		}
+	}
+}
+
+func TestLrt_Doctor(t *testing.T) {
+	output, err := exec.Command(executable, "doctor", testPackagePath).CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "lrt: ok: "+testPackagePath+" listens on $PORT") {
+		t.Errorf("Expected lrt doctor to pass, got: %s (%v)", output, err)
+	}
+
+	anotherURL := generateServiceURL(baseListenURL)
+	output, err = exec.Command(executable, "doctor", "-cmd-args", "-override-port "+anotherURL.Port(), "-health-check-timeout", "1s", testPackagePath).CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "lrt: problem: "+testPackagePath+" listens on port "+anotherURL.Port()+", not on $PORT") {
+		t.Errorf("Expected lrt doctor to notice the service ignoring $PORT, got: %s (%v)", output, err)
+	}
+}
+
+func TestUseSettingsAsDefaults(t *testing.T) {
+	defer func(saved defaultStringsFlag) { *listenFlag = saved }(*listenFlag)
+
+	flag.Set("listen", "localhost:4000")
+	useSettingsAsDefaults()
+	flag.Set("listen", "localhost:5000")
+	flag.Set("listen", "localhost:5001")
+
+	if listen := listenFlag.String(); listen != "localhost:5000, localhost:5001" {
+		t.Errorf("Expected -listen on the command line to replace the one from settings, got: %s", listen)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	settings, err := parseConfig([]byte(`# lrt options
+package: ./cmd/server
+listen: localhost:4000 # not 3000
+cmd-args: "-config 'dev config.yaml' # really"
+env:
+  - DEBUG=1
+  - 'GREETING=it''s'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []configSetting{
+		{2, "package", "./cmd/server"},
+		{3, "listen", "localhost:4000"},
+		{4, "cmd-args", "-config 'dev config.yaml' # really"},
+		{6, "env", "DEBUG=1"},
+		{7, "env", "GREETING=it's"},
+	}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Errorf("Expected %v, got %v", expected, settings)
+	}
+
+	if _, err := parseConfig([]byte("listen: \"localhost:4000\n")); err == nil {
+		t.Errorf("Expected an unterminated string to be an error")
+	}
+}
+
+func TestLrt_Init(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "cmd", "server"), 0755)
+	os.MkdirAll(filepath.Join(dir, "cmd", "worker"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/app\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cmd", "server", "main.go"), []byte("package main\n\nimport \"net/http\"\n\nfunc main() { http.HandleFunc(\"/healthz\", nil) }\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cmd", "worker", "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "Procfile"), []byte("web: bin/server -config \"dev config.yaml\"\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".env"), []byte("DATABASE_URL=postgres://localhost/app\n"), 0644)
+
+	cmd := exec.Command(executable, "init")
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("lrt init failed: %s (%v)", output, err)
+	}
+
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, ".lrt.yaml"))
+	settings, err := parseConfig(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, s := range settings {
+		found[s.name] = s.value
+	}
+	if found["package"] != "./cmd/server" || found["health-check"] != "/healthz" || found["cmd-args"] != "-config 'dev config.yaml'" || found["dotenv"] != "true" {
+		t.Errorf("Expected lrt init to find the server, its health check and flags, got: %s", contents)
+	}
+}
+
+func TestLrt_Completion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		output, err := exec.Command(executable, "completion", shell).Output()
+		if err != nil || !strings.Contains(string(output), "listen") || !strings.Contains(string(output), "doctor") {
+			t.Errorf("Expected lrt completion %s to complete options and commands, got: %s (%v)", shell, output, err)
+		}
+		if _, err := exec.LookPath(shell); err == nil {
+			check := exec.Command(shell, "-n")
+			check.Stdin = bytes.NewReader(output)
+			if output, err := check.CombinedOutput(); err != nil {
+				t.Errorf("Expected lrt completion %s to be valid, got: %s (%v)", shell, output, err)
+			}
+		}
+	}
+
+	output, err := exec.Command(executable, "completion", "packages").Output()
+	if err != nil || !strings.Contains(string(output), "./test\n") {
+		t.Errorf("Expected ./test to be completed as a main package, got: %s (%v)", output, err)
+	}
+}
+
+func TestLrt_EnvOptions(t *testing.T) {
+	os.Setenv("LRT_BASIC_AUTH", "dev:secret")
+	listenURL, stop := startLrtForTests(t)
+	os.Unsetenv("LRT_BASIC_AUTH")
+	defer stop()
+
+	resp, err := http.Get(listenURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected $LRT_BASIC_AUTH to set -basic-auth, got %d", resp.StatusCode)
+	}
+}
+
+func TestLrt_MultipleListen(t *testing.T) {
+	otherURL := generateServiceURL(baseListenURL)
+	listenURL, stop := startLrtForTests(t, "-listen", otherURL.Host)
+	defer stop()
+
+	for _, u := range []*url.URL{listenURL, otherURL} {
+		response := getStringResponse(t, u)
+		if response != "lrt/test: OK" {
+			t.Errorf("Got unexpected response from lrt on %s: %s", u.Host, response)
+		}
+	}
+}
+
+func TestLrt_ListenFallback(t *testing.T) {
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	cmd := exec.Command(executable, "-listen", listenURL.Host, "-listen-fallback", "5", "-color", "never", testPackagePath)
+	output, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	}()
+
+	moved := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "so lrt is listening on "); i >= 0 {
+				moved <- strings.TrimSuffix(line[i+len("so lrt is listening on "):], " instead")
+			}
+		}
+	}()
+
+	select {
+	case address := <-moved:
+		u, err := url.Parse(address)
+		if err != nil || u.Port() == listenURL.Port() {
+			t.Fatalf("Expected lrt to move to another port, got: %s", address)
+		}
+		response := getStringResponse(t, u)
+		if response != "lrt/test: OK" {
+			t.Errorf("Got unexpected response from lrt on %s: %s", u.Host, response)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected a second lrt on the same address to move to the next free port")
+	}
+}
+
+func TestLrt_ListenFallback_PidFile(t *testing.T) {
+	// something other than lrt is using the port, so lrt only finds out when it listens
+	taken, err := net.Listen("tcp", generateServiceURL(baseListenURL).Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	cmd := exec.Command(executable, "-listen", taken.Addr().String(), "-listen-fallback", "5", "-color", "never", testPackagePath)
+	output, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	}()
+
+	moved := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "so lrt is listening on "); i >= 0 {
+				moved <- strings.TrimSuffix(line[i+len("so lrt is listening on "):], " instead")
+			}
+		}
+	}()
+
+	select {
+	case address := <-moved:
+		u, err := url.Parse(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := exec.Command(executable, "-listen", u.Host, testPackagePath).CombinedOutput()
+		if err == nil || !strings.Contains(string(second), "lrt: another lrt is already listening on "+address) {
+			t.Errorf("Expected the pid file to be for the port lrt moved to, got: %s (%v)", second, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected lrt to move to the next free port")
+	}
+}
+
+func TestLrt_Route(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "admin: %s", r.Host)
+	}))
+	defer admin.Close()
+
+	listenURL, stop := startLrtForTests(t, "-route", "admin.localhost="+admin.URL, "-route", "api.localhost="+testPackagePath)
+	defer stop()
+
+	get := func(host string) string {
+		req, _ := http.NewRequest("GET", listenURL.String(), nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if response := get("admin.localhost:" + listenURL.Port()); response != "admin: admin.localhost:"+listenURL.Port() {
+		t.Errorf("Expected admin.localhost to be routed with its Host header, got: %s", response)
+	}
+	if response := get("other.localhost"); response != "lrt/test: OK" {
+		t.Errorf("Expected other hosts to go to the main package, got: %s", response)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		response := get("api.localhost")
+		if response == "lrt/test: OK" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected api.localhost to be routed to its own lrt, got: %s", response)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestFindRoute(t *testing.T) {
+	defer func(saved []*route) { routes = saved }(routes)
+	routes = []*route{
+		{host: "*.myapp.localhost"},
+		{host: "*.admin.myapp.localhost"},
+		{host: "www.myapp.localhost"},
+	}
+
+	for host, expected := range map[string]string{
+		"acme.myapp.localhost:3000":  "*.myapp.localhost",
+		"a.b.myapp.localhost":        "*.myapp.localhost",
+		"acme.admin.myapp.localhost": "*.admin.myapp.localhost",
+		"WWW.myapp.localhost":        "www.myapp.localhost",
+		"myapp.localhost":            "",
+		"localhost:3000":             "",
+	} {
+		found := ""
+		if r := findRoute(&http.Request{Host: host}); r != nil {
+			found = r.host
+		}
+		if found != expected {
+			t.Errorf("Expected %s to be routed to %q, got %q", host, expected, found)
+		}
+	}
+}
+
+func TestRewriteHost(t *testing.T) {
+	defer func(saved []hostRewrite) { hostRewrites = saved }(hostRewrites)
+	hostRewrites = nil
+	for _, value := range []string{"*.myapp.localhost=*.myapp.com", "myapp.localhost=www.myapp.com:8443"} {
+		rewrite, err := parseHostRewrite(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostRewrites = append(hostRewrites, rewrite)
+	}
+	if _, err := parseHostRewrite("*.myapp.localhost=myapp.com"); err == nil {
+		t.Errorf("Expected a rewrite from a wildcard to a single host to be invalid")
+	}
+
+	for host, expected := range map[string]string{
+		"acme.myapp.localhost:3000": "acme.myapp.com",
+		"myapp.localhost:3000":      "www.myapp.com:8443",
+		"other.localhost:3000":      "other.localhost:3000",
+	} {
+		req := &http.Request{Host: host}
+		rewriteHost(req)
+		if req.Host != expected {
+			t.Errorf("Expected %s to be rewritten to %s, got %s", host, expected, req.Host)
+		}
+	}
+}
+
+func TestLrt_SocketActivation(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	socket, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	// systemd sets LISTEN_PID to lrt's own pid
+	cmd := exec.Command("sh", "-c", `LISTEN_PID=$$ exec "$0" "$@"`, executable, "-listen", "localhost:1", testPackagePath)
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{socket}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	}()
+	// only lrt should be accepting connections now
+	listener.Close()
+
+	response := getStringResponse(t, &url.URL{Scheme: "http", Host: listener.Addr().String()})
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt on the socket from systemd: %s", response)
+	}
+}
+
+func TestRemoteCommand(t *testing.T) {
+	host, dir := parseRemote("dev@buildbox", "/src/myapp")
+	if host != "dev@buildbox" || dir != "lrt/myapp" {
+		t.Errorf("Expected -remote dev@buildbox to default to lrt/myapp, got %s %s", host, dir)
+	}
+	host, dir = parseRemote("dev@buildbox:src/my app/", "/src/myapp")
+	if host != "dev@buildbox" || dir != "src/my app" {
+		t.Errorf("Expected -remote dev@buildbox:src/my app/ to be parsed, got %s %s", host, dir)
+	}
+
+	defer func(host, dir string, u *url.URL) { remoteHost, remoteDir, serviceURL = host, dir, u }(remoteHost, remoteDir, serviceURL)
+	remoteHost, remoteDir = host, dir
+	serviceURL = &url.URL{Scheme: "http", Host: "localhost:4567"}
+	service := exec.Command("/tmp/lrt-service", "-greeting", "hello world")
+	service.Env = append(os.Environ(), "PORT=4567")
+
+	cmd := remoteCommand(service)
+	args := strings.Join(cmd.Args, " ")
+	if !strings.Contains(args, "-L localhost:4567:localhost:4567 dev@buildbox") {
+		t.Errorf("Expected the service's port to be forwarded, got: %s", args)
+	}
+	if !strings.HasSuffix(args, "&& exec env PORT=4567 'src/my app/.lrt/service' -greeting 'hello world'") {
+		t.Errorf("Expected the remote build to be run with only lrt's environment variables, got: %s", args)
+	}
+}
+
+func TestLrt_Deploy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a "device" that is just another directory
+	deployed := filepath.Join(dir, "service")
+	deviceURL := generateServiceURL(baseListenURL)
+	listenURL, stop := startLrtForTests(t, "-deploy", `cp "$BINARY" `+deployed+` && echo deployed && exec `+deployed, "-ready-log-pattern", "^deployed$", "-service", deviceURL.Host)
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from the deployed service: %s", response)
+	}
+	if _, err := os.Stat(deployed); err != nil {
+		t.Errorf("Expected -deploy to copy the build: %s", err)
+	}
+}
+
+func TestLrt_DeployAndExit(t *testing.T) {
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl is not installed")
+	}
+	dir, err := ioutil.TempDir("", "lrt-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the previous build, still running on the "device" until the hook stops it
+	deviceURL := generateServiceURL(baseListenURL)
+	listener, err := net.Listen("tcp", deviceURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := &http.Server{}
+	previous.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stop" {
+			go previous.Close()
+		}
+		w.Write([]byte("lrt/test: PREVIOUS"))
+	})
+	go previous.Serve(listener)
+	defer previous.Close()
+
+	// restart the service in the background, like systemctl restart would
+	deployed, pid := filepath.Join(dir, "service"), filepath.Join(dir, "pid")
+	hook := `sleep 1 && curl -s ` + deviceURL.String() + `/stop && sleep 0.2 && cp "$BINARY" ` + deployed + ` && { ` + deployed + ` >/dev/null 2>&1 & echo $! > ` + pid + `; }`
+	listenURL, stop := startLrtForTests(t, "-deploy", hook, "-service", deviceURL.Host)
+	defer stop()
+	defer func() {
+		if data, err := ioutil.ReadFile(pid); err == nil {
+			n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+			syscall.Kill(n, syscall.SIGKILL)
+		}
+	}()
+
+	if response := getStringResponse(t, listenURL); response != "lrt/test: OK" {
+		t.Errorf("Expected lrt to wait for the deploy hook before checking the service, got: %s", response)
+	}
+}
+
+func TestPortForward(t *testing.T) {
+	for value, expected := range map[string]portForward{
+		"svc/postgres=5432":               {resource: "svc/postgres", localPort: "5432", ports: "5432"},
+		"staging/svc/postgres=15432:5432": {namespace: "staging", resource: "svc/postgres", localPort: "15432", ports: "15432:5432"},
+	} {
+		p, err := parsePortForward(value)
+		if err != nil || *p != expected {
+			t.Errorf("Expected -port-forward %s to be parsed as %+v, got %+v (%v)", value, expected, p, err)
+		}
+	}
+	for _, value := range []string{"postgres=5432", "svc/postgres", "svc/postgres=db", "svc/postgres=1:2:3"} {
+		if _, err := parsePortForward(value); err == nil {
+			t.Errorf("Expected -port-forward %s to be invalid", value)
+		}
+	}
+
+	// a kubectl that exits straight away, as it does when the connection drops
+	dir, err := ioutil.TempDir("", "lrt-kubectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	calls := filepath.Join(dir, "calls")
+	ioutil.WriteFile(filepath.Join(dir, "kubectl"), []byte("#!/bin/sh\necho \"$@\" >> "+calls+"\n"), 0755)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	p, _ := parsePortForward("staging/svc/postgres=15432:5432")
+	stopping := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		p.supervise(stopping)
+		close(done)
+	}()
+	time.Sleep(1500 * time.Millisecond)
+	close(stopping)
+	<-done
+
+	contents, _ := ioutil.ReadFile(calls)
+	if string(contents) != strings.Repeat("port-forward -n staging svc/postgres 15432:5432\n", 2) {
+		t.Errorf("Expected kubectl port-forward to be restarted after it exited, got: %q", contents)
+	}
+}
+
+func TestLrt_Compose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a docker that records what it is asked to do, and whose db container
+	// is running once it has been brought up
+	calls := filepath.Join(dir, "calls")
+	ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(`#!/bin/sh
+echo "$@" >> `+calls+`
+case "$2" in
+ps) if [ -f `+dir+`/up ]; then echo '{"Service":"db","State":"running","Health":"healthy","Publishers":[]}'; else echo '{"Service":"db","State":"exited"}'; fi ;;
+up) touch `+dir+`/up ;;
+esac
+`), 0755)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	listenURL, stop := startLrtForTests(t, "-compose", "db")
+	response := getStringResponse(t, listenURL)
+	stop()
+	if response != "lrt/test: OK" {
+		t.Errorf("Got unexpected response from lrt: %s", response)
+	}
+
+	contents, _ := ioutil.ReadFile(calls)
+	if !strings.Contains(string(contents), "compose up -d db\n") || !strings.HasSuffix(string(contents), "compose stop db\n") {
+		t.Errorf("Expected lrt to start db before the service, and stop it on exit, got: %s", contents)
+	}
+}
+
+func TestLrt_WaitFor(t *testing.T) {
+	dependency := generateServiceURL(baseListenURL)
+	listenURL, stop := startLrtForTests(t, "-wait-for", "tcp://"+dependency.Host, "-wait-for-timeout", "500ms")
+	defer stop()
+
+	response := getStringResponse(t, listenURL)
+	if !strings.Contains(response, "lrt: error: not starting your service, as tcp://"+dependency.Host+" is not reachable") {
+		t.Errorf("Expected lrt to wait for its dependency, got: %s", response)
+	}
+
+	listener, err := net.Listen("tcp", dependency.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		response = getStringResponse(t, listenURL)
+		if response == "lrt/test: OK" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected lrt to start the service once its dependency was reachable, got: %s", response)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestLrt_Static(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "style.css"), []byte("body { color: red }"), 0644)
+
+	listenURL, stop := startLrtForTests(t, "-static", "/assets="+dir, "-static", "/="+dir)
+	defer stop()
+
+	resp, err := http.Get(listenURL.String() + "/assets/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "body { color: red }" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/css") || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("Expected lrt to serve style.css itself, got: %s %s (%s)", resp.Header.Get("Content-Type"), resp.Header.Get("Cache-Control"), body)
+	}
+
+	response := getStringResponse(t, &url.URL{Scheme: "http", Host: listenURL.Host, Path: "/assets/other.css"})
+	if response != "lrt/test: OK" {
+		t.Errorf("Expected files that don't exist to be served by the service, got: %s", response)
+	}
+
+	if response := getStringResponse(t, listenURL); response != "lrt/test: OK" {
+		t.Errorf("Expected / to be served by the service rather than listing the directory, got: %s", response)
+	}
+	if response := getStringResponse(t, &url.URL{Scheme: "http", Host: listenURL.Host, Path: "/style.css"}); response != "body { color: red }" {
+		t.Errorf("Expected lrt to serve files mounted at /, got: %s", response)
+	}
+}
+
+func TestAddBrowserReloadScript(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:       ioutil.NopCloser(strings.NewReader("<html><BODY>hi</BODY></html>")),
+		Request:    &http.Request{Method: "GET"},
+	}
+	if err := addBrowserReloadScript(resp); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "<html><BODY>hi"+browserReloadScript+"</BODY></html>" || resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("Expected the script to be added before </body>, got: %s (%s)", body, resp.Header.Get("Content-Length"))
+	}
+
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified, http.StatusNotFound} {
+		resp := &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    &http.Request{Method: "GET"},
+		}
+		if err := addBrowserReloadScript(resp); err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := ioutil.ReadAll(resp.Body); len(body) != 0 {
+			t.Errorf("Expected no script to be added to a %d response, got: %s", status, body)
+		}
+	}
+}
+
+func TestLrt_BrowserReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listenURL, stop := startLrtForTests(t, "-browser-reload", filepath.Join(dir, "*.tmpl"))
+	defer stop()
+	getStringResponse(t, listenURL)
+
+	resp, err := http.Get(listenURL.String() + "/__lrt/browser-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	ioutil.WriteFile(filepath.Join(dir, "index.tmpl"), []byte("<p>hello</p>"), 0644)
+
+	reloaded := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() == "event: reload" {
+				reloaded <- scanner.Text()
+				return
+			}
+		}
+	}()
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the browser to be told to reload when a template changed")
+	}
+}
+
+func TestLrt_GoFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-gofiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := func(response string) []byte {
+		return []byte(`package main
+
+import (
+	"net/http"
+	"os"
+)
+
+func main() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("` + response + `")) })
+	http.ListenAndServe("localhost:"+os.Getenv("PORT"), nil)
+}
+`)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "server.go"), server("one"), 0644)
+	// not part of the build, so lrt should neither build nor watch it
+	ioutil.WriteFile(filepath.Join(dir, "broken.go"), []byte("package main\n\nfunc main() {"), 0644)
+
+	listenURL := generateServiceURL(baseListenURL)
+	cmd := exec.Command(executable, "-listen", listenURL.Host, "-pid-file", "none", "server.go")
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	}()
+
+	response := ""
+	for i := 0; i < 100 && response != "one"; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if resp, err := http.Get(listenURL.String()); err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			response = string(body)
+		}
+	}
+	if response != "one" {
+		t.Fatalf("Expected lrt to run server.go, got: %s", response)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "server.go"), server("two"), 0644)
+	for i := 0; i < 50 && response != "two"; i++ {
+		waitForFsNotify()
+		response = getStringResponse(t, listenURL)
+	}
+	if response != "two" {
+		t.Errorf("Expected lrt to rebuild when server.go changed, got: %s", response)
+	}
+}
+
+func TestLrt_Replicas(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-replicas", "2")
+	defer stop()
+
+	replicas := map[string]bool{}
+	ports := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		replicas[getStringResponse(t, &url.URL{Scheme: "http", Host: listenURL.Host, Path: "/env", RawQuery: "name=REPLICA"})] = true
+	}
+	for i := 0; i < 4; i++ {
+		ports[getStringResponse(t, &url.URL{Scheme: "http", Host: listenURL.Host, Path: "/env", RawQuery: "name=PORT"})] = true
+	}
+	if !replicas["1"] || !replicas["2"] || len(replicas) != 2 || len(ports) != 2 {
+		t.Errorf("Expected requests to go to both replicas, each on its own port, got: %v %v", replicas, ports)
+	}
+}
+
+func TestThirdPartyPackages(t *testing.T) {
+	defer func(m *gomod.Module) { goModule = m }(goModule)
+	goModule = &gomod.Module{Name: "github.com/example/app"}
+
+	deps := thirdPartyPackages([]byte("github.com/example/app/internal/db\ngithub.com/lib/pq\n\ngithub.com/example/application\ngithub.com/example/app\ncommand-line-arguments\n"))
+	if !reflect.DeepEqual(deps, []string{"github.com/lib/pq", "github.com/example/application"}) {
+		t.Errorf("Expected only packages from outside the module, got: %v", deps)
+	}
+}
+
+func TestWatchCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-watch-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/app\n"), 0644)
+	os.Mkdir(filepath.Join(dir, "db"), 0755)
+
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	defer func(m *gomod.Module, d string, w *fsnotify.Watcher, watched map[string]bool) {
+		goModule, goModuleDir, watcher, watchedDir = m, d, w, watched
+	}(goModule, goModuleDir, watcher, watchedDir)
+	goModule, goModuleDir = &gomod.Module{Name: "example.com/app"}, dir
+	watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	watchedDir = map[string]bool{}
+	if loadWatchCache() {
+		t.Fatalf("Expected nothing to be cached yet")
+	}
+	watchDir(filepath.Join(dir, "db"))
+	saveWatchCache()
+
+	watchedDir = map[string]bool{}
+	if !loadWatchCache() || !watchedDir[filepath.Join(dir, "db")] {
+		t.Errorf("Expected the cached directory to be watched, got: %v", watchedDir)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/app\n\nrequire example.com/lib v1.0.0\n"), 0644)
+	watchedDir = map[string]bool{}
+	if loadWatchCache() {
+		t.Errorf("Expected changing go.mod to invalidate the cache")
+	}
+}
+
+func TestIsIgnoredDir(t *testing.T) {
+	defer func(f []string) { *watchIgnoreFlag = f }(*watchIgnoreFlag)
+	*watchIgnoreFlag = []string{"web/dist", "generated"}
+	root := watchRootDir()
+
+	for dir, ignored := range map[string]bool{
+		".git":              true,
+		"_old":              true,
+		"api/testdata":      true,
+		"web/node_modules":  true,
+		"web/dist":          true,
+		"api/generated":     true,
+		"web/src":           false,
+		"internal/dist":     false,
+		"cmd/server":        false,
+		"internal/generate": false,
+	} {
+		if isIgnoredDir(filepath.Join(root, dir)) != ignored {
+			t.Errorf("Expected isIgnoredDir(%s) to be %v", dir, ignored)
+		}
+	}
+}
+
+func TestLrt_WatchRoot(t *testing.T) {
+	listenURL, stop := startLrtForTests(t, "-watch-root")
+	defer stop()
+
+	hits := &url.URL{Scheme: "http", Host: listenURL.Host, Path: "/hits"}
+	if response := getStringResponse(t, hits); response != "1" {
+		t.Fatalf("Got unexpected response from lrt: %s", response)
+	}
+	// give go list time to find the dependencies
+	time.Sleep(time.Second)
+
+	defer os.RemoveAll("lrt-watch-root-test")
+	os.Mkdir("lrt-watch-root-test", 0755)
+	waitForFsNotify()
+	ioutil.WriteFile("lrt-watch-root-test/unrelated.go", []byte("package unrelated\n"), 0644)
+	waitForFsNotify()
+	waitForFsNotify()
+	if response := getStringResponse(t, hits); response != "2" {
+		t.Errorf("Expected changes outside the package's dependencies not to cause a rebuild, got: %s", response)
+	}
+
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte("package main\n\nfunc init() { response = \"lrt/test: OVERRIDE\" }\n"), 0644)
+	response := ""
+	for i := 0; i < 50 && response != "lrt/test: OVERRIDE"; i++ {
+		waitForFsNotify()
+		response = getStringResponse(t, listenURL)
+	}
+	if response != "lrt/test: OVERRIDE" {
+		t.Errorf("Expected changes to the package to cause a rebuild, got: %s", response)
+	}
+}
+
+func TestPollSiblings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-poll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(w *fsnotify.Watcher, watched map[string]bool, polled map[string]bool) {
+		// (which stops the poller in the background)
+		watchLock.Lock()
+		watcher, watchedDir, polledRoots = w, watched, polled
+		watchLock.Unlock()
+	}(watcher, watchedDir, polledRoots)
+	watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	watchedDir, polledRoots = map[string]bool{}, map[string]bool{}
+
+	for i := 0; i < 4; i++ {
+		pkg := filepath.Join(dir, "pkg"+strconv.Itoa(i))
+		os.Mkdir(pkg, 0755)
+		ioutil.WriteFile(filepath.Join(pkg, "pkg.go"), []byte("package pkg\n"), 0644)
+		if i < 3 {
+			watchDir(pkg)
+		}
+	}
+	if len(polledRoots) != 0 {
+		t.Fatalf("Expected nothing to be polled while fsnotify has watches to spare, got: %v", polledRoots)
+	}
+
+	// as if fsnotify had run out of inotify watches
+	watchLock.Lock()
+	pollSiblings(filepath.Join(dir, "pkg3"), syscall.ENOSPC)
+	watchLock.Unlock()
+	if !polledRoots[dir] || len(watchedDir) != 4 {
+		t.Fatalf("Expected %s to be polled instead of its subdirectories being watched, got: %v", dir, polledRoots)
+	}
+
+	time.Sleep(pollInterval)
+	changed := filepath.Join(dir, "pkg3", "pkg.go")
+	ioutil.WriteFile(changed, []byte("package pkg\n\nvar x = 1\n"), 0644)
+	os.Chtimes(changed, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	select {
+	case ev := <-pollEvents:
+		if ev.Name != changed || ev.Op != fsnotify.Write {
+			t.Errorf("Expected a write to %s, got: %s", changed, ev)
+		}
+	case <-time.After(5 * pollInterval):
+		t.Errorf("Expected polling to notice %s changing", changed)
+	}
+}
+
+func TestLrt_WatchedDirRecreated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-recreated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := func(response string) []byte {
+		return []byte(`package main
+
+import (
+	"net/http"
+	"os"
+)
+
+func main() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("` + response + `")) })
+	http.ListenAndServe("localhost:"+os.Getenv("PORT"), nil)
+}
+`)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "server.go"), server("one"), 0644)
+
+	listenURL := generateServiceURL(baseListenURL)
+	cmd := exec.Command(executable, "-listen", listenURL.Host, "-pid-file", "none", filepath.Join(dir, "server.go"))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	}()
+	waitForResponse := func(want string) string {
+		response := ""
+		for i := 0; i < 100 && response != want; i++ {
+			time.Sleep(100 * time.Millisecond)
+			if resp, err := http.Get(listenURL.String()); err == nil {
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				response = string(body)
+			}
+		}
+		return response
+	}
+	if response := waitForResponse("one"); response != "one" {
+		t.Fatalf("Expected lrt to run server.go, got: %s", response)
+	}
+
+	// like a git checkout that deletes and recreates a directory, which
+	// removes its watch
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "server.go"), server("one"), 0644)
+	time.Sleep(time.Second)
+
+	ioutil.WriteFile(filepath.Join(dir, "server.go"), server("two"), 0644)
+	if response := waitForResponse("two"); response != "two" {
+		t.Errorf("Expected lrt to watch the directory again once it was recreated, got: %s", response)
+	}
+}
+
+func TestLrt_IgnoresExcludedFiles(t *testing.T) {
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	hits := &url.URL{Scheme: "http", Host: listenURL.Host, Path: "/hits"}
+	if response := getStringResponse(t, hits); response != "1" {
+		t.Fatalf("Got unexpected response from lrt: %s", response)
+	}
+	waitForBuiltFiles(t, listenURL)
+
+	defer os.Remove("test/generate.go")
+	ioutil.WriteFile("test/generate.go", []byte("//go:build ignore\n\npackage main\n"), 0644)
+	waitForFsNotify()
+	waitForFsNotify()
+	if response := getStringResponse(t, hits); response != "2" {
+		t.Errorf("Expected a file excluded by its build constraints not to cause a rebuild, got: %s", response)
+	}
+}
+
+// waitForBuiltFiles waits for lrt to find out which files the test service
+// is built from, which it does in the background after building it
+func waitForBuiltFiles(t *testing.T, listenURL *url.URL) {
+	watches := &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/watches", RawQuery: "format=json"}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		var set watchSet
+		json.Unmarshal([]byte(getStringResponse(t, watches)), &set)
+		for _, module := range set.Modules {
+			for _, entry := range module.Dirs {
+				if filepath.Base(entry.Dir) == "test" && reflect.DeepEqual(entry.Files, []string{"main.go"}) {
+					return
+				}
+			}
+		}
+	}
+	t.Fatalf("Expected lrt to find the files the service is built from")
+}
+
+func TestDependenciesMayHaveChanged(t *testing.T) {
+	file := filepath.Join(os.TempDir(), fmt.Sprintf("lrt-deps-test-%d.go", os.Getpid()))
+	defer os.Remove(file)
+	ioutil.WriteFile(file, []byte("package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(1) }\n"), 0644)
+
+	defer func(headers map[string]string) { fileHeaders = headers }(fileHeaders)
+	fileHeaders = map[string]string{file: fileHeader(file)}
+
+	ioutil.WriteFile(file, []byte("package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(2) }\n"), 0644)
+	if dependenciesMayHaveChanged([]string{file}) {
+		t.Errorf("Expected a change after the imports not to change the dependencies")
+	}
+	ioutil.WriteFile(file, []byte("package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc main() { fmt.Println(os.Args) }\n"), 0644)
+	if !dependenciesMayHaveChanged([]string{file}) {
+		t.Errorf("Expected a new import to change the dependencies")
+	}
+	ioutil.WriteFile(file, []byte("//go:build ignore\n\npackage main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(2) }\n"), 0644)
+	if !dependenciesMayHaveChanged([]string{file}) {
+		t.Errorf("Expected a new build constraint to change the dependencies")
+	}
+	if !dependenciesMayHaveChanged([]string{filepath.Join(os.TempDir(), "new.go")}) {
+		t.Errorf("Expected a new file to change the dependencies")
+	}
+}
+
+func TestBuildContext(t *testing.T) {
+	defer func(env []string, args []string) { targetGoEnv, buildArgs = env, args }(targetGoEnv, buildArgs)
+	targetGoEnv = []string{"GOOS=linux", "GOARCH=arm64"}
+	buildArgs = []string{"-race", "-tags", "integration,dev", "-tags=sqlite"}
+
+	ctxt := buildContext()
+	if ctxt.GOOS != "linux" || ctxt.GOARCH != "arm64" || !reflect.DeepEqual(ctxt.BuildTags, []string{"integration", "dev", "sqlite"}) {
+		t.Errorf("Expected the build context to match the build, got: %s/%s %v", ctxt.GOOS, ctxt.GOARCH, ctxt.BuildTags)
+	}
+}
+
+func TestLrt_DryRun(t *testing.T) {
+	cmd := exec.Command(executable, "-dry-run", "-verbose", "-env", "DRY_RUN=1", "-version-var", "main.buildVersion", "-listen", generateServiceURL(baseListenURL).Host, testPackagePath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Expected -dry-run to succeed, got %s: %s", err, output)
+	}
+
+	dir, _ := filepath.Abs("test")
+	for _, expected := range []string{
+		"  -env=DRY_RUN=1\n",
+		"  " + dir + ": main.go\n",
+		"go build -ldflags '-X main.buildVersion=<git sha>-<timestamp>' -o ",
+		"DRY_RUN=1 PORT=",
+		"lrt: would watch " + dir + "\n",
+	} {
+		if !strings.Contains(string(output), expected) {
+			t.Errorf("Expected -dry-run to print %q, got:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(string(output), "lrt: listening") || strings.Contains(string(output), "(by polling)") {
+		t.Errorf("Expected -dry-run not to start anything, got:\n%s", output)
+	}
+}
+
+func TestLrt_Watches(t *testing.T) {
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	getStringResponse(t, listenURL)
+
+	dir, _ := filepath.Abs("test")
+	watches := func(file string) watchSet {
+		var set watchSet
+		response := getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/watches", RawQuery: url.Values{"format": {"json"}, "file": {file}}.Encode()})
+		if err := json.Unmarshal([]byte(response), &set); err != nil {
+			t.Fatalf("Got unexpected response from lrt: %s", response)
+		}
+		return set
+	}
+
+	// the files each directory is built from are found after the build
+	var set watchSet
+	found := false
+	for i := 0; i < 50 && !found; i++ {
+		set = watches(filepath.Join(dir, "main.go"))
+		for _, module := range set.Modules {
+			for _, entry := range module.Dirs {
+				found = found || (module.Module == packagePath && entry.Dir == dir && reflect.DeepEqual(entry.Files, []string{"main.go"}))
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !found || set.Dirs < 1 {
+		t.Errorf("Expected lrt to list %s (and main.go in it) under %s, got: %+v", dir, packagePath, set)
+	}
+	if set.File == nil || !set.File.Rebuilds {
+		t.Errorf("Expected changing main.go to rebuild, got: %+v", set.File)
+	}
+
+	for _, file := range []string{filepath.Join(dir, "README.txt"), filepath.Join(os.TempDir(), "other.go")} {
+		if set := watches(file); set.File == nil || set.File.Rebuilds || set.File.Reason == "" {
+			t.Errorf("Expected changing %s not to rebuild, with a reason, got: %+v", file, set.File)
+		}
+	}
+}
+
+func TestLrt_PrunesRemovedDependencies(t *testing.T) {
+	defer os.RemoveAll("test/pruned")
+	os.MkdirAll("test/pruned", 0755)
+	ioutil.WriteFile("test/pruned/pruned.go", []byte("package pruned\n\nconst Response = \"lrt/test: pruned\"\n"), 0644)
+	defer os.Remove("test/override.go")
+	ioutil.WriteFile("test/override.go", []byte(
+		`package main
+
+		import "`+testPackagePath+`/pruned"
+
+		func init() {
+			response = pruned.Response
+		}
+		`),
+		0644)
+
+	listenURL, stop := startLrtForTests(t)
+	defer stop()
+
+	dir, _ := filepath.Abs("test/pruned")
+	watching := func() bool {
+		var set watchSet
+		response := getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/watches", RawQuery: "format=json"})
+		if err := json.Unmarshal([]byte(response), &set); err != nil {
+			t.Fatalf("Got unexpected response from lrt: %s", response)
+		}
+		for _, module := range set.Modules {
+			for _, entry := range module.Dirs {
+				if entry.Dir == dir {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if response := getStringResponse(t, listenURL); response != "lrt/test: pruned" || !watching() {
+		t.Fatalf("Expected lrt to build and watch test/pruned, got: %s", response)
+	}
+
+	os.Remove("test/override.go")
+	response := ""
+	for i := 0; i < 50 && response != "lrt/test: OK"; i++ {
+		waitForFsNotify()
+		response = getStringResponse(t, listenURL)
+	}
+	stillWatching := true
+	for i := 0; i < 50 && stillWatching; i++ {
+		time.Sleep(100 * time.Millisecond)
+		stillWatching = watching()
+	}
+	if response != "lrt/test: OK" || stillWatching {
+		t.Errorf("Expected lrt to stop watching test/pruned once it wasn't imported, got: %s (watching: %v)", response, stillWatching)
+	}
+}
+
+func TestLocalPackageDir(t *testing.T) {
+	defer func(m *gomod.Module, d string) {
+		goModule, goModuleDir = m, d
+	}(goModule, goModuleDir)
+	goModDir := filepath.Join(os.TempDir(), "app")
+	contents := "module example.com/app\n\nreplace example.com/lib => ../lib\n\nreplace example.com/app/nested => example.com/nested v1.0.0\n"
+	mod, err := gomod.Parse(filepath.Join(goModDir, "go.mod"), []byte(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	goModule, goModuleDir = mod, goModDir
+
+	for p, expected := range map[string]string{
+		"example.com/app":            goModDir,
+		"example.com/app/db":         filepath.Join(goModDir, "db"),
+		"example.com/application":    "",
+		"example.com/lib/client":     filepath.Join(os.TempDir(), "lib", "client"),
+		"example.com/app/nested/pkg": "",
+		"github.com/other/module":    "",
+	} {
+		if dir, err := localPackageDir(p); err != nil || dir != expected {
+			t.Errorf("Expected %s to be in %q, got %q (%v)", p, expected, dir, err)
+		}
+	}
+}
+
+func TestLrt_GopathMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-gopath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	app, lib := filepath.Join(dir, "one", "src", "app"), filepath.Join(dir, "two", "src", "lib")
+	os.MkdirAll(app, 0755)
+	os.MkdirAll(lib, 0755)
+	ioutil.WriteFile(filepath.Join(app, "main.go"), []byte(`package main
+
+import (
+	"lib"
+	"net/http"
+	"os"
+)
+
+func main() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(lib.Response)) })
+	http.ListenAndServe("localhost:"+os.Getenv("PORT"), nil)
+}
+`), 0644)
+	ioutil.WriteFile(filepath.Join(lib, "lib.go"), []byte("package lib\n\nconst Response = \"one\"\n"), 0644)
+
+	// GOPATH is set with go env -w, rather than in lrt's environment, and
+	// the package's dependency is in its second entry
+	goEnv := filepath.Join(dir, "go.env")
+	ioutil.WriteFile(goEnv, []byte("GOPATH="+filepath.Join(dir, "one")+string(filepath.ListSeparator)+filepath.Join(dir, "two")+"\nGO111MODULE=off\n"), 0644)
+
+	listenURL := generateServiceURL(baseListenURL)
+	cmd := exec.Command(executable, "-listen", listenURL.Host, "-pid-file", "none", ".")
+	cmd.Dir = app
+	cmd.Env = []string{"GOENV=" + goEnv}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "GOPATH=") && !strings.HasPrefix(kv, "GO111MODULE=") && !strings.HasPrefix(kv, "GOENV=") && !strings.HasPrefix(kv, "GOFLAGS=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	}()
+
+	response := ""
+	for i := 0; i < 100 && response != "one"; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if resp, err := http.Get(listenURL.String()); err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			response = string(body)
+		}
+	}
+	if response != "one" {
+		t.Fatalf("Expected lrt to build the package in GOPATH mode, got: %s", response)
+	}
+
+	ioutil.WriteFile(filepath.Join(lib, "lib.go"), []byte("package lib\n\nconst Response = \"two\"\n"), 0644)
+	for i := 0; i < 50 && response != "two"; i++ {
+		waitForFsNotify()
+		response = getStringResponse(t, listenURL)
+	}
+	if response != "two" {
+		t.Errorf("Expected lrt to rebuild when a package in the second GOPATH entry changed, got: %s", response)
+	}
+}
+
+func TestLrt_StableBuildOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-build-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", dir)
+
+	// a build for a directory that has since been removed
+	removed := filepath.Join(dir, "lrt", "0123456789abcdef")
+	os.MkdirAll(removed, 0755)
+	for name, contents := range map[string]string{"lock": "", "bin": "", "cwd": filepath.Join(dir, "removed")} {
+		ioutil.WriteFile(filepath.Join(removed, name), []byte(contents), 0644)
+	}
+
+	binary := func(listenURL *url.URL) string {
+		var status struct{ Binary string }
+		response := getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/status", RawQuery: "format=json"})
+		if err := json.Unmarshal([]byte(response), &status); err != nil {
+			t.Fatalf("Got unexpected response from lrt: %s", response)
+		}
+		return status.Binary
+	}
+
+	listenURL, stop := startLrtForTests(t)
+	getStringResponse(t, listenURL)
+	first := binary(listenURL)
+	if !strings.HasPrefix(first, filepath.Join(dir, "lrt")+string(filepath.Separator)) || filepath.Base(first) != "bin" {
+		stop()
+		t.Fatalf("Expected the service to be built in the user cache directory, got: %s", first)
+	}
+
+	// a second lrt running the same package can't share it
+	otherURL, stopOther := startLrtForTests(t)
+	getStringResponse(t, otherURL)
+	if other := binary(otherURL); other == first || other == "" {
+		t.Errorf("Expected a second lrt to build somewhere else, got: %s", other)
+	}
+	stopOther()
+	stop()
+
+	if _, err := os.Stat(first); err != nil {
+		t.Errorf("Expected the build to be kept for next time: %v", err)
+	}
+	listenURL, stop = startLrtForTests(t)
+	defer stop()
+	getStringResponse(t, listenURL)
+	if again := binary(listenURL); again != first {
+		t.Errorf("Expected lrt to build to the same place each time, got %s then %s", first, again)
+	}
+	if _, err := os.Stat(removed); !os.IsNotExist(err) {
+		t.Errorf("Expected the build for a removed directory to be removed: %v", err)
+	}
+}
+
+func TestLrt_RAMBuild(t *testing.T) {
+	if info, err := os.Stat("/dev/shm"); err != nil || !info.IsDir() {
+		t.Skip("no /dev/shm")
+	}
+	listenURL, stop := startLrtForTests(t, "-ram-build", "-service-name", "ram-build-test")
+	defer stop()
+
+	if response := getStringResponse(t, listenURL); response != "lrt/test: OK" {
+		t.Fatalf("Got unexpected response from lrt: %s", response)
+	}
+	var status struct{ Binary string }
+	response := getStringResponse(t, &url.URL{Scheme: listenURL.Scheme, Host: listenURL.Host, Path: "/__lrt/status", RawQuery: "format=json"})
+	if err := json.Unmarshal([]byte(response), &status); err != nil {
+		t.Fatalf("Got unexpected response from lrt: %s", response)
+	}
+	defer os.RemoveAll(filepath.Dir(status.Binary))
+	if !strings.HasPrefix(status.Binary, fmt.Sprintf("/dev/shm/lrt-%d/ram-build-test-", os.Getuid())) {
+		t.Errorf("Expected the service to be built in /dev/shm, got: %s", status.Binary)
+	}
+}
+
+func TestCheckPrivateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrt-private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "private")
+	shared := filepath.Join(dir, "shared")
+	link := filepath.Join(dir, "link")
+	file := filepath.Join(dir, "file")
+	os.Mkdir(private, 0700)
+	os.Mkdir(shared, 0700)
+	os.Chmod(shared, 0777)
+	os.Symlink(private, link)
+	ioutil.WriteFile(file, nil, 0600)
+
+	for path, ok := range map[string]bool{private: true, shared: false, link: false, file: false, filepath.Join(dir, "missing"): false} {
+		if err := checkPrivateDir(path); (err == nil) != ok {
+			t.Errorf("Expected checkPrivateDir(%s) to be ok=%v, got: %v", filepath.Base(path), ok, err)
+		}
+	}
+}
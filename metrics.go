@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lrt's own metrics, served in the prometheus text format on /__lrt/metrics
+var (
+	rebuildsTotal      = &counter{name: "lrt_rebuilds_total", help: "Number of times lrt has rebuilt the service."}
+	buildFailuresTotal = &counter{name: "lrt_build_failures_total", help: "Number of builds that failed."}
+	bootFailuresTotal  = &counter{name: "lrt_boot_failures_total", help: "Number of times the service exited or timed out before becoming healthy."}
+	buildDuration      = newHistogram("lrt_build_duration_seconds", "How long go build took.", slowBuckets)
+	bootDuration       = newHistogram("lrt_boot_duration_seconds", "How long the service took to become healthy after starting.", slowBuckets)
+	queueWaitDuration  = newHistogram("lrt_queue_wait_seconds", "How long requests waited for the service to be ready.", fastBuckets)
+	requestDuration    = newHistogram("lrt_request_duration_seconds", "How long proxied requests took, including waiting for the service.", fastBuckets)
+	metrics            = []metric{rebuildsTotal, buildFailuresTotal, bootFailuresTotal, buildDuration, bootDuration, queueWaitDuration, requestDuration}
+	slowBuckets        = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	fastBuckets        = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// counter is a prometheus counter
+type counter struct {
+	name  string
+	help  string
+	value int64
+}
+
+func (c *counter) inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, atomic.LoadInt64(&c.value))
+}
+
+// histogram is a prometheus histogram of durations
+type histogram struct {
+	lock    sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	counts  []int64
+	count   int64
+	sum     float64
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bucket := range h.buckets {
+		if d.Seconds() <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += d.Seconds()
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bucket := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bucket, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", h.name, h.count, h.name, h.sum, h.name, h.count)
+}
+
+// serveMetrics serves /__lrt/metrics
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newHandler returns the handler for requests to lrt: the proxy to the
+// service, wrapped in whichever extra behaviour has been asked for.
+func newHandler() http.Handler {
+	lrtMux.HandleFunc("/__lrt/logs", serveLogs)
+	lrtMux.HandleFunc("/__lrt/logs/stream", streamLogs)
+	lrtMux.Handle("/__lrt/pprof/", servePprof())
+	lrtMux.HandleFunc("/__lrt/metrics", serveMetrics)
+	lrtMux.HandleFunc("/__lrt/status", serveStatus)
+	lrtMux.HandleFunc("/__lrt/status/stream", streamStatus)
+	lrtMux.HandleFunc("/__lrt/watches", serveWatches)
+	lrtMux.HandleFunc("/__lrt/browser-reload", streamBrowserReloads)
+
+	var handler http.Handler = &blockingProxy{newProxy()}
+	if *shadowFlag > 0 {
+		handler = withShadow(handler)
+	}
+	if *warmupFlag > 0 {
+		handler = withWarmupRecording(handler)
+	}
+	if *serveStaleFlag {
+		handler = withStaleResponses(handler)
+	}
+	if *latencyFlag > 0 || *errorRateFlag > 0 {
+		handler = withFaults(handler)
+	}
+	if *captureFlag > 0 {
+		handler = withCapture(handler)
+	}
+	handler = withLrtRoutes(handler)
+	if len(staticMounts) > 0 {
+		handler = withStatic(handler)
+	}
+	if len(routes) > 0 {
+		handler = withRoutes(handler)
+	}
+	if *basicAuthFlag != "" {
+		handler = withBasicAuth(handler)
+	}
+	if *corsFlag || len(*corsOriginFlag) > 0 {
+		handler = withCORS(handler)
+	}
+	if *accessLogFlag != "" {
+		handler = withAccessLog(handler)
+	}
+	return handler
+}
+
+// lrtMux serves lrt's own pages, under /__lrt/
+var lrtMux = http.NewServeMux()
+
+// withLrtRoutes sends requests for /__lrt/ to lrt itself instead of the service.
+func withLrtRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/__lrt/") {
+			lrtMux.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withFaults delays requests by -inject-latency, and fails a random
+// -inject-error-rate of them, so clients' timeout and retry handling can be
+// tested against the real service.
+func withFaults(next http.Handler) http.Handler {
+	rand.Seed(time.Now().UnixNano())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *latencyFlag > 0 {
+			select {
+			case <-time.After(*latencyFlag):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if *errorRateFlag > 0 && rand.Float64() < *errorRateFlag {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("lrt: injected error (see -inject-error-rate)\n"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withBasicAuth requires the username and password from -basic-auth on
+// every request.
+func withBasicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(username+":"+password), []byte(*basicAuthFlag)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lrt", charset="UTF-8"`)
+			http.Error(w, "lrt: unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// the service doesn't need to see lrt's credentials
+		r.Header.Del("Authorization")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCORS adds CORS headers to every response, and answers preflight
+// requests without bothering the service.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowOrigin, credentials := corsOrigin(origin)
+		if allowOrigin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setHeaders := func(h http.Header) {
+			h.Set("Access-Control-Allow-Origin", allowOrigin)
+			if credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+				h.Add("Vary", "Origin")
+			}
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			setHeaders(w.Header())
+			w.Header().Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(&responseWriter{ResponseWriter: w, beforeWriteHeader: setHeaders}, r)
+	})
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin for a request from
+// origin ("" if it isn't allowed), and whether it may send credentials. Only
+// origins listed in -cors-origin get credentials, as otherwise any page open
+// in the browser could read the service's responses as you. Without
+// -cors-origin (or with "*") any origin is allowed, without credentials.
+func corsOrigin(origin string) (string, bool) {
+	if len(*corsOriginFlag) == 0 {
+		return "*", false
+	}
+	anyOrigin := false
+	for _, allowed := range *corsOriginFlag {
+		if allowed == "*" {
+			anyOrigin = true
+		} else if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	if anyOrigin {
+		return "*", false
+	}
+	return "", false
+}
+
+// responseWriter wraps an http.ResponseWriter so that middleware can change
+// the headers after the service has set them, and see what was sent. It
+// supports flushing and hijacking so that streaming responses and websockets
+// still work.
+type responseWriter struct {
+	http.ResponseWriter
+	beforeWriteHeader func(http.Header)
+	onWrite           func([]byte)
+	wroteHeader       bool
+	status            int
+	bytes             int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		w.wroteHeader = true
+		w.status = status
+		if w.beforeWriteHeader != nil {
+			w.beforeWriteHeader(w.Header())
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	if w.onWrite != nil {
+		w.onWrite(p[:n])
+	}
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("lrt: %T does not support hijacking", w.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
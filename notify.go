@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// notifyOnBuildResult shows a desktop notification when a build fails, and
+// when the build is fixed again, for -notify.
+func notifyOnBuildResult() {
+	notifier := notifyCommand("lrt", "")
+	if _, err := exec.LookPath(notifier[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "lrt: warning: -notify needs %s, but it is not in your $PATH\n", notifier[0])
+		return
+	}
+
+	watchBuildResults(func(title string, message string) {
+		notify("lrt: "+title, message)
+	})
+}
+
+// watchBuildResults calls onResult when a build fails (with the first error),
+// and when a build succeeds after failing.
+func watchBuildResults(onResult func(title string, message string)) {
+	ch := subscribeEvents()
+	go func() {
+		failing := false
+		for e := range ch {
+			switch e["type"] {
+			case "build-failed":
+				message := "the build failed"
+				if diagnostics, ok := e["diagnostics"].([]diagnostic); ok && len(diagnostics) > 0 {
+					d := diagnostics[0]
+					message = fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+					if d.Column > 0 {
+						message = fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+					}
+				}
+				failing = true
+				onResult("build failed", message)
+			case "build-succeeded":
+				if failing {
+					failing = false
+					onResult("build fixed", "the build succeeded again")
+				}
+			}
+		}
+	}()
+}
+
+// notify shows a desktop notification
+func notify(title string, message string) {
+	cmd := notifyCommand(title, message)
+	exec.Command(cmd[0], cmd[1:]...).Run()
+}
+
+// notifyCommand is the command that shows a notification on this platform
+func notifyCommand(title string, message string) []string {
+	if runtime.GOOS == "darwin" {
+		return []string{"osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run",
+			title, message}
+	}
+	return []string{"notify-send", "--app-name=lrt", title, message}
+}
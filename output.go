@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lineWriter copies the service's output through to out as it arrives, and
+// calls onLine with each complete line so that lrt can watch what the service
+// is saying.
+type lineWriter struct {
+	lock    sync.Mutex
+	out     io.Writer
+	onLine  func(line string)
+	partial []byte
+
+	// flushes a partial line once the output has been idle for
+	// partialLineWait, so that prompts aren't held back
+	idle *time.Timer
+
+	// if set, output is written a line at a time with this prefix
+	prefix func() string
+}
+
+// a partial line is treated as a whole line once it is this long, or once
+// nothing more has been written for this long
+const (
+	partialLineLimit = 64 * 1024
+	partialLineWait  = 100 * time.Millisecond
+)
+
+// stdout and stderr are used for lrt's own messages once it is running, so
+// that they are kept in the logs alongside the service's output.
+var (
+	stdout io.Writer = &lineWriter{out: os.Stdout, onLine: func(line string) { serviceLogs.add("lrt", line) }}
+	stderr io.Writer = &lineWriter{out: os.Stderr, onLine: func(line string) { serviceLogs.add("lrt", line) }}
+)
+
+// serviceStdout is where the service's stdout is copied to: lrt's stdout,
+// unless -json is using it for events.
+var serviceStdout io.Writer = os.Stdout
+
+// log levels, set by -log-level (or -quiet and -verbose)
+const (
+	levelError = iota
+	levelInfo
+	levelDebug
+)
+
+var logLevels = map[string]int{"error": levelError, "info": levelInfo, "debug": levelDebug}
+
+var logLevel = levelInfo
+
+// infof prints one of lrt's routine messages (like "rebuilding..."), unless
+// -quiet is set. Errors and warnings are always printed to stderr.
+func infof(format string, args ...interface{}) {
+	if logLevel >= levelInfo {
+		fmt.Fprintf(stdout, format, args...)
+	}
+}
+
+// debugf prints details that help debug lrt itself, with -verbose
+func debugf(format string, args ...interface{}) {
+	if logLevel >= levelDebug {
+		fmt.Fprintf(stdout, format, args...)
+	}
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n, err := len(p), error(nil)
+	if l.prefix == nil {
+		n, err = l.out.Write(p)
+	}
+
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimSuffix(l.partial[:i], []byte("\r")))
+		if l.prefix != nil {
+			io.WriteString(l.out, l.prefix()+line+"\n")
+		}
+		l.onLine(line)
+		l.partial = l.partial[i+1:]
+	}
+	if len(l.partial) >= partialLineLimit {
+		l.flushPartial()
+	}
+
+	if len(l.partial) == 0 {
+		if l.idle != nil {
+			l.idle.Stop()
+		}
+	} else if l.idle == nil {
+		l.idle = time.AfterFunc(partialLineWait, func() {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			l.flushPartial()
+		})
+	} else {
+		l.idle.Reset(partialLineWait)
+	}
+
+	return n, err
+}
+
+// flushPartial handles what has been written since the last newline as if it
+// were a whole line. The caller must hold l.lock.
+func (l *lineWriter) flushPartial() {
+	if len(l.partial) == 0 {
+		return
+	}
+	line := string(l.partial)
+	if l.prefix != nil {
+		io.WriteString(l.out, l.prefix()+line+"\n")
+	}
+	l.onLine(line)
+	l.partial = nil
+}
+
+// outputPrefix returns the prefix for lines of the service's output on the
+// given stream, as set by -timestamps and -tag, or nil if there isn't one.
+func outputPrefix(stream string) func() string {
+	if !*timestampsFlag && *tagFlag == "" {
+		return nil
+	}
+	color := useColor()
+	return func() string {
+		prefix := ""
+		if *timestampsFlag {
+			prefix = time.Now().Format("15:04:05.000") + " "
+			if color {
+				prefix = "\033[2m" + prefix + "\033[0m"
+			}
+		}
+		if *tagFlag != "" {
+			tag := "[" + *tagFlag + "] "
+			if color && stream == "stderr" {
+				tag = "\033[31m" + tag + "\033[0m"
+			} else if color {
+				tag = "\033[36m" + tag + "\033[0m"
+			}
+			prefix += tag
+		}
+		return prefix
+	}
+}
+
+// useColor is true if -color is always, or auto and stdout is a terminal
+// (and NO_COLOR isn't set).
+func useColor() bool {
+	switch *colorFlag {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// recentOutput keeps the last lines the service printed since it was started,
+// so that they can be shown when it fails.
+var recentOutput = &lineBuffer{size: 30}
+
+// withRecentOutput appends the service's recent output to an error message
+func withRecentOutput(msg string) []byte {
+	lines := recentOutput.all()
+	if len(lines) == 0 {
+		return []byte(msg)
+	}
+	return []byte(msg + "\nrecent output:\n" + strings.Join(lines, "\n") + "\n")
+}
+
+// lineBuffer keeps the last size lines added to it
+type lineBuffer struct {
+	lock  sync.Mutex
+	size  int
+	lines []string
+}
+
+func (b *lineBuffer) add(line string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lines = append(b.lines, line)
+	if len(b.lines) > b.size {
+		b.lines = b.lines[len(b.lines)-b.size:]
+	}
+}
+
+func (b *lineBuffer) all() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string{}, b.lines...)
+}
+
+func (b *lineBuffer) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lines = nil
+}
+
+// clearScreen clears the terminal (and its scrollback), if lrt is running in one
+func clearScreen() {
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		os.Stdout.WriteString("\033[H\033[2J\033[3J")
+	}
+}
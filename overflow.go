@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// rescanNeeded is set when lrt may have missed changes, so that the next
+// rebuild lists (and watches) the dependencies again, accessed atomically
+var rescanNeeded int32
+
+// missedEvents is called when lrt can't be sure it has seen every change: when
+// the kernel's event queue overflowed (e.g. during a large git checkout), or a
+// watched directory was removed, taking its watch with it. Rather than
+// silently serving a stale build, it rescans the dependencies and rebuilds.
+func missedEvents(reason string, changed func()) {
+	fmt.Fprintf(stderr, "lrt: warning: %s, so some changes may have been missed; rebuilding to be safe\n", reason)
+	atomic.StoreInt32(&rescanNeeded, 1)
+	go changed()
+}
+
+// forgetWatchedDir stops lrt thinking dir is watched, returning false if it
+// wasn't. Watches are removed when their directory is, so if it comes back it
+// needs watching again.
+func forgetWatchedDir(dir string) bool {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	if !watchedDir[dir] {
+		return false
+	}
+	delete(watchedDir, dir)
+	watcher.Remove(dir)
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockedPidFile is held open (and locked) for as long as lrt runs
+var lockedPidFile *os.File
+
+// pidFile returns the path of the pid file: -pid-file, or by default one per
+// -listen address (or per package with -no-proxy) in the temp directory.
+func pidFile() string {
+	if *pidFileFlag == "none" {
+		return ""
+	}
+	if *pidFileFlag != "" {
+		return *pidFileFlag
+	}
+	key := listenURL.String()
+	if *noProxyFlag {
+		dir, _ := os.Getwd()
+		key = "package:" + filepath.Join(dir, packageName)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(os.TempDir(), "lrt-"+hex.EncodeToString(sum[:6])+".pid")
+}
+
+// mustLockPidFile writes lrt's pid to its pid file, exiting with a message
+// pointing at the other lrt if it is already locked. With -listen-fallback,
+// the next port is tried instead.
+func mustLockPidFile() {
+	for tries := 0; ; tries++ {
+		path := pidFile()
+		if path == "" {
+			return
+		}
+
+		f, err := lockPidFile(path)
+		if err == syscall.EWOULDBLOCK && tries < *listenFallbackFlag && *pidFileFlag == "" && !*noProxyFlag && listenURL.Scheme != "unix" {
+			f.Close()
+			nextListenPort(listenURL)
+			continue
+		}
+		if err != nil {
+			exitWithPidFileError(f, err)
+		}
+
+		lockedPidFile = f
+		atExit(func() { os.Remove(lockedPidFile.Name()) })
+		return
+	}
+}
+
+// mustRelockPidFile moves lrt's pid file once it is listening, as
+// -listen-fallback may have had to skip ports that other programs were using,
+// so that the pid file is for the address lrt is actually listening on.
+func mustRelockPidFile() {
+	if lockedPidFile == nil || pidFile() == lockedPidFile.Name() {
+		return
+	}
+	f, err := lockPidFile(pidFile())
+	if err != nil {
+		exitWithPidFileError(f, err)
+	}
+	old := lockedPidFile
+	lockedPidFile = f
+	os.Remove(old.Name())
+	old.Close()
+}
+
+// lockPidFile opens and locks the pid file at path and writes lrt's pid to
+// it. If another lrt has it locked, the error is syscall.EWOULDBLOCK and the
+// file is returned so that its pid can be read.
+func lockPidFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+		return f, err
+	}
+
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return f, nil
+}
+
+// exitWithPidFileError explains why lrt couldn't lock its pid file, pointing
+// at the other lrt if there is one, and exits.
+func exitWithPidFileError(f *os.File, err error) {
+	if err != syscall.EWOULDBLOCK {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		exit(1)
+	}
+
+	// the pid file only has the other lrt's pid, but it was written
+	// when that lrt started and we know what it is locking
+	contents, _ := ioutil.ReadAll(f)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(contents)))
+	fmt.Fprintf(os.Stderr, "lrt: another lrt is already %s (pid %d", pidFileOwner(), pid)
+	if info, err := f.Stat(); err == nil {
+		fmt.Fprintf(os.Stderr, ", started %s ago", time.Since(info.ModTime()).Round(time.Second))
+	}
+	fmt.Fprintf(os.Stderr, ")\n")
+	fmt.Fprintf(os.Stderr, "     hint: stop it with kill %d, or use a different -listen (or -listen-fallback)\n", pid)
+	f.Close()
+	exit(1)
+}
+
+// pidFileOwner describes what the lrt holding the pid file is doing
+func pidFileOwner() string {
+	switch {
+	case *pidFileFlag != "":
+		return "using " + *pidFileFlag
+	case *noProxyFlag:
+		return "running " + packageName
+	default:
+		return "listening on " + listenURL.String()
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// portForward is a kubectl port-forward tunnel that lrt keeps open, set by
+// -port-forward
+type portForward struct {
+	namespace string
+	resource  string // e.g. svc/postgres
+	localPort string
+	ports     string // as given to kubectl, e.g. 15432:5432
+}
+
+var portForwards []*portForward
+
+// parsePortForward parses a -port-forward like svc/postgres=5432,
+// staging/svc/postgres=15432:5432 or pod/api-0=8080
+func parsePortForward(value string) (*portForward, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("expected [namespace/]type/name=[local:]port, e.g. svc/postgres=5432")
+	}
+	p := &portForward{resource: value[:i], ports: value[i+1:]}
+	if parts := strings.Split(p.resource, "/"); len(parts) == 3 {
+		p.namespace, p.resource = parts[0], parts[1]+"/"+parts[2]
+	} else if len(parts) != 2 {
+		return nil, fmt.Errorf("expected [namespace/]type/name=[local:]port, e.g. svc/postgres=5432")
+	}
+	ports := strings.Split(p.ports, ":")
+	for _, port := range ports {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 || len(ports) > 2 {
+			return nil, fmt.Errorf("expected the port to be a number or local:remote, e.g. 15432:5432")
+		}
+	}
+	p.localPort = ports[0]
+	return p, nil
+}
+
+func (p *portForward) String() string {
+	if p.namespace != "" {
+		return p.namespace + "/" + p.resource
+	}
+	return p.resource
+}
+
+// startPortForwards starts each -port-forward, keeping it open until lrt
+// exits, and waits (for up to -health-check-timeout) for them to accept
+// connections, so that the service doesn't start before its dependencies
+// can be reached.
+func startPortForwards() {
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: -port-forward needs kubectl, but it is not in your $PATH")
+		fmt.Fprintln(os.Stderr, "     hint: see https://kubernetes.io/docs/tasks/tools/")
+		exit(1)
+	}
+
+	stopping := make(chan bool)
+	atExit(func() { close(stopping) })
+	for _, p := range portForwards {
+		go p.supervise(stopping)
+	}
+
+	deadline := time.Now().Add(*timeoutFlag)
+	for _, p := range portForwards {
+		for {
+			if conn, err := net.Dial("tcp", "localhost:"+p.localPort); err == nil {
+				conn.Close()
+				infof("lrt: forwarding localhost:%s to %s\n", p.localPort, p)
+				break
+			}
+			if time.Now().After(deadline) {
+				fmt.Fprintf(stderr, "lrt: warning: the port-forward to %s is not accepting connections on localhost:%s yet\n", p, p.localPort)
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// supervise runs kubectl port-forward, restarting it whenever it exits (as it
+// does when the pod restarts, or the connection drops), until stopping is
+// closed.
+func (p *portForward) supervise(stopping chan bool) {
+	delay := time.Second
+	for {
+		args := []string{"port-forward"}
+		if p.namespace != "" {
+			args = append(args, "-n", p.namespace)
+		}
+		if *kubeContextFlag != "" {
+			args = append(args, "--context", *kubeContextFlag)
+		}
+		cmd := exec.Command("kubectl", append(args, p.resource, p.ports)...)
+		cmd.Stdout = &lineWriter{out: ioutil.Discard, onLine: p.onLine}
+		cmd.Stderr = cmd.Stdout
+		// don't let ctrl-c reach kubectl before lrt is ready to stop it
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+		started := time.Now()
+		exited := make(chan bool)
+		err := cmd.Start()
+		if err == nil {
+			go func() {
+				cmd.Wait()
+				close(exited)
+			}()
+			select {
+			case <-stopping:
+				cmd.Process.Signal(syscall.SIGTERM)
+				<-exited
+				return
+			case <-exited:
+			}
+			err = fmt.Errorf("%s", cmd.ProcessState)
+		}
+
+		if time.Since(started) > time.Minute {
+			delay = time.Second
+		}
+		fmt.Fprintf(stderr, "lrt: the port-forward to %s stopped (%s), reconnecting in %s\n", p, err, delay)
+		select {
+		case <-stopping:
+			return
+		case <-time.After(delay):
+		}
+		if delay < 10*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// onLine handles kubectl's output: its routine messages are only shown with
+// -verbose, anything else (like errors) is shown as a warning.
+func (p *portForward) onLine(line string) {
+	if strings.HasPrefix(line, "Forwarding from") || strings.HasPrefix(line, "Handling connection") {
+		debugf("lrt: port-forward %s: %s\n", p, line)
+		return
+	}
+	fmt.Fprintf(stderr, "lrt: port-forward %s: %s\n", p, line)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// detectServiceHost waits for the service (or any process in its process
+// group) to start listening on a TCP port, and returns the host:port that
+// requests should be forwarded to. If the service listens on the port we asked
+// it to, serviceURL.Host is returned unchanged. It returns false if stop is
+// closed before the service starts listening.
+func detectServiceHost(pgid int, stop <-chan bool) (string, bool) {
+	for {
+		ports := listeningPorts(pgid)
+		for _, port := range ports {
+			if strconv.Itoa(port) == serviceURL.Port() {
+				return serviceURL.Host, true
+			}
+		}
+		if len(ports) > 0 {
+			return net.JoinHostPort(serviceURL.Hostname(), strconv.Itoa(ports[0])), true
+		}
+
+		select {
+		case <-stop:
+			return "", false
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// listeningPorts returns the TCP ports that processes in the process group
+// pgid are listening on, lowest first. On linux this is read from /proc,
+// elsewhere we ask lsof.
+func listeningPorts(pgid int) []int {
+	var ports []int
+	if runtime.GOOS == "linux" {
+		ports = procListeningPorts(pgid)
+	} else {
+		ports = lsofListeningPorts(pgid)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func procListeningPorts(pgid int) []int {
+	inodes := map[string]bool{}
+
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, proc := range procs {
+		stat, err := ioutil.ReadFile(proc + "/stat")
+		if err != nil {
+			continue
+		}
+		// the command name is in parens and may contain spaces, so skip past it:
+		// pid (comm) state ppid pgrp ...
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 3 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+
+		fds, _ := ioutil.ReadDir(proc + "/fd")
+		for _, fd := range fds {
+			link, err := os.Readlink(proc + "/fd/" + fd.Name())
+			if err == nil && strings.HasPrefix(link, "socket:[") {
+				inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+			}
+		}
+	}
+
+	var ports []int
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		for _, line := range strings.Split(string(contents), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[3] != "0A" || !inodes[fields[9]] {
+				continue
+			}
+			address := fields[1]
+			port, err := strconv.ParseInt(address[strings.LastIndexByte(address, ':')+1:], 16, 32)
+			if err == nil {
+				ports = append(ports, int(port))
+			}
+		}
+	}
+	return ports
+}
+
+func lsofListeningPorts(pgid int) []int {
+	output, err := exec.Command("lsof", "-a", "-g", strconv.Itoa(pgid), "-iTCP", "-sTCP:LISTEN", "-P", "-n", "-Fn").Output()
+	if err != nil {
+		return nil
+	}
+
+	var ports []int
+	for _, line := range strings.Split(string(output), "\n") {
+		if !strings.HasPrefix(line, "n") {
+			continue
+		}
+		port, err := strconv.Atoi(line[strings.LastIndexByte(line, ':')+1:])
+		if err == nil {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// servePprof forwards requests for /__lrt/pprof/ to the service's
+// net/http/pprof handlers, at -pprof. Requests wait for the service to be
+// ready, but unlike proxied requests don't hold up the next rebuild while
+// a long-running profile is collected.
+func servePprof() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lockForRequest()
+		// -detect-port can move the service, so find it again each time
+		target := pprofURL()
+		proxy := &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = target.Scheme
+				req.URL.Host = target.Host
+				req.URL.Path = target.Path + strings.TrimPrefix(req.URL.Path, "/__lrt/pprof/")
+				req.Host = target.Host
+			},
+			FlushInterval: -1,
+		}
+		if target.Host == serviceURL.Host {
+			proxy.Transport = serviceTransport
+		}
+		proxyLock.RUnlock()
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// pprofURL is where the service serves pprof: either a path on the service
+// (like "/debug/pprof/"), or a separate address (like "localhost:6060" or
+// "localhost:6060/debug/pprof/").
+func pprofURL() *url.URL {
+	str := *pprofFlag
+	if strings.HasPrefix(str, "/") {
+		return &url.URL{Scheme: serviceURL.Scheme, Host: serviceURL.Host, Path: strings.TrimSuffix(str, "/") + "/"}
+	}
+
+	host, path := str, "/debug/pprof/"
+	if i := strings.Index(str, "/"); i >= 0 {
+		host, path = str[:i], strings.TrimSuffix(str[i:], "/")+"/"
+	}
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	return &url.URL{Scheme: "http", Host: host, Path: path}
+}
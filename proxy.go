@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serviceTransport is used for every request lrt makes to the service (both
+// proxied requests and health checks) so that they go over the unix socket
+// when the service listens on one.
+var serviceTransport = func() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialService
+	return transport
+}()
+
+// dialService connects to the service, over serviceSocket if it is set.
+func dialService(ctx context.Context, network string, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: *proxyDialFlag}
+	if serviceSocket != "" {
+		return dialer.DialContext(ctx, "unix", serviceSocket)
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// streams are the streaming responses (server-sent events and websockets)
+// currently being proxied. As each request holds a read lock on the proxy
+// until it completes, we end them before rebuilding instead of waiting forever.
+var (
+	streamsLock sync.Mutex
+	streams     = map[stream]bool{}
+)
+
+type stream interface {
+	interrupt()
+}
+
+// newProxy returns a reverse proxy that forwards requests to the service
+func newProxy() *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(serviceURL)
+	proxy.Transport = serviceTransport
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		if len(replicaURLs) > 0 {
+			pickReplica(req)
+		}
+		setForwardedHeaders(req)
+		if len(*browserReloadFlag) > 0 {
+			allowBrowserReloadScript(req)
+		}
+	}
+	proxy.ErrorHandler = proxyError
+	proxy.FlushInterval = *flushFlag
+	if proxy.FlushInterval == 0 {
+		proxy.FlushInterval = -1
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if conn, ok := resp.Body.(io.ReadWriteCloser); ok {
+				resp.Body = trackStream(&upgradeStream{ReadWriteCloser: conn}).(*upgradeStream)
+			}
+		} else if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			resp.Body = trackStream(&eventStream{ReadCloser: resp.Body}).(*eventStream)
+		} else if len(*browserReloadFlag) > 0 {
+			return addBrowserReloadScript(resp)
+		}
+		return nil
+	}
+	return proxy
+}
+
+// setForwardedHeaders sets the headers a production load balancer would, and
+// rewrites the Host header if asked to (by -host-header or -host-rewrite). (X-Forwarded-For is always set by the
+// reverse proxy.)
+func setForwardedHeaders(req *http.Request) {
+	if *forwardedFlag {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			req.Header.Set("X-Real-IP", ip)
+		}
+	}
+
+	switch *hostHeaderFlag {
+	case "", "preserve":
+		rewriteHost(req)
+	case "service":
+		req.Host = serviceURL.Host
+	default:
+		req.Host = *hostHeaderFlag
+	}
+}
+
+// proxyError responds when a request could not be proxied to the service,
+// making it clear whether the service was slow or unreachable.
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		status = http.StatusGatewayTimeout
+	}
+	if req, ok := r.Context().Value(inflightKey{}).(*inflightRequest); ok && atomic.LoadInt32(&req.drained) == 1 {
+		msg := fmt.Sprintf("lrt: cancelled %s %s as it was still running after -drain %s", r.Method, r.URL.Path, *drainFlag)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(msg + "\n"))
+		return
+	}
+	if errors.Is(err, context.Canceled) && r.Context().Err() == context.Canceled {
+		// the client went away, there's nobody to tell
+		return
+	}
+	if retry, ok := r.Context().Value(retryKey{}).(*retryState); ok && retry.allowed && isConnectionError(err) {
+		retry.failed = true
+		return
+	}
+
+	msg := fmt.Sprintf("lrt: could not proxy %s %s: %v", r.Method, r.URL.Path, err)
+	if status == http.StatusGatewayTimeout {
+		msg += "\n     hint: your service took too long to respond (see -proxy-header-timeout and -proxy-timeout)"
+	}
+	fmt.Fprintln(stderr, msg)
+
+	w.WriteHeader(status)
+	w.Write([]byte(msg + "\n"))
+}
+
+// inflight are the requests currently being proxied, so that they can be
+// cancelled once -drain has passed.
+var (
+	inflightLock sync.Mutex
+	inflight     = map[*inflightRequest]bool{}
+)
+
+// inflightKey is the context key for the inflightRequest of a request
+type inflightKey struct{}
+
+type inflightRequest struct {
+	cancel  func()
+	drained int32
+}
+
+// trackRequest returns a copy of r that can be cancelled by cancelRequests,
+// and a function to call once the request has finished.
+func trackRequest(r *http.Request) (*http.Request, func()) {
+	ctx, cancel := context.WithCancel(r.Context())
+	req := &inflightRequest{cancel: cancel}
+
+	inflightLock.Lock()
+	inflight[req] = true
+	inflightLock.Unlock()
+
+	return r.WithContext(context.WithValue(ctx, inflightKey{}, req)), func() {
+		inflightLock.Lock()
+		delete(inflight, req)
+		inflightLock.Unlock()
+		cancel()
+	}
+}
+
+// cancelRequests cancels all in-flight requests, returning how many there were.
+func cancelRequests() int {
+	inflightLock.Lock()
+	defer inflightLock.Unlock()
+	for req := range inflight {
+		atomic.StoreInt32(&req.drained, 1)
+		req.cancel()
+	}
+	return len(inflight)
+}
+
+// retryKey is the context key for the retryState of a request
+type retryKey struct{}
+
+// retryState lets proxyError tell blockingProxy that a request should be
+// retried, instead of responding with an error.
+type retryState struct {
+	allowed bool
+	failed  bool
+}
+
+// isConnectionError is true if err means the service is not running (or has
+// just exited), rather than that it failed to handle the request.
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// lockProxy takes the write lock on the proxy, ending any streaming responses
+// that would otherwise hold it open indefinitely. With -drain, requests that are
+// still running once it has passed are cancelled.
+func lockProxy() {
+	locked := make(chan bool)
+	go func() {
+		var drained <-chan time.Time
+		if *drainFlag > 0 {
+			drained = time.After(*drainFlag)
+		}
+		for {
+			interruptStreams()
+			select {
+			case <-locked:
+				return
+			case <-drained:
+				if n := cancelRequests(); n > 0 {
+					fmt.Fprintf(stderr, "lrt: warning: cancelling %d requests that were still running after -drain %s\n", n, *drainFlag)
+				}
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+
+	proxyLock.Lock()
+	close(locked)
+}
+
+func trackStream(s stream) stream {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	streams[s] = true
+	return s
+}
+
+func untrackStream(s stream) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	delete(streams, s)
+}
+
+func interruptStreams() {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	for s := range streams {
+		s.interrupt()
+	}
+}
+
+// eventStream is the body of a text/event-stream response. When interrupted
+// it ends cleanly, so clients see the end of the response (and EventSource
+// reconnects) instead of a broken connection.
+type eventStream struct {
+	io.ReadCloser
+	interrupted int32
+}
+
+func (e *eventStream) Read(p []byte) (int, error) {
+	n, err := e.ReadCloser.Read(p)
+	if err != nil && atomic.LoadInt32(&e.interrupted) == 1 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (e *eventStream) Close() error {
+	untrackStream(e)
+	return e.ReadCloser.Close()
+}
+
+func (e *eventStream) interrupt() {
+	atomic.StoreInt32(&e.interrupted, 1)
+	e.ReadCloser.Close()
+}
+
+// upgradeStream is the connection to the service after a protocol upgrade
+// (usually to a websocket). When interrupted we close it, which closes the
+// client's connection too.
+type upgradeStream struct {
+	io.ReadWriteCloser
+}
+
+func (u *upgradeStream) Close() error {
+	untrackStream(u)
+	return u.ReadWriteCloser.Close()
+}
+
+func (u *upgradeStream) interrupt() {
+	u.ReadWriteCloser.Close()
+}
+
+// serviceAddress describes where the service listens, for log messages
+func serviceAddress() string {
+	if serviceSocket != "" {
+		return "unix:" + serviceSocket
+	}
+	return serviceURL.String()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// writeQuickfix writes the errors from each failed build to path in the
+// file:line:col: message format that vim and emacs understand, and empties it
+// when the build succeeds. If path is "-" errors are printed with lrt's own
+// messages instead (to stderr with -json, so they stay out of the events).
+func writeQuickfix(path string) {
+	ch := subscribeEvents()
+	go func() {
+		for e := range ch {
+			switch e["type"] {
+			case "build-failed":
+				diagnostics, _ := e["diagnostics"].([]diagnostic)
+				if path == "-" {
+					writeQuickfixLines(stdout, diagnostics)
+					continue
+				}
+				var b strings.Builder
+				writeQuickfixLines(&b, diagnostics)
+				if err := ioutil.WriteFile(path, []byte(b.String()), 0644); err != nil {
+					fmt.Fprintf(stderr, "lrt: warning: could not write -quickfix: %s\n", err)
+				}
+			case "build-succeeded":
+				if path != "-" {
+					ioutil.WriteFile(path, nil, 0644)
+				}
+			}
+		}
+	}()
+}
+
+func writeQuickfixLines(w io.Writer, diagnostics []diagnostic) {
+	for _, d := range diagnostics {
+		file := d.File
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+		column := d.Column
+		if column == 0 {
+			column = 1
+		}
+		fmt.Fprintf(w, "%s:%d:%d: %s\n", file, d.Line, column, d.Message)
+	}
+}
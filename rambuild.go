@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ramFilesystems are the RAM-backed (tmpfs) filesystems -ram-build looks for
+var ramFilesystems = []string{"/dev/shm"}
+
+// ramDir is lrt's directory on a RAM-backed filesystem with -ram-build, or ""
+var ramDir string
+
+// mustFindRAMDir sets ramDir for -ram-build, so that the service is built
+// (and go build uses a temporary work directory) in memory, saving disk I/O on
+// each rebuild on machines with slow disks or antivirus software that scans
+// every new file. go's build cache stays on disk. If there isn't a RAM-backed
+// filesystem, lrt says so and builds on disk.
+func mustFindRAMDir() {
+	if !*ramBuildFlag {
+		return
+	}
+	for _, fs := range ramFilesystems {
+		if info, err := os.Stat(fs); err != nil || !info.IsDir() {
+			continue
+		}
+		// the filesystem is shared, so each user gets their own directory
+		dir := filepath.Join(fs, fmt.Sprintf("lrt-%d", os.Getuid()))
+		if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0700); err != nil {
+			debugf("lrt: -ram-build: %s\n", err)
+			continue
+		}
+		// anyone can create lrt-<uid> before us, so only use it if it's ours
+		for _, d := range []string{dir, filepath.Join(dir, "tmp")} {
+			if err := checkPrivateDir(d); err != nil {
+				fmt.Fprintf(stderr, "lrt: warning: -ram-build: not using %s: %s, so building on disk\n", d, err)
+				return
+			}
+		}
+		ramDir = dir
+		debugf("lrt: building in %s\n", dir)
+		return
+	}
+	fmt.Fprintf(stderr, "lrt: warning: -ram-build: there is no RAM-backed filesystem (like /dev/shm) on this machine, so building on disk\n")
+}
+
+// checkPrivateDir returns an error unless dir is a real directory (not a
+// symlink) that belongs to the current user and only they can access.
+func checkPrivateDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("it is not a directory")
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("it belongs to another user")
+	}
+	if info.Mode().Perm() != 0700 {
+		return fmt.Errorf("its mode is %s, not drwx------", info.Mode())
+	}
+	return nil
+}
+
+// ramBuildEnv is the environment go build needs to use a temporary work
+// directory in ramDir. (The build cache, GOCACHE, is left on disk.)
+func ramBuildEnv() []string {
+	if ramDir == "" {
+		return nil
+	}
+	return []string{"GOTMPDIR=" + filepath.Join(ramDir, "tmp")}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchReloadPatterns sends -reload-signal to the running service whenever a
+// file matching one of the -reload patterns changes, instead of rebuilding it.
+func watchReloadPatterns() {
+	watchPatterns(*reloadFlag, reloadService)
+}
+
+// watchPatterns calls onChange (debounced) with the name of each file that
+// changes and matches one of the patterns.
+func watchPatterns(flagPatterns []string, onChange func(name string)) {
+	if len(flagPatterns) == 0 {
+		return
+	}
+
+	patternWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		exit(1)
+	}
+
+	patterns := []string{}
+	for _, pattern := range flagPatterns {
+		pattern = filepath.Clean(pattern)
+		patterns = append(patterns, pattern)
+
+		dirs, _ := filepath.Glob(filepath.Dir(pattern))
+		for _, dir := range dirs {
+			if err := patternWatcher.Add(dir); err != nil {
+				fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+				exit(1)
+			}
+		}
+	}
+
+	var lock sync.Mutex
+	var changed string
+	debounced := debounceCallable(*debounceFlag, *debounceMaxFlag, func() {
+		lock.Lock()
+		name := changed
+		lock.Unlock()
+		onChange(name)
+	})
+
+	go func() {
+		for {
+			select {
+			case ev := <-patternWatcher.Events:
+				if ev.Op == fsnotify.Chmod {
+					continue
+				}
+				for _, pattern := range patterns {
+					if ok, _ := filepath.Match(pattern, filepath.Clean(ev.Name)); ok {
+						lock.Lock()
+						changed = ev.Name
+						lock.Unlock()
+						go debounced()
+						break
+					}
+				}
+
+			case err := <-patternWatcher.Errors:
+				fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+				exit(1)
+			}
+		}
+	}()
+}
+
+// reloadService sends -reload-signal to the running service
+func reloadService(changed string) {
+	proxyLock.RLock()
+	defer proxyLock.RUnlock()
+
+	if service == nil {
+		return
+	}
+	infof("lrt: %s changed, sending %s to your service\n", changed, reloadSignal)
+	signalService(reloadSignal)
+	emit("service-reloaded", event{"file": changed})
+}
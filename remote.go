@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// set by -remote, see parseRemote
+var (
+	remoteHost string
+	remoteDir  string
+)
+
+// remoteBinary is where the service is built on the remote host, relative to
+// remoteDir
+const remoteBinary = ".lrt/service"
+
+// parseRemote parses -remote, which is host or host:dir. The directory
+// defaults to lrt/<module directory> in the remote user's home.
+func parseRemote(value string, localRoot string) (host string, dir string) {
+	host = value
+	if i := strings.Index(value, ":"); i >= 0 && !strings.HasPrefix(value, "[") {
+		host, dir = value[:i], value[i+1:]
+	}
+	if dir == "" {
+		dir = path.Join("lrt", filepath.Base(localRoot))
+	}
+	return host, strings.TrimSuffix(dir, "/")
+}
+
+// syncRoot is the directory that is copied to the remote host: the module, or
+// the current directory if there isn't one
+func syncRoot() string {
+	if goModuleDir != "" {
+		return goModuleDir
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+// remoteWorkDir is the remote equivalent of the current directory, so that
+// relative packages (and -cmd-args paths) mean the same thing there
+func remoteWorkDir() string {
+	cwd, _ := os.Getwd()
+	rel, err := filepath.Rel(syncRoot(), cwd)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return remoteDir
+	}
+	return path.Join(remoteDir, filepath.ToSlash(rel))
+}
+
+// mustCheckRemote checks that lrt can run go on the remote host, and finds out
+// which platform it builds for.
+func mustCheckRemote() {
+	output, err := exec.Command("ssh", "-o", "BatchMode=yes", remoteHost, "go env GOOS GOARCH").CombinedOutput()
+	lines := strings.Fields(string(output))
+	if err != nil || len(lines) != 2 {
+		fmt.Fprintf(os.Stderr, "lrt: could not run go on %s: %s\n", remoteHost, strings.TrimSpace(string(output)))
+		fmt.Fprintf(os.Stderr, "     hint: check that ssh %s works without a password prompt, and that go is in its $PATH\n", remoteHost)
+		fmt.Fprintf(os.Stderr, "           (for non-interactive logins, e.g. set it in ~/.ssh/environment or ~/.bashrc)\n")
+		exit(1)
+	}
+	targetGoEnv = []string{"GOOS=" + lines[0], "GOARCH=" + lines[1]}
+	infof("lrt: building and running %s on %s (%s/%s) in %s\n", packageName, remoteHost, lines[0], lines[1], remoteDir)
+}
+
+// buildRemotely copies the code to the remote host with rsync and builds it
+// there with the given go build arguments. Errors from rsync are reported
+// like build errors, so they show up on the error page.
+func buildRemotely(args []string) ([]byte, error) {
+	rsync, build := remoteBuildCommands(args)
+	if output, err := rsync.CombinedOutput(); err != nil {
+		return append([]byte("lrt: could not copy your code to "+remoteHost+":\n"), output...), err
+	}
+	return build.CombinedOutput()
+}
+
+// remoteBuildCommands returns the rsync command that copies the code to the
+// remote host, and the ssh command that builds it there
+func remoteBuildCommands(args []string) (rsync *exec.Cmd, build *exec.Cmd) {
+	rsync = exec.Command("rsync", "-az", "--delete", "--exclude", "/.git/", "--exclude", "/.lrt/",
+		syncRoot()+"/", remoteHost+":"+remoteDir+"/")
+
+	// .go files are given relative to the current directory, which
+	// remoteWorkDir mirrors
+	pkgArgs := packageArgs()
+	if len(goFiles) > 0 {
+		cwd, _ := os.Getwd()
+		pkgArgs = nil
+		for _, file := range goFiles {
+			rel, _ := filepath.Rel(cwd, file)
+			pkgArgs = append(pkgArgs, filepath.ToSlash(rel))
+		}
+	}
+
+	script := "mkdir -p " + shellQuote(path.Join(remoteDir, path.Dir(remoteBinary))) +
+		" && cd " + shellQuote(remoteWorkDir()) +
+		" && go build " + shellJoin(args) + " -o " + shellQuote(path.Join(remoteDir, remoteBinary)) + " -v " + shellJoin(pkgArgs)
+	return rsync, exec.Command("ssh", "-o", "BatchMode=yes", remoteHost, script)
+}
+
+// remoteCommand wraps the service's command to run the remote build over ssh,
+// forwarding the service's port back to this machine. The remote service
+// is given the environment variables lrt adds, but not the rest of lrt's.
+func remoteCommand(service *exec.Cmd) *exec.Cmd {
+	env := addedEnv(service.Env)
+	script := "cd " + shellQuote(remoteWorkDir()) + " && exec "
+	if len(env) > 0 {
+		script += "env " + shellJoin(env) + " "
+	}
+	script += shellQuote(path.Join(remoteDir, remoteBinary))
+	if len(service.Args) > 1 {
+		script += " " + shellJoin(service.Args[1:])
+	}
+
+	// -tt gives the service a terminal, so it gets SIGHUP when lrt stops ssh
+	args := []string{"-tt", "-o", "BatchMode=yes"}
+	if !*noProxyFlag {
+		port := serviceURL.Port()
+		args = append(args, "-o", "ExitOnForwardFailure=yes", "-L", "localhost:"+port+":localhost:"+port)
+	}
+	cmd := exec.Command("ssh", append(args, remoteHost, script)...)
+	cmd.SysProcAttr = service.SysProcAttr
+	return cmd
+}
+
+// addedEnv returns the variables in env that aren't in lrt's own environment
+func addedEnv(env []string) []string {
+	local := map[string]bool{}
+	for _, kv := range os.Environ() {
+		local[kv] = true
+	}
+	added := []string{}
+	for _, kv := range env {
+		if !local[kv] {
+			added = append(added, kv)
+		}
+	}
+	return added
+}
+
+// shellQuote quotes s for a POSIX shell, if it needs it
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`!*?[]{}()<>|&;#~") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
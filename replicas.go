@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// replica is one of the extra copies of the service that -replicas runs, on
+// a port of its own. The first copy is the service itself.
+type replica struct {
+	number int
+	url    *url.URL
+	cmd    *exec.Cmd
+	exited chan bool
+	stopCh chan bool // closed when lrt stops the replica
+}
+
+// replicaURLs are where each extra replica listens, chosen once so that they
+// don't move between builds
+var replicaURLs []*url.URL
+
+// the replicas that are running, and which of them (or the service) gets the
+// next request
+var (
+	replicasLock   sync.Mutex
+	runningReplica []*replica
+	healthyReplica []*replica
+	nextReplica    int
+)
+
+// startReplicas starts the extra copies of the service for -replicas, and
+// waits for them to be healthy. A replica that doesn't become healthy is
+// left out of the rotation, and the others carry on serving. The caller must
+// hold the write lock on the proxy.
+func startReplicas() {
+	replicasLock.Lock()
+	running := len(runningReplica) > 0
+	replicasLock.Unlock()
+	if running {
+		// the service crashed and was restarted, but the replicas didn't
+		return
+	}
+
+	var wait sync.WaitGroup
+	for i, target := range replicaURLs {
+		r := &replica{number: i + 2, url: target, exited: make(chan bool), stopCh: make(chan bool)}
+		logReady := r.start()
+		if logReady == nil {
+			continue
+		}
+		replicasLock.Lock()
+		runningReplica = append(runningReplica, r)
+		replicasLock.Unlock()
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			health := *healthCheckURL
+			health.Host = r.url.Host
+			stop := make(chan bool)
+			done := make(chan bool)
+			defer close(done)
+			go func() {
+				select {
+				case <-r.exited:
+				case <-time.After(*timeoutFlag):
+				case <-done:
+					return
+				}
+				close(stop)
+			}()
+			if !waitUntilReady(&health, logReady, stop) {
+				fmt.Fprintf(stderr, "lrt: warning: replica %d is not responding on %s, so it won't be sent requests\n", r.number, r.url.Host)
+				return
+			}
+			replicasLock.Lock()
+			healthyReplica = append(healthyReplica, r)
+			replicasLock.Unlock()
+		}()
+	}
+	wait.Wait()
+
+	replicasLock.Lock()
+	healthy := len(healthyReplica) + 1
+	replicasLock.Unlock()
+	infof("lrt: round-robin between %d replicas\n", healthy)
+}
+
+// start runs the replica, returning a channel that receives a value once it
+// logs a line matching -ready-log-pattern (or nil if it could not be started)
+func (r *replica) start() chan bool {
+	r.cmd = serviceCommand()
+	r.cmd.Env = append(r.cmd.Env, "PORT="+r.url.Port(), "REPLICA="+fmt.Sprint(r.number))
+	logReady := make(chan bool, 1)
+	onLine := func(source string) func(string) {
+		return func(line string) {
+			serviceLogs.add(source, line)
+			if readyLogPattern != nil && readyLogPattern.MatchString(line) {
+				select {
+				case logReady <- true:
+				default:
+				}
+			}
+		}
+	}
+	prefix := func() string { return fmt.Sprintf("[replica %d] ", r.number) }
+	r.cmd.Stdout = &lineWriter{out: serviceStdout, onLine: onLine("stdout"), prefix: prefix}
+	r.cmd.Stderr = &lineWriter{out: os.Stderr, onLine: onLine("stderr"), prefix: prefix}
+	if err := r.cmd.Start(); err != nil {
+		fmt.Fprintf(stderr, "lrt: replica %d: %s\n", r.number, err)
+		return nil
+	}
+
+	pid := r.cmd.Process.Pid
+	waiter.Add(1)
+	go func() {
+		defer waiter.Done()
+		r.cmd.Wait()
+		syscall.Kill(-pid, syscall.SIGKILL)
+		close(r.exited)
+
+		select {
+		case <-r.stopCh:
+			return
+		default:
+		}
+		fmt.Fprintf(stderr, "lrt: replica %d exited unexpectedly (%s), so it won't be sent requests until the next rebuild\n", r.number, r.cmd.ProcessState)
+		replicasLock.Lock()
+		defer replicasLock.Unlock()
+		for i, h := range healthyReplica {
+			if h == r {
+				healthyReplica = append(healthyReplica[:i:i], healthyReplica[i+1:]...)
+				break
+			}
+		}
+	}()
+	return logReady
+}
+
+// stopReplicas stops the replicas the same way as stopRunningService stops
+// the service.
+func stopReplicas() {
+	replicasLock.Lock()
+	running := runningReplica
+	runningReplica, healthyReplica = nil, nil
+	replicasLock.Unlock()
+
+	for _, r := range running {
+		close(r.stopCh)
+		pgid := r.cmd.Process.Pid
+		exited := r.exited
+		syscall.Kill(-pgid, stopSignal)
+		go func() {
+			select {
+			case <-time.After(*stopTimeoutFlag):
+				syscall.Kill(-pgid, syscall.SIGKILL)
+			case <-exited:
+			}
+		}()
+	}
+}
+
+// signalReplicas sends a signal to each running replica's process group
+func signalReplicas(sig syscall.Signal) {
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+	for _, r := range runningReplica {
+		syscall.Kill(-r.cmd.Process.Pid, sig)
+	}
+}
+
+// pickReplica sends a request to the next healthy replica in turn. The
+// service itself takes its turn as the first replica.
+func pickReplica(req *http.Request) {
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+	nextReplica = (nextReplica + 1) % (len(healthyReplica) + 1)
+	if n := nextReplica; n > 0 {
+		req.URL.Host = healthyReplica[n-1].url.Host
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// routedEnv is set for the lrts that -route starts, so that they don't start
+// routes, -compose services or -port-forwards of their own (from .lrt.yaml or
+// $LRT_), and only listen where they are told to
+const routedEnv = "LRT_ROUTED"
+
+// route sends requests for one host to another package, run by its own lrt,
+// or to something already listening at an address
+type route struct {
+	host    string
+	pkg     string   // set if lrt runs the package
+	target  *url.URL // where requests are forwarded
+	proxy   *httputil.ReverseProxy
+	process *exec.Cmd
+}
+
+// routes are set by -route
+var routes []*route
+
+// hostRewrite is set by -host-rewrite, to change the Host header of requests
+// for one host (or, with a *., any subdomain of it) to another
+type hostRewrite struct {
+	from string
+	to   string
+}
+
+var hostRewrites []hostRewrite
+
+// parseHostRewrite parses a -host-rewrite like *.myapp.localhost=*.myapp.com
+func parseHostRewrite(value string) (hostRewrite, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return hostRewrite{}, fmt.Errorf("expected from=to, e.g. *.myapp.localhost=*.myapp.com")
+	}
+	rewrite := hostRewrite{from: strings.ToLower(value[:i]), to: value[i+1:]}
+	if strings.HasPrefix(rewrite.from, "*.") != strings.HasPrefix(rewrite.to, "*.") {
+		return hostRewrite{}, fmt.Errorf("either both or neither side should start with *.")
+	}
+	return rewrite, nil
+}
+
+// matchHost reports whether host matches pattern, which may start with *. to
+// match any subdomain, and if so what the * matched
+func matchHost(pattern string, host string) (string, bool) {
+	if !strings.HasPrefix(pattern, "*.") {
+		return "", host == pattern
+	}
+	suffix := pattern[1:]
+	if len(host) <= len(suffix) || !strings.HasSuffix(host, suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(host, suffix), true
+}
+
+// requestHostname is the host a request is for, without its port
+func requestHostname(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// rewriteHost changes the request's Host header if it matches a
+// -host-rewrite. The port is dropped, as it would be in production (unless
+// the rewrite gives one).
+func rewriteHost(req *http.Request) {
+	host := requestHostname(req)
+	for _, rewrite := range hostRewrites {
+		if sub, ok := matchHost(rewrite.from, host); ok {
+			req.Host = strings.Replace(rewrite.to, "*", sub, 1)
+			return
+		}
+	}
+}
+
+// parseRoute parses a -route like api.localhost=./cmd/api,
+// admin.localhost=localhost:8080 or *.tenants.localhost=./cmd/tenants
+func parseRoute(value string) (*route, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return nil, fmt.Errorf("expected host=package or host=host:port")
+	}
+	r := &route{host: strings.ToLower(value[:i])}
+	target := value[i+1:]
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		r.target = u
+	} else if _, _, err := net.SplitHostPort(target); err == nil {
+		r.target = &url.URL{Scheme: "http", Host: target}
+	} else {
+		r.pkg = target
+		r.target = generateServiceURL(&url.URL{Scheme: "http", Host: "localhost:3000"})
+	}
+	return r, nil
+}
+
+// startRoutes starts an lrt for each -route to a package, listening where
+// the route forwards to.
+func startRoutes() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	color := "never"
+	if useColor() {
+		color = "always"
+	}
+	for _, r := range routes {
+		r.proxy = httputil.NewSingleHostReverseProxy(r.target)
+		director := r.proxy.Director
+		r.proxy.Director = func(req *http.Request) {
+			director(req)
+			rewriteHost(req)
+		}
+		r.proxy.ErrorHandler = routeError(r)
+		if r.pkg == "" {
+			infof("lrt: routing %s to %s\n", r.host, r.target)
+			continue
+		}
+
+		// options from .lrt.yaml and $LRT_ are set first, so these win. A
+		// repeated option like -listen is added to instead, so routedEnv
+		// has the lrt only use the last -listen.
+		args := []string{
+			"-listen", r.target.Host, "-pid-file", "none", "-keys=false", "-no-self-update",
+			"-tag", strings.SplitN(strings.TrimPrefix(r.host, "*."), ".", 2)[0], "-color", color,
+			"-log-file", "", "-control-socket", "", "-events-socket", "", "-json=false",
+			r.pkg,
+		}
+		r.process = exec.Command(executable, args...)
+		r.process.Env = append(os.Environ(), routedEnv+"="+r.host)
+		source := r.host
+		r.process.Stdout = &lineWriter{out: serviceStdout, onLine: func(line string) { serviceLogs.add(source, line) }}
+		r.process.Stderr = &lineWriter{out: os.Stderr, onLine: func(line string) { serviceLogs.add(source, line) }}
+		if err := r.process.Start(); err != nil {
+			return err
+		}
+		infof("lrt: routing %s to %s (on %s)\n", r.host, r.pkg, r.target)
+
+		stopping := make(chan bool)
+		exited := make(chan bool)
+		go func(r *route) {
+			r.process.Wait()
+			close(exited)
+			select {
+			case <-stopping:
+			default:
+				fmt.Fprintf(stderr, "lrt: the lrt for %s exited (%s)\n", r.host, r.process.ProcessState)
+			}
+		}(r)
+		process := r.process
+		atExit(func() {
+			close(stopping)
+			process.Process.Signal(syscall.SIGTERM)
+			<-exited
+		})
+	}
+	return nil
+}
+
+// withRoutes sends requests for each -route's host to it, and the rest on
+func withRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r := findRoute(req); r != nil {
+			r.proxy.ServeHTTP(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// findRoute returns the route for a request's Host header, if there is one.
+// A route for the exact host wins over wildcards, and a more specific
+// wildcard (like *.admin.myapp.localhost) over a less specific one.
+func findRoute(req *http.Request) *route {
+	host := requestHostname(req)
+	var found *route
+	for _, r := range routes {
+		if _, ok := matchHost(r.host, host); !ok {
+			continue
+		}
+		if !strings.HasPrefix(r.host, "*.") {
+			return r
+		}
+		if found == nil || len(r.host) > len(found.host) {
+			found = r
+		}
+	}
+	return found
+}
+
+func routeError(r *route) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+		msg := fmt.Sprintf("lrt: could not proxy %s %s to %s: %v", req.Method, req.URL.Path, r.host, err)
+		if r.pkg != "" {
+			msg += "\n     hint: look above in lrt's output for why " + r.pkg + " isn't running"
+		}
+		fmt.Fprintln(stderr, msg)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(msg + "\n"))
+	}
+}
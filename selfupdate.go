@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"syscall"
+)
+
+// reinstalledEnv is set when lrt re-execs itself after reinstalling, so that
+// it doesn't reinstall itself over and over if the new binary still doesn't
+// match.
+const reinstalledEnv = "LRT_REINSTALLED"
+
+// rebuildIfNecessary notices if the go version has changed since lrt was compiled
+// and, if so, recompiles it.
+// N.B. If a recompilation is neceessary, rebuildIfNecessary will re-exec the current process
+// so after calling this method the latest lrt will continue. If lrt can't be
+// reinstalled, this lrt carries on regardless.
+func rebuildIfNecessary() {
+	// lrt doesn't need to match the toolchain you've explicitly picked for your service.
+	if *noSelfUpdateFlag || usingOtherToolchain() {
+		return
+	}
+
+	// TODO what else should we check?
+	output, err := exec.Command("go", "version").CombinedOutput()
+	if err != nil {
+		// figureOutToolchain explains what's wrong with go
+		return
+	}
+	if strings.Contains(string(output), " "+runtime.Version()+" ") {
+		return
+	}
+	if os.Getenv(reinstalledEnv) != "" {
+		fmt.Fprintf(os.Stderr, "lrt: warning: reinstalled lrt, but it was still built with %s, not %s\n", runtime.Version(), strings.TrimSpace(string(output)))
+		fmt.Fprintf(os.Stderr, "     hint: check which lrt is first in your $PATH, or use -no-self-update to stop trying\n")
+		return
+	}
+
+	info, _ := debug.ReadBuildInfo()
+	target := installTarget(info)
+
+	fmt.Printf("lrt: new go version detected, reinstalling lrt for %v...\n", string(output))
+	binary, err := reinstall(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lrt: warning: could not reinstall lrt, carrying on with the one built with %s\n", runtime.Version())
+		fmt.Fprint(os.Stderr, "lrt: "+err.Error()+"\n")
+		fmt.Fprintf(os.Stderr, "     hint: reinstall it yourself with go install %s, or use -no-self-update to stop trying\n", target)
+		return
+	}
+
+	os.Setenv(reinstalledEnv, "1")
+	if err := syscall.Exec(binary, os.Args, os.Environ()); err != nil {
+		fmt.Fprintf(os.Stderr, "lrt: warning: could not run the reinstalled lrt, carrying on with this one: %s\n", err)
+	}
+}
+
+// reinstall runs go install for target (see installTarget), and returns the
+// path of the new binary.
+//
+// lrt is installed as package@version so that it is built in module mode
+// regardless of the directory lrt is run in. The rest of GOFLAGS is respected,
+// but -mod and -modfile are dropped as they're meant for your module, not lrt.
+func reinstall(target string) (string, error) {
+	cmd := exec.Command("go", "install", target)
+	cmd.Env = append(os.Environ(), "GOFLAGS="+installGoflags(os.Getenv("GOFLAGS")))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("%s", strings.TrimSpace(string(output)))
+		}
+		return "", err
+	}
+
+	// go install puts it in $GOBIN, or else the bin directory of the first $GOPATH
+	output, err := exec.Command("go", "env", "GOBIN", "GOPATH").Output()
+	if err != nil {
+		return "", err
+	}
+	env := strings.SplitN(string(output), "\n", 3)
+	if len(env) < 2 {
+		return "", fmt.Errorf("unexpected output from go env: %q", output)
+	}
+	bin := strings.TrimSpace(env[0])
+	if bin == "" {
+		bin = filepath.Join(filepath.SplitList(strings.TrimSpace(env[1]))[0], "bin")
+	}
+	return filepath.Join(bin, path.Base(strings.SplitN(target, "@", 2)[0])), nil
+}
+
+// installTarget returns the package@version that lrt was built from, so that
+// forks (and copies of lrt vendored into other modules) reinstall themselves
+// rather than github.com/superhuman/lrt. If lrt was built from a checkout
+// rather than with go install, the latest version of it is used, as the
+// pseudo-version go gives a checkout (since go 1.24) may not be published.
+func installTarget(info *debug.BuildInfo) string {
+	if info == nil || info.Path == "" {
+		return "github.com/superhuman/lrt@latest"
+	}
+	version := "latest"
+	for _, m := range append([]*debug.Module{&info.Main}, info.Deps...) {
+		if m.Path != info.Path && !strings.HasPrefix(info.Path, m.Path+"/") {
+			continue
+		}
+		if m.Replace == nil && m.Version != "" && m.Version != "(devel)" && !strings.HasSuffix(m.Version, "+dirty") &&
+			!(m == &info.Main && pseudoVersion.MatchString(m.Version)) {
+			version = m.Version
+		}
+		break
+	}
+	return info.Path + "@" + version
+}
+
+// pseudoVersion matches the versions go gives untagged commits, like
+// v0.0.0-20240102150405-abcdef123456
+var pseudoVersion = regexp.MustCompile(`[-.]\d{14}-[0-9a-f]{12}(\+.*)?$`)
+
+// installGoflags removes the flags from GOFLAGS that only make sense when
+// building your module
+func installGoflags(goflags string) string {
+	var kept []string
+	for _, f := range strings.Fields(goflags) {
+		if !strings.HasPrefix(f, "-mod=") && !strings.HasPrefix(f, "-modfile=") {
+			kept = append(kept, f)
+		}
+	}
+	return strings.Join(kept, " ")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shadowBodyLimit is how much of each response -shadow compares
+const shadowBodyLimit = 1024 * 1024
+
+// shadowing is the new build that requests are being mirrored to with
+// -shadow, if any
+var shadowing struct {
+	sync.Mutex
+	target   *url.URL
+	build    int32
+	pgid     int // of the new build's process, while it is running
+	mirrored int
+	differed int
+}
+
+var shadowClient = &http.Client{
+	Transport: serviceTransport,
+	Timeout:   30 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// shadowBuild runs binary on a port of its own for -shadow, while the current
+// build carries on serving. Requests are mirrored to both, and any
+// differences between their responses are logged, before the new build is
+// promoted. The caller must hold the write lock on the proxy; it is released
+// while the new build is being tried out, but buildLock isn't, so the current
+// build can't be restarted or rolled back in the meantime.
+func shadowBuild(binary string, build int32) {
+	target := generateServiceURL(serviceURL)
+	cmd := exec.Command(binary, cmdArgs...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(serviceEnv(), "PORT="+target.Port())
+	prefix := func() string { return fmt.Sprintf("[build %d] ", build) }
+	cmd.Stdout = &lineWriter{out: serviceStdout, onLine: func(string) {}, prefix: prefix}
+	cmd.Stderr = &lineWriter{out: os.Stderr, onLine: func(string) {}, prefix: prefix}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(stderr, "lrt: shadow: %s\n", err)
+		return
+	}
+	shadowing.Lock()
+	shadowing.pgid = cmd.Process.Pid
+	shadowing.Unlock()
+	defer func() {
+		stopShadow()
+		cmd.Wait()
+	}()
+
+	health := *healthCheckURL
+	health.Host = target.Host
+	stop := make(chan bool)
+	timer := time.AfterFunc(*timeoutFlag, func() { close(stop) })
+	healthy := waitUntilHealthy(&health, stop)
+	timer.Stop()
+	if !healthy {
+		fmt.Fprintf(stderr, "lrt: shadow: build %d did not become healthy, promoting it anyway\n", build)
+		return
+	}
+
+	fmt.Fprintf(stderr, "lrt: shadow: mirroring requests to build %d for %s\n", build, *shadowFlag)
+	emit("shadow-started", event{"build": build})
+	shadowing.Lock()
+	shadowing.target, shadowing.build = target, build
+	shadowing.mirrored, shadowing.differed = 0, 0
+	shadowing.Unlock()
+
+	// let the current build serve requests while we wait
+	atomic.StoreInt32(&rebuilding, 0)
+	proxyLock.Unlock()
+	time.Sleep(*shadowFlag)
+	lockProxy()
+	atomic.StoreInt32(&rebuilding, 1)
+
+	shadowing.Lock()
+	mirrored, differed := shadowing.mirrored, shadowing.differed
+	shadowing.target = nil
+	shadowing.Unlock()
+
+	fmt.Fprintf(stderr, "lrt: shadow: %d requests mirrored to build %d, %d differed; promoting it\n", mirrored, build, differed)
+	emit("shadow-finished", event{"build": build, "mirrored": mirrored, "differed": differed})
+}
+
+// stopShadow kills the build being tried out with -shadow, if there is one.
+// It is also run when lrt exits, which may be while the build is being tried
+// out.
+func stopShadow() {
+	shadowing.Lock()
+	defer shadowing.Unlock()
+	if shadowing.pgid != 0 {
+		syscall.Kill(-shadowing.pgid, syscall.SIGKILL)
+		shadowing.pgid = 0
+	}
+}
+
+// withShadow mirrors GET and HEAD requests to the build being tried out with
+// -shadow, and logs where its responses differ from the current build's.
+// Other methods aren't mirrored, as doing them twice could have side effects.
+func withShadow(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shadowing.Lock()
+		target, build := shadowing.target, shadowing.build
+		shadowing.Unlock()
+
+		if target == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		req, err := http.NewRequest(r.Method, target.Scheme+"://"+target.Host+r.URL.RequestURI(), nil)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		req.Header = r.Header.Clone()
+		req.Host = r.Host
+
+		body := &cappedBuffer{limit: shadowBodyLimit}
+		rw := &responseWriter{ResponseWriter: w, onWrite: func(p []byte) { body.Write(p) }}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			return
+		}
+
+		go compareShadowResponse(req, build, rw.status, body)
+	})
+}
+
+// compareShadowResponse sends req to the shadow build, and logs how its
+// response differs from the one the current build sent.
+func compareShadowResponse(req *http.Request, build int32, status int, body *cappedBuffer) {
+	name := req.Method + " " + req.URL.RequestURI()
+	diff := ""
+
+	resp, err := shadowClient.Do(req)
+	if err != nil {
+		diff = err.Error()
+	} else {
+		defer resp.Body.Close()
+		shadowBody := &cappedBuffer{limit: shadowBodyLimit}
+		// hide bytes.Buffer's ReadFrom, so that the body is capped
+		_, err := io.Copy(struct{ io.Writer }{shadowBody}, resp.Body)
+		switch {
+		case err != nil:
+			diff = err.Error()
+		case resp.StatusCode != status:
+			diff = fmt.Sprintf("responded %d instead of %d", resp.StatusCode, status)
+		case shadowBody.size != body.size || !bytes.Equal(shadowBody.Bytes(), body.Bytes()):
+			diff = fmt.Sprintf("response body differs (%d bytes instead of %d)", shadowBody.size, body.size)
+		}
+	}
+
+	shadowing.Lock()
+	defer shadowing.Unlock()
+	if shadowing.build != build {
+		return
+	}
+	shadowing.mirrored++
+	if diff != "" {
+		shadowing.differed++
+		fmt.Fprintf(stderr, "lrt: shadow: %s: build %d %s\n", name, build, diff)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// staleResponseLimit is the largest response body that -serve-stale keeps
+const staleResponseLimit = 1024 * 1024
+
+// staleResponseCount is how many responses -serve-stale keeps, so that URLs
+// with cache-busting query strings don't fill up memory
+const staleResponseCount = 100
+
+// staleResponse is the last successful response to a GET request
+type staleResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	at     time.Time
+
+	// the request headers named by the response's Vary header, and their
+	// values, which a request must match to be served this response
+	vary map[string]string
+}
+
+var (
+	staleLock      sync.Mutex
+	staleResponses = map[string]*staleResponse{}
+)
+
+// withStaleResponses remembers the last successful response to each GET
+// request, and serves it while the service is being rebuilt so that pages
+// that refresh themselves don't stall for the length of a compile.
+//
+// Requests with credentials (cookies or an Authorization header) are passed
+// straight through, as their responses may be specific to one user, and the
+// response's Vary header is respected.
+func withStaleResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" || hasCredentials(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.URL.RequestURI()
+
+		if atomic.LoadInt32(&rebuilding) == 1 {
+			staleLock.Lock()
+			stale := staleResponses[key]
+			staleLock.Unlock()
+
+			if stale != nil && stale.matches(r) {
+				for name, values := range stale.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("X-Lrt-Stale", "true")
+				w.Header().Set("Age", strconv.Itoa(int(time.Since(stale.at).Seconds())))
+				w.WriteHeader(stale.status)
+				w.Write(stale.body)
+				return
+			}
+		}
+
+		var body bytes.Buffer
+		tooBig := false
+		rw := &responseWriter{ResponseWriter: w, onWrite: func(p []byte) {
+			if body.Len()+len(p) > staleResponseLimit {
+				tooBig = true
+				return
+			}
+			body.Write(p)
+		}}
+		next.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status < 200 || status > 299 || tooBig || strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") || w.Header().Get("Set-Cookie") != "" {
+			return
+		}
+		vary := map[string]string{}
+		for _, value := range w.Header()["Vary"] {
+			for _, name := range strings.Split(value, ",") {
+				name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+				if name == "*" {
+					return
+				}
+				vary[name] = r.Header.Get(name)
+			}
+		}
+
+		staleLock.Lock()
+		defer staleLock.Unlock()
+		staleResponses[key] = &staleResponse{status: status, header: w.Header().Clone(), body: body.Bytes(), at: time.Now(), vary: vary}
+		if len(staleResponses) > staleResponseCount {
+			evictOldestStaleResponse()
+		}
+	})
+}
+
+// evictOldestStaleResponse forgets the response that was kept the longest
+// ago. The caller must hold staleLock.
+func evictOldestStaleResponse() {
+	oldest := ""
+	for key, stale := range staleResponses {
+		if oldest == "" || stale.at.Before(staleResponses[oldest].at) {
+			oldest = key
+		}
+	}
+	delete(staleResponses, oldest)
+}
+
+// clearStaleResponses forgets every response, once the service has been
+// rebuilt and they may no longer be what it would respond with
+func clearStaleResponses() {
+	staleLock.Lock()
+	defer staleLock.Unlock()
+	staleResponses = map[string]*staleResponse{}
+}
+
+// hasCredentials is true if r identifies a user, so that its response
+// shouldn't be kept for anyone else
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Cookie") != "" || r.Header.Get("Authorization") != "" || r.Header.Get("Proxy-Authorization") != ""
+}
+
+// matches is true if r has the same values as the request s was the response
+// to, for each header named by its Vary header
+func (s *staleResponse) matches(r *http.Request) bool {
+	for name, value := range s.vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// staticMount serves the files in dir at prefix, set by -static
+type staticMount struct {
+	prefix string
+	dir    string
+	files  http.Handler
+}
+
+var staticMounts []*staticMount
+
+// parseStatic parses a -static like /assets=./public. A mount at / has the
+// prefix "", and is tried for every request.
+func parseStatic(value string) (*staticMount, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 || !strings.HasPrefix(value, "/") {
+		return nil, fmt.Errorf("expected /path=directory, e.g. /assets=./public")
+	}
+	m := &staticMount{prefix: strings.TrimSuffix(value[:i], "/"), dir: value[i+1:]}
+	if info, err := os.Stat(m.dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", m.dir)
+	}
+	m.files = http.StripPrefix(m.prefix, http.FileServer(http.Dir(m.dir)))
+	return m, nil
+}
+
+// sortStaticMounts puts the longest prefixes first, so that they win
+func sortStaticMounts() {
+	sort.SliceStable(staticMounts, func(i, j int) bool { return len(staticMounts[i].prefix) > len(staticMounts[j].prefix) })
+}
+
+// withStatic serves -static files itself, so they don't wait for a rebuild
+// (or for the service to be healthy). Requests for files that don't exist,
+// and for directories, are passed on to the service.
+func withStatic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			for _, m := range staticMounts {
+				if m.prefix != "" && r.URL.Path != m.prefix && !strings.HasPrefix(r.URL.Path, m.prefix+"/") {
+					continue
+				}
+				name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, m.prefix))
+				if info, err := os.Stat(filepath.Join(m.dir, filepath.FromSlash(name))); err != nil || info.IsDir() {
+					continue
+				}
+				// always check for a newer version, as it may change at any time
+				w.Header().Set("Cache-Control", "no-cache")
+				m.files.ServeHTTP(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// statusPage is what /__lrt/status shows: lrt's status and what has happened
+// recently, newest first.
+type statusPage struct {
+	status
+	Events []event `json:"events"`
+}
+
+func currentStatusPage() statusPage {
+	events := lastEvents()
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return statusPage{currentStatus(), events}
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<title>lrt: status</title>
+<style>body { font-family: sans-serif } th { text-align: left; padding-right: 16px } pre { background: #f4f4f4; padding: 8px; white-space: pre-wrap }</style>
+<h1>lrt</h1>
+<table>
+<tr><th>State</th><td id="state">{{ .State }}{{ if .Paused }} (paused){{ end }}</td></tr>
+<tr><th>Build</th><td id="build">{{ .Build }}</td></tr>
+<tr><th>Last build took</th><td id="build_duration">{{ .BuildTime }}ms</td></tr>
+<tr><th>Service</th><td id="address">{{ .Address }}{{ if .PID }} (pid {{ .PID }}){{ end }}</td></tr>
+<tr><th>Watched directories</th><td><a id="watched_dirs" href="/__lrt/watches">{{ .WatchedDirs }}</a></td></tr>
+</table>
+<pre id="error"{{ if not .Error }} hidden{{ end }}>{{ .Error }}</pre>
+<h2>Recent events</h2>
+<ul id="events">
+{{ range .Events }}<li><code>{{ index . "time" }}</code> {{ index . "type" }} (build {{ index . "build" }})</li>
+{{ end }}</ul>
+<script>
+new EventSource("/__lrt/status/stream").onmessage = function (e) {
+	var data = JSON.parse(e.data), s = data.status
+	document.getElementById("state").textContent = s.state + (s.paused ? " (paused)" : "")
+	document.getElementById("build").textContent = s.build
+	document.getElementById("build_duration").textContent = (s.build_duration_ms || 0) + "ms"
+	document.getElementById("address").textContent = s.address + (s.pid ? " (pid " + s.pid + ")" : "")
+	document.getElementById("watched_dirs").textContent = s.watched_dirs
+	document.getElementById("error").textContent = s.error || ""
+	document.getElementById("error").hidden = !s.error
+	if (data.event) {
+		var li = document.createElement("li"), code = document.createElement("code")
+		code.textContent = data.event.time
+		li.appendChild(code)
+		li.appendChild(document.createTextNode(" " + data.event.type + " (build " + data.event.build + ")"))
+		var events = document.getElementById("events")
+		events.insertBefore(li, events.firstChild)
+	}
+}
+</script>
+`))
+
+// serveStatus shows lrt's status as a page, or as JSON with ?format=json.
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	page := currentStatusPage()
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, page)
+}
+
+// streamStatus sends lrt's status as server-sent events each time something
+// happens, along with the event.
+func streamStatus(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e event) {
+		data, _ := json.Marshal(struct {
+			Status status `json:"status"`
+			Event  event  `json:"event,omitempty"`
+		}{currentStatus(), e})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+	send(nil)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			send(e)
+		}
+	}
+}
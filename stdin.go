@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// serviceStdin is where lines typed into lrt are sent when -stdin is set. It
+// is replaced each time the service is started.
+var serviceStdin struct {
+	lock   sync.Mutex
+	pipe   io.WriteCloser
+	closed bool
+}
+
+// setServiceStdin sends lrt's stdin to a newly started service.
+func setServiceStdin(pipe io.WriteCloser) {
+	serviceStdin.lock.Lock()
+	defer serviceStdin.lock.Unlock()
+
+	serviceStdin.pipe = pipe
+	if serviceStdin.closed {
+		pipe.Close()
+	}
+}
+
+// forwardStdin copies lrt's stdin to whichever service is running. If lrt's
+// stdin is closed, so is the service's (and that of any later service).
+func forwardStdin() {
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := os.Stdin.Read(buf)
+
+			serviceStdin.lock.Lock()
+			if n > 0 && serviceStdin.pipe != nil {
+				// if the service isn't reading, the input is lost
+				serviceStdin.pipe.Write(buf[:n])
+			}
+			if err != nil {
+				serviceStdin.closed = true
+				if serviceStdin.pipe != nil {
+					serviceStdin.pipe.Close()
+				}
+			}
+			serviceStdin.lock.Unlock()
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lastBinarySize is the size of the previous successful build, so that the
+// summary can show how much it changed.
+var lastBinarySize int64
+
+// printBuildSummary prints a line after each rebuild saying what triggered
+// it and how long it took, so that slow builds are noticed.
+func printBuildSummary(trigger []string, buildTime time.Duration, bootTime time.Duration, healthy bool) {
+	size := int64(0)
+	if info, err := os.Stat(tmpFile.Name()); err == nil {
+		size = info.Size()
+	}
+	if healthy {
+		infof("%s\n", formatBuildSummary(trigger, buildTime, size, lastBinarySize, bootTime, healthy))
+	} else {
+		// still shown with -quiet, as it is an error
+		fmt.Fprintln(stdout, formatBuildSummary(trigger, buildTime, size, lastBinarySize, bootTime, healthy))
+	}
+	lastBinarySize = size
+}
+
+func formatBuildSummary(trigger []string, buildTime time.Duration, size int64, lastSize int64, bootTime time.Duration, healthy bool) string {
+	summary := "lrt: built"
+	if len(trigger) > 0 {
+		summary = "lrt: rebuilt for " + strings.Join(relativeFiles(trigger), ", ")
+	}
+
+	summary += fmt.Sprintf(" in %s (%s", buildTime.Round(10*time.Millisecond), formatSize(size))
+	if lastSize > 0 && size != lastSize {
+		delta := formatSize(size - lastSize)
+		if size > lastSize {
+			delta = "+" + delta
+		}
+		summary += ", " + delta
+	}
+	summary += ")"
+
+	if healthy {
+		summary += fmt.Sprintf(", healthy after %s", bootTime.Round(10*time.Millisecond))
+	} else {
+		summary += ", but it failed to start"
+	}
+	return summary
+}
+
+// relativeFiles makes files under the current directory relative to it, and
+// lists only the first 3
+func relativeFiles(files []string) []string {
+	cwd, _ := os.Getwd()
+	relative := []string{}
+	for _, file := range files {
+		if rel, err := filepath.Rel(cwd, file); err == nil && !strings.HasPrefix(rel, "..") {
+			file = rel
+		}
+		relative = append(relative, file)
+	}
+	if len(relative) > 3 {
+		relative = append(relative[:3], fmt.Sprintf("%d more", len(relative)-3))
+	}
+	return relative
+}
+
+// formatSize formats a number of bytes, e.g. 8.1MB or -12KB
+func formatSize(n int64) string {
+	abs := n
+	if abs < 0 {
+		abs = -abs
+	}
+	switch {
+	case abs >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case abs >= 1<<10:
+		return fmt.Sprintf("%dKB", n/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -2,24 +2,99 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	_ "net/http/pprof"
 	"os"
+	"os/exec"
+	"os/signal"
 	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var response = "lrt/test: OK"
+var status = http.StatusOK
+
+var reloads int32
+var hits int32
 
 var overridePort = flag.Int("override-port", 0, "")
+var useTLS = flag.Bool("tls", false, "")
 
 func main() {
+	flag.Parse()
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	})
+	http.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Host: %s\r\n", r.Host)
+		r.Header.Write(w)
+	})
+	http.HandleFunc("/spawn", func(w http.ResponseWriter, r *http.Request) {
+		cmd := exec.Command("sleep", "60")
+		cmd.Start()
+		fmt.Fprint(w, cmd.Process.Pid)
+	})
+	http.HandleFunc("/exit", func(w http.ResponseWriter, r *http.Request) {
+		os.Exit(1)
+	})
+	http.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
 		w.Write([]byte(response))
 	})
+	http.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: " + response + "\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	http.HandleFunc("/env", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, os.Getenv(r.URL.Query().Get("name")))
+	})
+	http.HandleFunc("/hits", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, atomic.AddInt32(&hits, 1))
+	})
+	http.HandleFunc("/reloads", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, atomic.LoadInt32(&reloads))
+	})
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go func() {
+		for range reloadCh {
+			atomic.AddInt32(&reloads, 1)
+		}
+	}()
+
+	if socket := os.Getenv("SOCKET"); socket != "" {
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			panic(err)
+		}
+		http.Serve(listener, nil)
+		return
+	}
+
 	port := os.Getenv("PORT")
 	if *overridePort != 0 {
 		port = strconv.Itoa(*overridePort)
 	}
 
+	if *useTLS {
+		listener, err := net.Listen("tcp", "localhost:"+port)
+		if err != nil {
+			panic(err)
+		}
+		server := httptest.NewUnstartedServer(http.DefaultServeMux)
+		server.Listener = listener
+		server.StartTLS()
+		select {}
+	}
+
 	http.ListenAndServe("localhost:"+port, nil)
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mustLoadTLSConfig returns the certificate lrt uses to serve HTTPS with -tls.
+//
+// If you've provided a certificate with -tls-cert and -tls-key we'll use that,
+// otherwise if mkcert is installed we use it to generate a certificate that
+// your browser will trust. As a last resort we generate a self-signed
+// certificate, which works, but causes browser warnings.
+func mustLoadTLSConfig() *tls.Config {
+	certFile, keyFile := *tlsCertFlag, *tlsKeyFlag
+
+	if (certFile == "") != (keyFile == "") {
+		fmt.Printf("lrt: -tls-cert and -tls-key must be used together. See lrt --help for details\n")
+		os.Exit(2)
+	}
+
+	if certFile == "" {
+		if _, err := exec.LookPath("mkcert"); err == nil {
+			certFile, keyFile = mustMkcert()
+		} else {
+			fmt.Fprintf(os.Stderr, "lrt: warning: using a self-signed certificate, your browser will not trust it.\n")
+			fmt.Fprintf(os.Stderr, "     hint: install mkcert (https://github.com/FiloSottile/mkcert) and run `mkcert -install`\n")
+			cert, err := selfSignedCertificate()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+				os.Exit(1)
+			}
+			return &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// certificateHosts are the names lrt's certificate is valid for
+func certificateHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	seen := map[string]bool{"localhost": true, "127.0.0.1": true, "::1": true}
+	for _, u := range listenURLs {
+		if host := u.Hostname(); host != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// certificateName names the cached certificate for hosts, so that a new one
+// is generated whenever the hosts change
+func certificateName(hosts []string) string {
+	sorted := append([]string{}, hosts...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// mustMkcert generates (or re-uses) a locally-trusted certificate in the user's cache directory
+func mustMkcert() (string, string) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	dir := filepath.Join(cacheDir, "lrt", "certs")
+	hosts := certificateHosts()
+	certFile := filepath.Join(dir, certificateName(hosts)+".pem")
+	keyFile := filepath.Join(dir, certificateName(hosts)+"-key.pem")
+
+	if _, err := os.Stat(certFile); err == nil {
+		return certFile, keyFile
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+	args := append([]string{"-cert-file", certFile, "-key-file", keyFile}, hosts...)
+	output, err := exec.Command("mkcert", args...).CombinedOutput()
+	if err != nil {
+		fmt.Fprint(os.Stderr, "lrt: "+string(output))
+		fmt.Fprintln(os.Stderr, "lrt: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("lrt: generated a certificate for %v using mkcert\n", hosts)
+	fmt.Printf("     hint: if your browser doesn't trust it, run `mkcert -install`\n")
+	return certFile, keyFile
+}
+
+// selfSignedCertificate generates a certificate for the certificateHosts
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"lrt development certificate"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range certificateHosts() {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// waitForURLs are the dependencies given with -wait-for
+var waitForURLs []*url.URL
+
+// waitForClient checks http:// dependencies. It doesn't follow redirects, as
+// a redirect shows the dependency is up.
+var waitForClient = &http.Client{
+	Timeout:       2 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// parseWaitFor parses a -wait-for like tcp://localhost:5432 or
+// http://localhost:9200/_health
+func parseWaitFor(value string) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "tcp" && u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("expected tcp://host:port or an http:// URL")
+	}
+	if u.Scheme == "tcp" && u.Port() == "" {
+		return nil, fmt.Errorf("expected tcp://host:port")
+	}
+	return u, nil
+}
+
+// checkDependency returns an error if u can't be reached: for tcp:// if it
+// doesn't accept connections, and for http:// if it doesn't respond with a
+// status below 400.
+func checkDependency(u *url.URL) error {
+	if u.Scheme == "tcp" {
+		conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	resp, err := waitForClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("it responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// unreachableDependency returns the first -wait-for that can't be reached,
+// and why
+func unreachableDependency() (*url.URL, error) {
+	for _, u := range waitForURLs {
+		if err := checkDependency(u); err != nil {
+			return u, err
+		}
+	}
+	return nil, nil
+}
+
+// waitForDependencies waits for up to -wait-for-timeout for every -wait-for
+// to be reachable, returning an error if one isn't.
+func waitForDependencies() error {
+	deadline := time.Now().Add(*waitForTimeoutFlag)
+	said := false
+	for {
+		u, err := unreachableDependency()
+		if u == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is not reachable after %s: %s", u, *waitForTimeoutFlag, err)
+		}
+		if !said {
+			infof("lrt: waiting for %s before starting your service...\n", u)
+			said = true
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// waitUntilReachable waits for every -wait-for to be reachable, returning
+// false if stopCh is closed first.
+func waitUntilReachable(stopCh chan bool) bool {
+	said := false
+	for {
+		u, err := unreachableDependency()
+		if u == nil {
+			return true
+		}
+		if !said {
+			fmt.Fprintf(stderr, "lrt: waiting for %s (%s) before starting your service\n", u, err)
+			said = true
+		}
+		select {
+		case <-stopCh:
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// startWhenReachable starts the service once its dependencies are reachable,
+// after waitForDependencies has given up on them, unless a rebuild (which
+// closes stopCh) gets there first.
+func startWhenReachable(stopCh chan bool) {
+	if !waitUntilReachable(stopCh) {
+		return
+	}
+	lockProxy()
+	defer proxyLock.Unlock()
+	select {
+	case <-stopCh:
+		return
+	default:
+	}
+	infof("lrt: dependencies are reachable, starting service...\n")
+	errorResponse = nil
+	startService()
+}
+
+// dependencyHint explains that the service may have exited because one of its
+// dependencies isn't reachable
+func dependencyHint() string {
+	if u, err := unreachableDependency(); u != nil {
+		return fmt.Sprintf("     hint: %s is not reachable (%s), which may be why\n", u, err)
+	}
+	return ""
+}
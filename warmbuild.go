@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// warmBuildDone is closed once startWarmBuild has finished
+var warmBuildDone chan bool
+
+// startWarmBuild builds the service's dependencies from outside its module in
+// the background, while lrt is starting up (and starting -compose services,
+// -port-forwards and so on). This fills go's build cache, so that on a cold
+// cache lrt only has to wait for your own code once it gets to the first build.
+// Failures are ignored: the first build reports them properly.
+func startWarmBuild() {
+	warmBuildDone = make(chan bool)
+	go func() {
+		defer close(warmBuildDone)
+		started := time.Now()
+
+		list := exec.Command(*goFlag, append([]string{"list", "-deps", "-f", "{{if not .Standard}}{{.ImportPath}}{{end}}"}, packageArgs()...)...)
+		list.Env = append(os.Environ(), targetGoEnv...)
+		output, err := list.Output()
+		if err != nil {
+			debugf("lrt: warm build: could not list dependencies: %s\n", err)
+			return
+		}
+		deps := thirdPartyPackages(output)
+		if len(deps) == 0 {
+			return
+		}
+
+		// the same flags as the real build, so that it can use what is cached
+		build := exec.Command(*goFlag, append(append([]string{"build"}, buildArgs...), deps...)...)
+		build.Env = append(os.Environ(), targetGoEnv...)
+		if output, err := build.CombinedOutput(); err != nil {
+			debugf("lrt: warm build: %s\n%s", err, output)
+			return
+		}
+		debugf("lrt: warm build: built %d dependencies in %s\n", len(deps), time.Since(started).Round(time.Millisecond))
+	}()
+}
+
+// waitForWarmBuild waits for startWarmBuild, so that the first build doesn't
+// compile the same packages at the same time
+func waitForWarmBuild() {
+	if warmBuildDone == nil {
+		return
+	}
+	select {
+	case <-warmBuildDone:
+	default:
+		debugf("lrt: waiting for the warm build to finish\n")
+		<-warmBuildDone
+	}
+	warmBuildDone = nil
+}
+
+// thirdPartyPackages picks the packages from go list's output that aren't in
+// the main module (or the .go files lrt was given)
+func thirdPartyPackages(output []byte) []string {
+	deps := []string{}
+	for _, p := range strings.Split(string(output), "\n") {
+		p = strings.TrimSpace(p)
+		if p == "" || p == "command-line-arguments" {
+			continue
+		}
+		if goModule != nil && (p == goModule.Name || strings.HasPrefix(p, goModule.Name+"/")) {
+			continue
+		}
+		deps = append(deps, p)
+	}
+	return deps
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmupRequest is a request recorded by -warmup, to be replayed after the
+// service restarts
+type warmupRequest struct {
+	uri    string
+	host   string
+	header http.Header
+}
+
+var (
+	warmupLock     sync.Mutex
+	warmupRequests []*warmupRequest
+)
+
+var warmupClient = &http.Client{
+	Transport: serviceTransport,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// withWarmupRecording remembers the last -warmup distinct GET requests (that
+// match -warmup-path), including their cookies, so that replayWarmup can send
+// them again after the service restarts. Event streams are not recorded, as
+// they only end when the service does.
+func withWarmupRecording(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		// recorded afterwards, so that a request waiting for the service to
+		// boot isn't replayed ahead of itself
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			return
+		}
+		if r.Method == http.MethodGet && r.Header.Get("Upgrade") == "" && (warmupPathPattern == nil || warmupPathPattern.MatchString(r.URL.Path)) {
+			recordWarmupRequest(&warmupRequest{uri: r.URL.RequestURI(), host: r.Host, header: r.Header.Clone()})
+		}
+	})
+}
+
+func recordWarmupRequest(req *warmupRequest) {
+	warmupLock.Lock()
+	defer warmupLock.Unlock()
+
+	// the most recently requested are kept at the end
+	for i, r := range warmupRequests {
+		if r.uri == req.uri {
+			warmupRequests = append(warmupRequests[:i], warmupRequests[i+1:]...)
+			break
+		}
+	}
+	warmupRequests = append(warmupRequests, req)
+	if len(warmupRequests) > *warmupFlag {
+		warmupRequests = warmupRequests[len(warmupRequests)-*warmupFlag:]
+	}
+}
+
+// replayWarmup sends the recorded requests to the service, one at a time, so
+// that caches are full (and lazy initialization has happened) before it is
+// sent real requests. The caller must hold the write lock on the proxy, so
+// together they take no longer than -health-check-timeout.
+func replayWarmup() {
+	warmupLock.Lock()
+	requests := append([]*warmupRequest{}, warmupRequests...)
+	warmupLock.Unlock()
+	if len(requests) == 0 {
+		return
+	}
+
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeoutFlag)
+	defer cancel()
+	failed := 0
+	for _, r := range requests {
+		if ctx.Err() != nil {
+			fmt.Fprintf(stderr, "lrt: warning: warmup took longer than -health-check-timeout %s, skipping the rest\n", *timeoutFlag)
+			break
+		}
+		if err := sendWarmupRequest(ctx, r); err != nil {
+			failed++
+			fmt.Fprintf(stderr, "lrt: warning: warmup request GET %s failed: %s\n", r.uri, err)
+		}
+	}
+	emit("service-warmed-up", event{"requests": len(requests), "failed": failed, "duration_ms": time.Since(started).Milliseconds()})
+}
+
+func sendWarmupRequest(ctx context.Context, r *warmupRequest) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", serviceURL.Scheme+"://"+serviceURL.Host+r.uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = r.header.Clone()
+	req.Host = r.host
+	req.Header.Set("X-Lrt-Warmup", "true")
+
+	resp, err := warmupClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
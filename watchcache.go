@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// watchCacheFile is where the directories lrt watches are remembered between
+// runs, so that on a large project lrt can start watching and building
+// without waiting for go list. It is keyed by everything that changes what
+// go list would say: go.mod, the package, and how it is built. Outside a
+// module there is nothing to key it by, so nothing is cached.
+func watchCacheFile() string {
+	if goModule == nil {
+		return ""
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	mod, err := ioutil.ReadFile(filepath.Join(goModuleDir, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	cwd, _ := os.Getwd()
+	hash := sha256.New()
+	hash.Write(mod)
+	for _, s := range [][]string{{cwd}, packageArgs(), targetGoEnv, buildArgs} {
+		hash.Write([]byte(strings.Join(s, "\x00") + "\n"))
+	}
+	return filepath.Join(dir, "lrt", "watch-"+hex.EncodeToString(hash.Sum(nil))[:16]+".json")
+}
+
+// loadWatchCache watches the directories cached by saveWatchCache, returning
+// false if there weren't any
+func loadWatchCache() bool {
+	file := watchCacheFile()
+	if file == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	dirs := []string{}
+	if err := json.Unmarshal(data, &dirs); err != nil || len(dirs) == 0 {
+		return false
+	}
+	for _, dir := range dirs {
+		// skip directories that have been deleted since
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			watchDir(dir)
+		}
+	}
+	debugf("lrt: watching %d directories from %s\n", len(dirs), file)
+	return true
+}
+
+// saveWatchCache remembers the directories being watched for next time.
+// Failing to is only slower, so errors are ignored.
+func saveWatchCache() {
+	file := watchCacheFile()
+	if file == "" {
+		return
+	}
+	watchLock.Lock()
+	dirs := make([]string, 0, len(watchedDir))
+	for dir := range watchedDir {
+		dirs = append(dirs, dir)
+	}
+	watchLock.Unlock()
+	sort.Strings(dirs)
+
+	data, err := json.Marshal(dirs)
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(file), 0755)
+	ioutil.WriteFile(file, data, 0644)
+}
+
+// refreshWatchCache runs go list after the cached directories have been
+// watched, to catch any packages that were imported since they were cached.
+// If it fails the build will too, and say why.
+func refreshWatchCache() {
+	output, err := listDependencies()
+	if err != nil {
+		debugf("lrt: could not list dependencies: %s\n", err)
+		return
+	}
+	watchDependencies(output)
+	saveWatchCache()
+}
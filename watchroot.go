@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// watchRootDir is the directory -watch-root watches: the module, or the current
+// directory if there isn't one
+func watchRootDir() string {
+	if goModuleDir != "" {
+		return goModuleDir
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+// watchTree watches dir and every directory below it, except those that
+// isIgnoredDir skips.
+func watchTree(root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != root && isIgnoredDir(path) {
+			return filepath.SkipDir
+		}
+		watchDir(path)
+		return nil
+	})
+}
+
+// isIgnoredDir is true for directories that -watch-root doesn't watch: those
+// go ignores (starting with . or _, and testdata), node_modules, and any
+// matching -watch-ignore by name or by path relative to watchRootDir.
+func isIgnoredDir(dir string) bool {
+	name := filepath.Base(dir)
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "node_modules" {
+		return true
+	}
+	rel, err := filepath.Rel(watchRootDir(), dir)
+	if err != nil {
+		rel = dir
+	}
+	for _, pattern := range *watchIgnoreFlag {
+		pattern = strings.TrimSuffix(filepath.ToSlash(pattern), "/")
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.ToSlash(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
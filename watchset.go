@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirkon/goproxy/gomod"
+)
+
+// watchSet describes what lrt is watching, grouped by module, so that you can
+// find out why saving a file did (or didn't) rebuild your service without
+// restarting lrt with -verbose.
+type watchSet struct {
+	Dirs    int             `json:"dirs"`
+	Polled  int             `json:"polled"`
+	Modules []watchedModule `json:"modules"`
+	File    *fileCheck      `json:"file,omitempty"`
+}
+
+// watchedModule is a module and the directories being watched in it. In
+// GOPATH mode Module is empty and Dir is the src directory of a $GOPATH entry;
+// outside both they are empty.
+type watchedModule struct {
+	Module string         `json:"module,omitempty"`
+	Dir    string         `json:"dir,omitempty"`
+	Dirs   []watchedEntry `json:"dirs"`
+}
+
+// watchedEntry is a watched directory, and the .go files in it that the
+// service is built from (once findDependencies has run)
+type watchedEntry struct {
+	Dir     string   `json:"dir"`
+	Polled  bool     `json:"polled,omitempty"`
+	Files   []string `json:"files,omitempty"`
+	Ignored []string `json:"ignored,omitempty"` // excluded by build constraints
+}
+
+// fileCheck says whether changing a file would rebuild the service, and why
+type fileCheck struct {
+	File     string `json:"file"`
+	Rebuilds bool   `json:"rebuilds"`
+	Reason   string `json:"reason"`
+}
+
+func currentWatchSet() watchSet {
+	watchLock.Lock()
+	entries := make([]watchedEntry, 0, len(watchedDir))
+	for dir := range watchedDir {
+		entries = append(entries, watchedEntry{Dir: dir, Polled: isPolled(dir)})
+	}
+	watchLock.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Dir < entries[j].Dir })
+
+	set := watchSet{Dirs: len(entries)}
+	modules := map[string]*watchedModule{}
+	dependencyLock.Lock()
+	for _, entry := range entries {
+		for file, built := range dependencyFiles[entry.Dir] {
+			if built {
+				entry.Files = append(entry.Files, file)
+			} else {
+				entry.Ignored = append(entry.Ignored, file)
+			}
+		}
+		sort.Strings(entry.Files)
+		sort.Strings(entry.Ignored)
+		if entry.Polled {
+			set.Polled++
+		}
+
+		name, root := moduleOf(entry.Dir)
+		module := modules[root]
+		if module == nil {
+			module = &watchedModule{Module: name, Dir: root}
+			modules[root] = module
+		}
+		module.Dirs = append(module.Dirs, entry)
+	}
+	dependencyLock.Unlock()
+
+	set.Modules = []watchedModule{}
+	for _, module := range modules {
+		set.Modules = append(set.Modules, *module)
+	}
+	// the main module first, then the rest by path
+	sort.Slice(set.Modules, func(i, j int) bool {
+		a, b := set.Modules[i], set.Modules[j]
+		if (a.Dir == goModuleDir) != (b.Dir == goModuleDir) {
+			return a.Dir == goModuleDir
+		}
+		if a.Module != b.Module {
+			return a.Module < b.Module
+		}
+		return a.Dir < b.Dir
+	})
+	return set
+}
+
+// moduleOf finds the module dir is in, by looking for a go.mod in it or its
+// parents. Failing that it returns the $GOPATH entry dir is in (with an empty
+// name), or empty strings.
+func moduleOf(dir string) (name string, root string) {
+	if goModule != nil && (dir == goModuleDir || strings.HasPrefix(dir, goModuleDir+string(filepath.Separator))) {
+		return goModule.Name, goModuleDir
+	}
+	for root = dir; ; root = filepath.Dir(root) {
+		file := filepath.Join(root, "go.mod")
+		if contents, err := ioutil.ReadFile(file); err == nil {
+			if mod, err := gomod.Parse(file, contents); err == nil {
+				return mod.Name, root
+			}
+			return filepath.Base(root), root
+		}
+		if filepath.Dir(root) == root {
+			return "", gopathSrcOf(dir)
+		}
+	}
+}
+
+// checkFile says whether changing name would rebuild the service, using the
+// same rules as watchForChanges. Relative names are relative to where lrt was
+// started.
+func checkFile(name string) fileCheck {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		abs = name
+	}
+	dir := filepath.Dir(abs)
+	watchLock.Lock()
+	watched, polled := watchedDir[dir], isPolled(dir)
+	watchLock.Unlock()
+
+	c := fileCheck{File: abs}
+	switch {
+	case !strings.HasSuffix(abs, ".go"):
+		c.Reason = "only .go files rebuild your service (use -reload or -browser-reload for other files)"
+	case strings.HasSuffix(abs, "_test.go"):
+		c.Reason = "tests aren't part of your service (use lrt test to rerun them on change)"
+	case !watched:
+		c.Reason = dir + " isn't being watched, because your service doesn't import a package in it"
+		if *watchRootFlag {
+			c.Reason = dir + " isn't being watched, because it isn't in " + watchRootDir() + " or is ignored"
+		}
+	case isOtherGoFile(abs):
+		c.Reason = "it isn't one of the .go files lrt was given"
+	case !isBuiltFile(abs):
+		c.Reason = "it isn't part of your service, e.g. its build constraints exclude it"
+	default:
+		c.Rebuilds = true
+		c.Reason = "it is part of your service"
+		if polled {
+			c.Reason += fmt.Sprintf(" (its directory is polled, so changes are noticed within %s)", pollInterval)
+		}
+		if atomic.LoadInt32(&paused) == 1 {
+			c.Reason += ", but rebuilding is paused"
+		}
+	}
+	return c
+}
+
+// printWatchSet writes a summary of what lrt is watching, for the w key
+func printWatchSet(w io.Writer) {
+	set := currentWatchSet()
+	fmt.Fprintf(w, "lrt: watching %d directories", set.Dirs)
+	if set.Polled > 0 {
+		fmt.Fprintf(w, " (%d by polling)", set.Polled)
+	}
+	fmt.Fprintf(w, ":\n")
+	for _, module := range set.Modules {
+		if module.Module != "" {
+			fmt.Fprintf(w, "     %s (%s)\n", module.Module, module.Dir)
+		} else if module.Dir != "" {
+			fmt.Fprintf(w, "     GOPATH %s\n", module.Dir)
+		} else {
+			fmt.Fprintf(w, "     outside a module\n")
+		}
+		for _, entry := range module.Dirs {
+			dir := entry.Dir
+			if rel, err := filepath.Rel(module.Dir, dir); err == nil && module.Dir != "" {
+				dir = "./" + filepath.ToSlash(rel)
+			}
+			if entry.Polled {
+				dir += " (polled)"
+			}
+			if len(entry.Files) > 0 {
+				dir += ": " + strings.Join(entry.Files, " ")
+			}
+			fmt.Fprintf(w, "       %s\n", dir)
+		}
+	}
+}
+
+var watchesTemplate = template.Must(template.New("watches").Funcs(template.FuncMap{"join": strings.Join}).Parse(`<!DOCTYPE html>
+<title>lrt: watches</title>
+<style>body { font-family: sans-serif } th, td { text-align: left; padding-right: 16px; vertical-align: top } small { color: #666 }</style>
+<h1>lrt is watching {{ .Dirs }} directories</h1>
+<form><input name="file" size="60" placeholder="path/to/file.go"> <button>Would saving it rebuild?</button></form>
+{{ with .File }}<p id="file"><code>{{ .File }}</code>: {{ if .Rebuilds }}yes{{ else }}no{{ end }}, {{ .Reason }}</p>{{ end }}
+{{ range .Modules }}<h2>{{ if .Module }}{{ .Module }}{{ else if .Dir }}GOPATH{{ else }}Outside a module{{ end }} <small>{{ .Dir }}</small></h2>
+<table>
+{{ range .Dirs }}<tr><td><code>{{ .Dir }}</code>{{ if .Polled }} (polled){{ end }}</td><td>{{ join .Files " " }}{{ if .Ignored }} <small>(not built: {{ join .Ignored " " }})</small>{{ end }}</td></tr>
+{{ end }}</table>
+{{ end }}`))
+
+// requestedWatchSet is the current watch set, checking the file in ?file= if
+// there is one
+func requestedWatchSet(r *http.Request) watchSet {
+	set := currentWatchSet()
+	if file := r.URL.Query().Get("file"); file != "" {
+		c := checkFile(file)
+		set.File = &c
+	}
+	return set
+}
+
+// serveWatches shows what lrt is watching as a page, or as JSON with
+// ?format=json. With ?file= it also says whether changing that file would
+// rebuild the service.
+func serveWatches(w http.ResponseWriter, r *http.Request) {
+	set := requestedWatchSet(r)
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(set)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	watchesTemplate.Execute(w, set)
+}
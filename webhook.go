@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// postToWebhook posts to -webhook when a build fails, and when the build is
+// fixed again. The payload is compatible with Slack's incoming webhooks.
+func postToWebhook(url string) {
+	host, _ := os.Hostname()
+	who := host
+	if user := os.Getenv("USER"); user != "" {
+		who = user + "@" + host
+	}
+
+	watchBuildResults(func(title string, message string) {
+		payload, _ := json.Marshal(map[string]string{
+			"text": fmt.Sprintf("lrt: %s (%s on %s)\n%s", title, packageName, who, message),
+		})
+		resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			fmt.Fprintf(stderr, "lrt: warning: could not post to -webhook: %s\n", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			fmt.Fprintf(stderr, "lrt: warning: -webhook responded with %s\n", resp.Status)
+		}
+	})
+}